@@ -21,6 +21,9 @@ func (c *ConfMgr) HandleAdminGetKeyType(w http.ResponseWriter, r *http.Request,
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
 
 	keytype, err := b.GetType(keyName)
 	if err != nil {
@@ -43,6 +46,13 @@ func (c *ConfMgr) HandleAdminKeyStore(w http.ResponseWriter, r *http.Request, b
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbWrite, keyName) {
+		return
+	}
+	expiresAt, ok := checkExpiry(w, r)
+	if !ok {
+		return
+	}
 	log.Infof("Storing key %s", keyName)
 
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
@@ -55,21 +65,324 @@ func (c *ConfMgr) HandleAdminKeyStore(w http.ResponseWriter, r *http.Request, b
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
 		return
 	}
-	err = c.SaveKeyFromJSON(keyName, body, b)
+	old, value, expires, ok := c.writeKey(w, r, keyName, KeyVersion{Op: AuditStore}, nil, func(tx backend.ConfigWriter) error {
+		if err := c.SaveKeyFromJSON(keyName, body, tx); err != nil {
+			return err
+		}
+		return setExpiry(tx, keyName, expiresAt)
+	}, b)
+	if !ok {
+		return
+	}
+	c.RecordExpiringChange(r, b, AuditStore, keyName, "", old, value, expires)
+	c.setETag(w, keyName, b)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *ConfMgr) HandleAdminKeyImpact(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	keyName := reqVars["keyName"]
+	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
+		keyName = c.Config.Main.KeyPrefix + keyName
+	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	resp, err := c.ImpactOfWrite(keyName, body, b)
+	switch err.(type) {
+	case nil:
+	case ImpactError, ScopeError:
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	default:
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, resp)
+}
+
+func (c *ConfMgr) HandleAdminScopeDiff(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	request := ScopeDiffRequestFromQuery(r.URL.Query())
+
+	if r.Method == "POST" {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+		if err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+			return
+		}
+
+		if err := r.Body.Close(); err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+			return
+		}
+
+		if err := json.Unmarshal(body, &request); err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+			return
+		}
+	}
+
+	resp, err := c.DiffScopes(request, b)
+	if _, ok := err.(ScopeError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid scope: %s", err))
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	// Hash fields are reported as name/field
+	entries := make([]ScopeDiffEntry, 0, len(resp.Data))
+	for _, entry := range resp.Data {
+		if c.Authorize(r, VerbLookup, c.lookupKey(strings.SplitN(entry.Key, "/", 2)[0])) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	resp.Data = entries
+
+	SendResponse(w, r, resp)
+}
+
+func (c *ConfMgr) HandleAdminListNodes(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	nodes, err := c.ListNodes(b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	nodes = c.filterKeys(r, VerbList, c.registryKey(""), nodes)
+
+	SendResponse(w, r, ListKeyResponse{"list", nodes})
+}
+
+func (c *ConfMgr) HandleAdminGetNode(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	identity := reqVars["identity"]
+	if !c.checkAccess(w, r, VerbRead, c.registryKey(identity)) {
+		return
+	}
+
+	facts, err := c.GetFacts(identity, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if len(facts) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "Node %s not found\n", identity)
+		return
+	}
+
+	SendResponse(w, r, HashKeyResponse{"hash", facts})
+}
+
+func (c *ConfMgr) HandleAdminStoreNode(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	identity := reqVars["identity"]
+	if !c.checkAccess(w, r, VerbWrite, c.registryKey(identity)) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var request FactsRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+
+	log.Infof("Storing facts for node %s", identity)
+	old := c.keySnapshot(c.registryKey(identity), b)
+	err = c.SetFacts(identity, request.Data, b)
+	if _, ok := err.(ScopeError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	c.RecordChange(r, b, AuditStoreNode, c.registryKey(identity), "", old, c.keySnapshot(c.registryKey(identity), b))
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *ConfMgr) HandleAdminDeleteNode(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	identity := reqVars["identity"]
+	if !c.checkAccess(w, r, VerbDelete, c.registryKey(identity)) {
+		return
+	}
+
+	old := c.keySnapshot(c.registryKey(identity), b)
+	err := c.DeleteFacts(identity, b)
 	if err != nil {
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
 		return
 	}
+	c.RecordChange(r, b, AuditDeleteNode, c.registryKey(identity), "", old, nil)
 
 	w.WriteHeader(http.StatusOK)
 }
 
+func (c *ConfMgr) HandleAdminListHierarchies(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	names := c.filterKeys(r, VerbList, hierarchyKey(c.Config.Main, c.Namespace, ""), c.HierarchyNames())
+
+	SendResponse(w, r, ListKeyResponse{"list", names})
+}
+
+/*
+ * Hierarchy routes without a name operate on the default hierarchy
+ */
+func (c *ConfMgr) hierarchyName(r *http.Request) string {
+	if name, ok := mux.Vars(r)["name"]; ok {
+		return name
+	}
+	return c.Config.Main.DefaultHierarchy
+}
+
+func (c *ConfMgr) HandleAdminGetHierarchy(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	name := c.hierarchyName(r)
+	if !c.checkAccess(w, r, VerbRead, hierarchyKey(c.Config.Main, c.Namespace, name)) {
+		return
+	}
+
+	h, ok := c.GetHierarchies()[name]
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Hierarchy %s not found", name))
+		return
+	}
+
+	SendResponse(w, r, HierarchyResponse{"hierarchy", name, h.Source, h.Version, h.Paths})
+}
+
+func (c *ConfMgr) HandleAdminStoreHierarchy(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	name := c.hierarchyName(r)
+	if !c.checkAccess(w, r, VerbWrite, hierarchyKey(c.Config.Main, c.Namespace, name)) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var request HierarchyRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+
+	old := c.hierarchyPaths(name)
+	version, err := c.StoreHierarchy(name, request.Data, b)
+	if err == nil {
+		c.RecordChange(r, b, AuditStoreHierarchy, hierarchyKey(c.Config.Main, c.Namespace, name), "", old, version.Paths)
+	}
+	c.sendHierarchyVersion(w, r, name, version, err)
+}
+
+func (c *ConfMgr) HandleAdminHierarchyHistory(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	name := c.hierarchyName(r)
+	if !c.checkAccess(w, r, VerbRead, hierarchyKey(c.Config.Main, c.Namespace, name)) {
+		return
+	}
+
+	history, err := c.HierarchyHistory(name, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, HierarchyHistoryResponse{"history", history})
+}
+
+func (c *ConfMgr) HandleAdminRevertHierarchy(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	name := c.hierarchyName(r)
+	if !c.checkAccess(w, r, VerbWrite, hierarchyKey(c.Config.Main, c.Namespace, name)) {
+		return
+	}
+
+	version, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid version: %s", err))
+		return
+	}
+
+	old := c.hierarchyPaths(name)
+	entry, err := c.RevertHierarchy(name, version, b)
+	if err == nil {
+		c.RecordChange(r, b, AuditRevertHierarchy, hierarchyKey(c.Config.Main, c.Namespace, name), "", old, entry.Paths)
+	}
+	c.sendHierarchyVersion(w, r, name, entry, err)
+}
+
+/*
+ * Current paths of a hierarchy, nil if it does not exist
+ */
+func (c *ConfMgr) hierarchyPaths(name string) interface{} {
+	if h, ok := c.GetHierarchies()[name]; ok {
+		return h.Paths
+	}
+	return nil
+}
+
+func (c *ConfMgr) sendHierarchyVersion(w http.ResponseWriter, r *http.Request, name string, version HierarchyVersion, err error) {
+	if _, ok := err.(HierarchyError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid hierarchy: %s", err))
+		return
+	}
+	if err == backend.ErrConflict {
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, HierarchyResponse{"hierarchy", name, "backend", version.Version, version.Paths})
+}
+
 func (c *ConfMgr) HandleAdminListHashFields(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
 
 	value, err := b.GetHash(keyName)
 	if err != nil {
@@ -90,12 +403,13 @@ func (c *ConfMgr) HandleAdminListHashFields(w http.ResponseWriter, r *http.Reque
 }
 
 func (c *ConfMgr) HandleAdminListKeys(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
-	resp, err := c.ListKeys("", b)
+	resp, err := c.ListKeys(c.Config.Main.KeyPrefix+"*", b)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "Backend error: %s\n", err)
 		return
 	}
+	resp.Data = c.filterKeys(r, VerbList, c.Config.Main.KeyPrefix, resp.Data)
 
 	SendResponse(w, r, resp)
 }
@@ -113,10 +427,15 @@ func (c *ConfMgr) HandleAdminListKeysFiltered(w http.ResponseWriter, r *http.Req
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
 		return
 	}
+	resp.Data = c.filterKeys(r, VerbList, c.Config.Main.KeyPrefix, resp.Data)
 
 	SendResponse(w, r, resp)
 }
 
+/*
+ * List the keys of this namespace matching a pattern. Other namespaces
+ * and internal data share the backend and are left out.
+ */
 func (c *ConfMgr) ListKeys(filter string, b backend.ConfigBackend) (ListKeyResponse, error) {
 	var resp ListKeyResponse
 	keys, err := b.ListKeys(filter)
@@ -126,10 +445,13 @@ func (c *ConfMgr) ListKeys(filter string, b backend.ConfigBackend) (ListKeyRespo
 	}
 
 	resp.Type = "list"
-	resp.Data = make([]string, len(keys))
+	resp.Data = make([]string, 0, len(keys))
 
-	for idx, key := range keys {
-		resp.Data[idx] = strings.TrimPrefix(key, c.Config.Main.KeyPrefix)
+	for _, key := range keys {
+		if !strings.HasPrefix(key, c.Config.Main.KeyPrefix) || strings.HasPrefix(key, c.Config.Main.MetaPrefix) {
+			continue
+		}
+		resp.Data = append(resp.Data, strings.TrimPrefix(key, c.Config.Main.KeyPrefix))
 	}
 
 	sort.Strings(resp.Data)
@@ -143,12 +465,17 @@ func (c *ConfMgr) HandleAdminKeyDelete(w http.ResponseWriter, r *http.Request, b
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbDelete, keyName) {
+		return
+	}
 
-	err := b.DeleteKey(keyName)
-	if err != nil {
-		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+	old, value, _, ok := c.writeKey(w, r, keyName, KeyVersion{Op: AuditDelete}, nil, func(tx backend.ConfigWriter) error {
+		return tx.DeleteKey(keyName)
+	}, b)
+	if !ok {
 		return
 	}
+	c.RecordChange(r, b, AuditDelete, keyName, "", old, value)
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -160,6 +487,13 @@ func (c *ConfMgr) HandleAdminListAppend(w http.ResponseWriter, r *http.Request,
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbWrite, keyName) {
+		return
+	}
+	expiresAt, ok := checkExpiry(w, r)
+	if !ok {
+		return
+	}
 
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
@@ -173,17 +507,22 @@ func (c *ConfMgr) HandleAdminListAppend(w http.ResponseWriter, r *http.Request,
 	}
 
 	log.Infof("List append to %s: '%s'", keyName, body)
-	err = c.ListAppendFromJSON(keyName, body, b)
-
-	if err != nil {
-		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+	old, value, expires, ok := c.writeKey(w, r, keyName, KeyVersion{Op: AuditListAppend}, requireType(keyName, vars.TYPE_LIST), func(tx backend.ConfigWriter) error {
+		if err := c.ListAppendFromJSON(keyName, body, tx); err != nil {
+			return err
+		}
+		return setExpiry(tx, keyName, expiresAt)
+	}, b)
+	if !ok {
 		return
 	}
+	c.RecordExpiringChange(r, b, AuditListAppend, keyName, "", old, value, expires)
+	c.setETag(w, keyName, b)
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (c *ConfMgr) ListAppendFromJSON(keyName string, jsondata []byte, b backend.ConfigBackend) error {
+func (c *ConfMgr) ListAppendFromJSON(keyName string, jsondata []byte, b backend.ConfigWriter) error {
 	var request DataRequest
 
 	if err := json.Unmarshal(jsondata, &request); err != nil {
@@ -199,6 +538,13 @@ func (c *ConfMgr) HandleAdminSetHashField(w http.ResponseWriter, r *http.Request
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbWrite, keyName) {
+		return
+	}
+	expiresAt, ok := checkExpiry(w, r)
+	if !ok {
+		return
+	}
 
 	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
 	if err != nil {
@@ -212,17 +558,23 @@ func (c *ConfMgr) HandleAdminSetHashField(w http.ResponseWriter, r *http.Request
 	}
 
 	log.Infof("Set hfield %s/%s to '%s'", keyName, fieldName, body)
-	err = c.SetHashFieldFromJSON(keyName, fieldName, body, b)
-
-	if err != nil {
-		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+	oldField := c.auditHashField(keyName, fieldName, b)
+	_, _, expires, ok := c.writeKey(w, r, keyName, KeyVersion{Op: AuditSetHashField}, requireType(keyName, vars.TYPE_HASH), func(tx backend.ConfigWriter) error {
+		if err := c.SetHashFieldFromJSON(keyName, fieldName, body, tx); err != nil {
+			return err
+		}
+		return setExpiry(tx, keyName, expiresAt)
+	}, b)
+	if !ok {
 		return
 	}
+	c.RecordExpiringChange(r, b, AuditSetHashField, keyName, fieldName, oldField, c.auditHashField(keyName, fieldName, b), expires)
+	c.setETag(w, keyName, b)
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (c *ConfMgr) SetHashFieldFromJSON(keyName string, fieldName string, jsondata []byte, b backend.ConfigBackend) error {
+func (c *ConfMgr) SetHashFieldFromJSON(keyName string, fieldName string, jsondata []byte, b backend.ConfigWriter) error {
 	var request DataRequest
 
 	if err := json.Unmarshal(jsondata, &request); err != nil {
@@ -233,7 +585,7 @@ func (c *ConfMgr) SetHashFieldFromJSON(keyName string, fieldName string, jsondat
 	return b.SetHashField(keyName, fieldName, request.Data)
 }
 
-func (c *ConfMgr) SaveKeyFromJSON(keyName string, jsondata []byte, b backend.ConfigBackend) error {
+func (c *ConfMgr) SaveKeyFromJSON(keyName string, jsondata []byte, b backend.ConfigWriter) error {
 	var err error
 
 	var keyEntry GenericRequest
@@ -244,29 +596,29 @@ func (c *ConfMgr) SaveKeyFromJSON(keyName string, jsondata []byte, b backend.Con
 
 	switch keyEntry.Type {
 	case "string":
-		c.StoreString(keyName, keyEntry.AsString(), b)
+		err = c.StoreString(keyName, keyEntry.AsString(), b)
 	case "hash":
-		c.StoreHash(keyName, keyEntry.AsHash(), b)
+		err = c.StoreHash(keyName, keyEntry.AsHash(), b)
 	case "list":
-		c.StoreList(keyName, keyEntry.AsList(), b)
+		err = c.StoreList(keyName, keyEntry.AsList(), b)
 	default:
-		log.Print("ERROR")
+		err = fmt.Errorf("Unsupported key type: %s", keyEntry.Type)
 	}
 
 	return err
 }
 
-func (c *ConfMgr) StoreString(keyName string, data StringKeyResponse, b backend.ConfigBackend) error {
+func (c *ConfMgr) StoreString(keyName string, data StringKeyResponse, b backend.ConfigWriter) error {
 	err := b.SetString(keyName, data.Data)
 	return err
 }
 
-func (c *ConfMgr) StoreHash(keyName string, data HashKeyResponse, b backend.ConfigBackend) error {
+func (c *ConfMgr) StoreHash(keyName string, data HashKeyResponse, b backend.ConfigWriter) error {
 	err := b.SetHash(keyName, data.Data)
 	return err
 }
 
-func (c *ConfMgr) StoreList(keyName string, data ListKeyResponse, b backend.ConfigBackend) error {
+func (c *ConfMgr) StoreList(keyName string, data ListKeyResponse, b backend.ConfigWriter) error {
 	err := b.SetList(keyName, data.Data)
 	return err
 }
@@ -280,57 +632,100 @@ func (c *ConfMgr) HandleAdminKeyGet(w http.ResponseWriter, r *http.Request, b ba
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
-	keytype, err := b.GetType(keyName)
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
+	resp, err := c.ReadKey(keyName, b)
 	if err != nil {
 		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
 		return
 	}
 
-	var resp KeyResponse
-
-	switch keytype {
-	case vars.TYPE_NOT_FOUND:
+	if resp == nil {
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, "Key %s not found\n", keyName)
 		return
+	}
+
+	etag, err := KeyETag(resp)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	if at := c.setExpiryHeaders(w, keyName, b); !at.IsZero() {
+		resp = ExpiringKeyResponse{resp, at}
+	}
+	sendWithETag(w, r, resp, etag)
+
+}
+
+/*
+ * Read an absolute key of any type. Returns nil if the key does not exist
+ */
+func (c *ConfMgr) ReadKey(keyName string, b backend.ConfigBackend) (KeyResponse, error) {
+	keytype, err := b.GetType(keyName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keytype {
+	case vars.TYPE_NOT_FOUND:
+		return nil, nil
 	case vars.TYPE_STRING:
 		value, err := b.GetString(keyName)
 		if err != nil {
-			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
-			return
+			return nil, err
 		}
-		resp = &StringKeyResponse{
+		return &StringKeyResponse{
 			Type: TypeToString(keytype),
 			Data: value,
-		}
+		}, nil
 	case vars.TYPE_LIST:
 		value, err := b.GetList(keyName)
 		if err != nil {
-			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
-			return
+			return nil, err
 		}
-		resp = &ListKeyResponse{
+		return &ListKeyResponse{
 			Type: TypeToString(keytype),
 			Data: value,
-		}
+		}, nil
 	case vars.TYPE_HASH:
 		value, err := b.GetHash(keyName)
 		if err != nil {
-			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
-			return
+			return nil, err
 		}
-
-		resp = &HashKeyResponse{
+		return &HashKeyResponse{
 			Type: TypeToString(keytype),
 			Data: value,
-		}
+		}, nil
 	default:
-		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Unsupported key type: %s", TypeToString(keytype)))
+		return nil, fmt.Errorf("Unsupported key type: %s", TypeToString(keytype))
+	}
+}
+
+func (c *ConfMgr) HandleAdminLocateKey(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	keyName := reqVars["keyName"]
+
+	resp, err := c.LocateKey(keyName, b)
+	if _, ok := err.(LocateError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
 		return
 	}
 
-	SendResponse(w, r, resp)
+	located := make([]LocatedKey, 0, len(resp.Data))
+	for _, entry := range resp.Data {
+		if c.Authorize(r, VerbRead, entry.Key) == nil {
+			located = append(located, entry)
+		}
+	}
+	resp.Data = located
 
+	SendResponse(w, r, resp)
 }
 
 func (c *ConfMgr) HandleAdminGetHashField(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
@@ -339,6 +734,9 @@ func (c *ConfMgr) HandleAdminGetHashField(w http.ResponseWriter, r *http.Request
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
 	fieldName := reqVars["fieldName"]
 
 	keytype, err := b.GetType(keyName)
@@ -382,7 +780,14 @@ func (c *ConfMgr) HandleAdminGetHashField(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	SendResponse(w, r, resp)
+	// Tagged with the whole key, so it can be used for If-Match on writes
+	etag, err := c.currentETag(keyName, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	c.setExpiryHeaders(w, keyName, b)
+	sendWithETag(w, r, resp, etag)
 }
 
 func (c *ConfMgr) HandleAdminGetListIndex(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
@@ -391,6 +796,9 @@ func (c *ConfMgr) HandleAdminGetListIndex(w http.ResponseWriter, r *http.Request
 	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
 		keyName = c.Config.Main.KeyPrefix + keyName
 	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
 	listIndex, _ := strconv.ParseInt(reqVars["listIndex"], 10, 64)
 
 	keytype, err := b.GetType(keyName)
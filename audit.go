@@ -0,0 +1,442 @@
+package confmgr
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/config"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditStore           = "store"
+	AuditDelete          = "delete"
+	AuditListAppend      = "list_append"
+	AuditSetHashField    = "set_hash_field"
+	AuditStoreNode       = "store_node"
+	AuditDeleteNode      = "delete_node"
+	AuditStoreHierarchy  = "store_hierarchy"
+	AuditRevertHierarchy = "revert_hierarchy"
+	AuditRollback        = "rollback"
+	AuditTxn             = "txn"
+	AuditScheduled       = "scheduled"
+)
+
+// Recorded instead of values whose key or field matches audit.redact
+const RedactedValue = "[redacted]"
+
+/*
+ * A single change made through the admin API
+ */
+type AuditEntry struct {
+	Time      time.Time   `json:"time"`
+	Identity  string      `json:"identity"`
+	Client    string      `json:"client"`
+	Namespace string      `json:"namespace"`
+	Op        string      `json:"op"`
+	Key       string      `json:"key"`
+	Field     string      `json:"field,omitempty"`
+	Old       interface{} `json:"old,omitempty"`
+	New       interface{} `json:"new,omitempty"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+type AuditResponse struct {
+	Type string       `json:"type"`
+	Data []AuditEntry `json:"data"`
+}
+
+func (r AuditResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, entry := range r.Data {
+		key := entry.Key
+		if entry.Field != "" {
+			key += "/" + entry.Field
+		}
+		lines[idx] = fmt.Sprintf("%s %s %s %s", entry.Time.Format(time.RFC3339), entry.Identity, entry.Op, key)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r AuditResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * Selects audit entries, empty fields match everything
+ */
+type AuditFilter struct {
+	From      time.Time
+	To        time.Time
+	Namespace string
+	Key       string
+	User      string
+	Op        string
+	// Return only the newest entries
+	Limit int
+}
+
+func (f AuditFilter) Matches(entry AuditEntry) bool {
+	if !f.From.IsZero() && entry.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && entry.Time.After(f.To) {
+		return false
+	}
+	if f.Namespace != "" && entry.Namespace != f.Namespace {
+		return false
+	}
+	if f.Op != "" && entry.Op != f.Op {
+		return false
+	}
+	if f.Key != "" {
+		if matched, _ := path.Match(f.Key, entry.Key); !matched {
+			return false
+		}
+	}
+	if f.User != "" {
+		name := entry.Identity
+		if idx := strings.Index(name, ":"); idx >= 0 {
+			name = name[idx+1:]
+		}
+		if !matchAny([]string{f.User}, entry.Identity, name) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Append-only record of admin changes, kept in a JSONL file or in a
+ * backend list
+ */
+type AuditLog struct {
+	Sink   string
+	File   string
+	Key    string
+	Redact []string
+	// Entries kept by the backend sink, 0 keeps all
+	MaxEntries int64
+
+	mu sync.Mutex
+}
+
+/*
+ * Compile the audit settings, nil if auditing is disabled
+ */
+func NewAuditLog(cfg config.AuditConfig, metaPrefix string) (*AuditLog, error) {
+	if cfg.Sink == "" {
+		return nil, nil
+	}
+
+	a := &AuditLog{
+		Sink:       cfg.Sink,
+		File:       cfg.File,
+		Key:        metaPrefix + "audit",
+		Redact:     make([]string, len(cfg.Redact)),
+		MaxEntries: int64(cfg.MaxEntries),
+	}
+	for idx, pattern := range cfg.Redact {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return a, fmt.Errorf("audit.redact: invalid pattern '%s': %s", pattern, err)
+		}
+		a.Redact[idx] = strings.ToLower(pattern)
+	}
+
+	switch cfg.Sink {
+	case "backend":
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return a, fmt.Errorf("audit.file: %s", err)
+		}
+		f.Close()
+	default:
+		return a, fmt.Errorf("audit.sink: unsupported sink '%s'", cfg.Sink)
+	}
+
+	return a, nil
+}
+
+func (a *AuditLog) redacted(name string) bool {
+	return name != "" && matchAny(a.Redact, strings.ToLower(name))
+}
+
+/*
+ * Hide values of sensitive keys, and of sensitive fields within hashes
+ */
+func (a *AuditLog) RedactValue(key string, field string, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if a.redacted(key) || a.redacted(field) {
+		return RedactedValue
+	}
+
+	if hash, ok := value.(*HashKeyResponse); ok {
+		data := make(map[string]string)
+		for name, fieldValue := range hash.Data {
+			if a.redacted(name) {
+				fieldValue = RedactedValue
+			}
+			data[name] = fieldValue
+		}
+		return &HashKeyResponse{hash.Type, data}
+	}
+	return value
+}
+
+func (a *AuditLog) Write(entry AuditEntry, b backend.ConfigBackend) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if a.Sink == "backend" {
+		return b.Atomic(nil, func() error { return nil }, func(w backend.ConfigWriter) error {
+			if err := w.ListAppend(a.Key, string(line)); err != nil {
+				return err
+			}
+			if a.MaxEntries > 0 {
+				return w.ListTrim(a.Key, -a.MaxEntries, -1)
+			}
+			return nil
+		})
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.OpenFile(a.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries, or bytes of the file sink, read per step when scanning backwards
+const auditReadSize = 1000
+
+/*
+ * Call visit with the lines of the log, newest first, until it returns
+ * false
+ */
+func (a *AuditLog) readBackwards(visit func(string) bool, b backend.ConfigBackend) error {
+	if a.Sink == "backend" {
+		for stop := int64(-1); ; stop -= auditReadSize {
+			lines, err := b.GetListRange(a.Key, stop-auditReadSize+1, stop)
+			if err != nil {
+				return err
+			}
+			for idx := len(lines) - 1; idx >= 0; idx-- {
+				if !visit(lines[idx]) {
+					return nil
+				}
+			}
+			if len(lines) < auditReadSize {
+				return nil
+			}
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, err := os.Open(a.File)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Start of a line continued in the block after the one being read
+	partial := []byte{}
+	for offset := info.Size(); offset > 0; {
+		size := int64(auditReadSize * 64)
+		if size > offset {
+			size = offset
+		}
+		offset -= size
+		block := make([]byte, size, size+int64(len(partial)))
+		if _, err := f.ReadAt(block, offset); err != nil {
+			return err
+		}
+		block = append(block, partial...)
+
+		lines := bytes.Split(block, []byte{'\n'})
+		partial = lines[0]
+		for idx := len(lines) - 1; idx >= 1; idx-- {
+			if len(lines[idx]) > 0 && !visit(string(lines[idx])) {
+				return nil
+			}
+		}
+	}
+	if len(partial) > 0 {
+		visit(string(partial))
+	}
+	return nil
+}
+
+/*
+ * Return the newest entries matching a filter, oldest first. Only as much
+ * of the log is read as needed to find filter.Limit entries.
+ */
+func (a *AuditLog) Query(filter AuditFilter, b backend.ConfigBackend) ([]AuditEntry, error) {
+	entries := make([]AuditEntry, 0)
+	err := a.readBackwards(func(line string) bool {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			log.Warnf("Skipping invalid audit entry: %s", err)
+			return true
+		}
+		if filter.Matches(entry) {
+			entries = append(entries, entry)
+		}
+		return filter.Limit <= 0 || len(entries) < filter.Limit
+	}, b)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+func (c *ConfMgr) auditHashField(keyName string, fieldName string, b backend.ConfigBackend) interface{} {
+	if c.Audit == nil {
+		return nil
+	}
+	if exists, err := b.HashFieldExists(keyName, fieldName); err != nil || !exists {
+		return nil
+	}
+	value, err := b.GetHashField(keyName, fieldName)
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+/*
+ * Record a change made by a request. Failures are logged, the change
+ * itself has already been made.
+ */
+func (c *ConfMgr) RecordChange(r *http.Request, b backend.ConfigBackend, op string, key string, field string, oldValue interface{}, newValue interface{}) {
+	c.RecordExpiringChange(r, b, op, key, field, oldValue, newValue, time.Time{})
+}
+
+/*
+ * Record a change that left the key expiring at the given time, zero if
+ * it does not expire
+ */
+func (c *ConfMgr) RecordExpiringChange(r *http.Request, b backend.ConfigBackend, op string, key string, field string, oldValue interface{}, newValue interface{}, expiresAt time.Time) {
+	if c.Audit == nil {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Identity:  AnonymousIdentity,
+		Client:    r.RemoteAddr,
+		Namespace: c.Namespace,
+		Op:        op,
+		Key:       key,
+		Field:     field,
+		Old:       c.Audit.RedactValue(key, field, oldValue),
+		New:       c.Audit.RedactValue(key, field, newValue),
+		ExpiresAt: expiryField(expiresAt),
+	}
+	if principal := RequestPrincipal(r); principal != nil {
+		entry.Identity = principal.String()
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.Client = host
+	}
+
+	if err := c.Audit.Write(entry, b); err != nil {
+		log.Errorf("Cannot write audit entry for %s on %s: %s", op, key, err)
+	}
+}
+
+/*
+ * Query the audit log: ?from=&to= (RFC3339), key (glob), user (glob),
+ * op and limit (default 100)
+ */
+func (c *ConfMgr) HandleAdminAudit(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	if c.Audit == nil {
+		SendErrorResponse(w, http.StatusNotFound, "Auditing is not enabled")
+		return
+	}
+	if !c.checkAccess(w, r, VerbRead, c.Audit.Key) {
+		return
+	}
+
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Namespace: c.Namespace,
+		Key:       query.Get("key"),
+		User:      query.Get("user"),
+		Op:        query.Get("op"),
+		Limit:     100,
+	}
+	if filter.Key != "" && !strings.HasPrefix(filter.Key, c.Config.Main.KeyPrefix) && !strings.HasPrefix(filter.Key, c.Config.Main.MetaPrefix) {
+		filter.Key = c.Config.Main.KeyPrefix + filter.Key
+	}
+	for name, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s: %s", name, err))
+				return
+			}
+			*target = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid limit: %s", value))
+			return
+		}
+		filter.Limit = limit
+	}
+
+	entries, err := c.Audit.Query(filter, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	// Only show changes to keys the client may read
+	allowed := make([]AuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		if c.Authorize(r, VerbRead, entry.Key) == nil {
+			allowed = append(allowed, entry)
+		}
+	}
+
+	SendResponse(w, r, AuditResponse{"audit", allowed})
+}
@@ -0,0 +1,201 @@
+package confmgr
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gorilla/context"
+	"github.com/moensch/confmgr/config"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	AuthToken = "token"
+	AuthBasic = "basic"
+	AuthMTLS  = "mtls"
+	AuthJWT   = "jwt"
+)
+
+/*
+ * An authenticated client
+ */
+type Principal struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	// Set from JWT claims, nil for other methods
+	Scope       map[string]string `json:"scope,omitempty"`
+	Permissions []Permission      `json:"permissions,omitempty"`
+}
+
+func (p *Principal) String() string {
+	return p.Method + ":" + p.Name
+}
+
+type AuthRule struct {
+	Routes  string
+	Require bool
+	Methods []string
+}
+
+type Authenticator struct {
+	Tokens map[string]string
+	Users  map[string][]byte
+	MTLS   bool
+	JWT    *JWTVerifier
+	Rules  []AuthRule
+}
+
+/*
+ * Admin routes need credentials unless a rule says otherwise
+ */
+var defaultAuthRules = []AuthRule{
+	AuthRule{Routes: "HandleAdmin*", Require: true},
+}
+
+type AuthError struct {
+	Message string
+}
+
+func (e AuthError) Error() string {
+	return e.Message
+}
+
+/*
+ * Compile the auth settings, nil if authentication is disabled
+ */
+func NewAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	a := &Authenticator{
+		Tokens: make(map[string]string),
+		Users:  make(map[string][]byte),
+		MTLS:   cfg.MTLS,
+		Rules:  make([]AuthRule, 0, len(cfg.Rules)+len(defaultAuthRules)),
+	}
+
+	for name, token := range cfg.Tokens {
+		if token == "" {
+			return a, fmt.Errorf("auth.tokens.%s: must not be empty", name)
+		}
+		a.Tokens[name] = token
+	}
+	for name, hash := range cfg.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return a, fmt.Errorf("auth.users.%s: not a bcrypt hash: %s", name, err)
+		}
+		a.Users[name] = []byte(hash)
+	}
+
+	jwt, err := NewJWTVerifier(cfg.JWT)
+	if err != nil {
+		return a, fmt.Errorf("auth.jwt: %s", err)
+	}
+	a.JWT = jwt
+
+	for _, rule := range cfg.Rules {
+		if _, err := path.Match(rule.Routes, ""); err != nil {
+			return a, fmt.Errorf("auth rule '%s': %s", rule.Routes, err)
+		}
+		for _, method := range rule.Methods {
+			if method != AuthToken && method != AuthBasic && method != AuthMTLS && method != AuthJWT {
+				return a, fmt.Errorf("auth rule '%s': unknown method '%s'", rule.Routes, method)
+			}
+		}
+		a.Rules = append(a.Rules, AuthRule{rule.Routes, rule.Require, rule.Methods})
+	}
+	a.Rules = append(a.Rules, defaultAuthRules...)
+
+	return a, nil
+}
+
+/*
+ * Return the first rule matching a route name
+ */
+func (a *Authenticator) RuleFor(routeName string) AuthRule {
+	for _, rule := range a.Rules {
+		if matched, _ := path.Match(rule.Routes, routeName); matched {
+			return rule
+		}
+	}
+	return AuthRule{Routes: "*"}
+}
+
+/*
+ * Identify the client from its credentials. Returns nil for anonymous
+ * requests and an error if credentials were given but are invalid.
+ */
+func (a *Authenticator) Authenticate(r *http.Request, certIdentity string) (*Principal, error) {
+	if header := r.Header.Get("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+		if a.JWT != nil && strings.Count(token, ".") == 2 {
+			principal, err := a.JWT.Verify(token)
+			if err != nil {
+				return nil, AuthError{fmt.Sprintf("invalid token: %s", err)}
+			}
+			return principal, nil
+		}
+		for name, expected := range a.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+				return &Principal{Name: name, Method: AuthToken}, nil
+			}
+		}
+		return nil, AuthError{"invalid token"}
+	}
+
+	if user, password, ok := r.BasicAuth(); ok {
+		hash, ok := a.Users[user]
+		if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return nil, AuthError{"invalid user or password"}
+		}
+		return &Principal{Name: user, Method: AuthBasic}, nil
+	}
+
+	if a.MTLS && certIdentity != "" {
+		return &Principal{Name: certIdentity, Method: AuthMTLS}, nil
+	}
+
+	return nil, nil
+}
+
+/*
+ * Check a request against the rule for its route
+ */
+func (a *Authenticator) Check(r *http.Request, routeName string, certIdentity string) (*Principal, error) {
+	principal, err := a.Authenticate(r, certIdentity)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := a.RuleFor(routeName)
+	if principal == nil {
+		if rule.Require {
+			return nil, AuthError{"authentication required"}
+		}
+		return nil, nil
+	}
+
+	if len(rule.Methods) > 0 {
+		for _, method := range rule.Methods {
+			if method == principal.Method {
+				return principal, nil
+			}
+		}
+		return nil, AuthError{fmt.Sprintf("%s authentication not accepted for this route", principal.Method)}
+	}
+
+	return principal, nil
+}
+
+/*
+ * Return the authenticated client of a request, nil if anonymous
+ */
+func RequestPrincipal(r *http.Request) *Principal {
+	if principal, ok := context.Get(r, ReqPrincipal).(*Principal); ok {
+		return principal
+	}
+	return nil
+}
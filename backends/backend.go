@@ -1,15 +1,30 @@
 package backend
 
+import (
+	"errors"
+	"time"
+)
+
+// Returned by Atomic when a watched key changed before the writes were applied
+var ErrConflict = errors.New("Transaction conflict: watched keys were modified")
+
 type ConfigBackend interface {
 	Exists(string) (bool, error)
 	GetType(string) (int, error)
+	// Types of several keys, in one round trip where the backend allows
+	GetTypes([]string) ([]int, error)
 	DeleteKey(string) error
 	GetHash(string) (map[string]string, error)
 	SetHash(string, map[string]string) error
 	GetHashField(string, string) (string, error)
 	SetHashField(string, string, string) error
+	// Remove a field, and the hash with its last field
+	DeleteHashField(string, string) error
 	HashFieldExists(string, string) (bool, error)
 	GetList(string) ([]string, error)
+	// Elements start to stop, inclusive. Negative indexes count from the end
+	// of the list, -1 is the last element.
+	GetListRange(string, int64, int64) ([]string, error)
 	SetList(string, []string) error
 	GetListIndex(string, int64) (string, error)
 	ListIndexExists(string, int64) (bool, error)
@@ -17,10 +32,37 @@ type ConfigBackend interface {
 	SetString(string, string) error
 	ListKeys(string) ([]string, error)
 	ListAppend(string, string) error
+	// Keep only the elements start to stop, indexed as in GetListRange
+	ListTrim(string, int64, int64) error
+	// Remove the key at the given time, a zero time removes the expiry.
+	// Writes replacing the whole key also remove it.
+	SetExpiry(string, time.Time) error
+	// Time the key will be removed, zero if it does not expire
+	GetExpiry(string) (time.Time, error)
+	// Run check, which may read through the backend, then apply the writes
+	// made by apply all at once. Nothing is written if check or apply fail,
+	// or (ErrConflict) if a watched key changed after check started.
+	Atomic(watch []string, check func() error, apply func(ConfigWriter) error) error
 	Check() error
 	Close()
 }
 
+/*
+ * The write operations of a backend, as available inside a transaction
+ */
+type ConfigWriter interface {
+	DeleteKey(string) error
+	SetHash(string, map[string]string) error
+	SetHashField(string, string, string) error
+	DeleteHashField(string, string) error
+	SetList(string, []string) error
+	SetString(string, string) error
+	ListAppend(string, string) error
+	ListTrim(string, int64, int64) error
+	SetExpiry(string, time.Time) error
+}
+
 type ConfigBackendFactory interface {
 	NewBackend() ConfigBackend
+	Close()
 }
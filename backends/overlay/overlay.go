@@ -0,0 +1,490 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/vars"
+	"time"
+)
+
+/*
+ * ConfigBackendOverlay layers uncommitted writes on top of another backend.
+ * Reads see the pending writes, the underlying backend is never modified.
+ */
+type ConfigBackendOverlay struct {
+	Backend backend.ConfigBackend
+	keys    map[string]*overlayKey
+	// Expiry set through the overlay, a zero time hides the expiry of the
+	// underlying key
+	expires map[string]time.Time
+}
+
+type overlayKey struct {
+	keytype int
+	str     string
+	list    []string
+	hash    map[string]string
+}
+
+func New(b backend.ConfigBackend) *ConfigBackendOverlay {
+	return &ConfigBackendOverlay{
+		Backend: b,
+		keys:    make(map[string]*overlayKey),
+		expires: make(map[string]time.Time),
+	}
+}
+
+/*
+ * Remove keys that expired. The overlay has no background sweeper, reads
+ * sweep before looking at the keys.
+ */
+func (b *ConfigBackendOverlay) sweep() {
+	now := time.Now()
+	for key, at := range b.expires {
+		if !at.IsZero() && !now.Before(at) {
+			b.DeleteKey(key)
+		}
+	}
+}
+
+func (b *ConfigBackendOverlay) Check() error {
+	return b.Backend.Check()
+}
+
+// The underlying backend is owned by the caller
+func (b *ConfigBackendOverlay) Close() {
+}
+
+func (b *ConfigBackendOverlay) GetType(key string) (int, error) {
+	b.sweep()
+	if entry, ok := b.keys[key]; ok {
+		return entry.keytype, nil
+	}
+	return b.Backend.GetType(key)
+}
+
+func (b *ConfigBackendOverlay) GetTypes(keys []string) ([]int, error) {
+	b.sweep()
+	types := make([]int, len(keys))
+	passed := make([]string, 0, len(keys))
+	for idx, key := range keys {
+		if entry, ok := b.keys[key]; ok {
+			types[idx] = entry.keytype
+		} else {
+			passed = append(passed, key)
+		}
+	}
+	if len(passed) == 0 {
+		return types, nil
+	}
+
+	backendTypes, err := b.Backend.GetTypes(passed)
+	if err != nil {
+		return types, err
+	}
+	for idx, key := range keys {
+		if _, ok := b.keys[key]; !ok {
+			types[idx] = backendTypes[0]
+			backendTypes = backendTypes[1:]
+		}
+	}
+	return types, nil
+}
+
+func (b *ConfigBackendOverlay) Exists(key string) (bool, error) {
+	keytype, err := b.GetType(key)
+	return keytype != vars.TYPE_NOT_FOUND, err
+}
+
+func (b *ConfigBackendOverlay) GetString(key string) (string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetString(key)
+	}
+	if entry.keytype != vars.TYPE_STRING {
+		return "", errNotType(key, "string")
+	}
+	return entry.str, nil
+}
+
+func (b *ConfigBackendOverlay) SetString(key string, value string) error {
+	b.keys[key] = &overlayKey{keytype: vars.TYPE_STRING, str: value}
+	b.expires[key] = time.Time{}
+	return nil
+}
+
+func (b *ConfigBackendOverlay) DeleteKey(key string) error {
+	b.keys[key] = &overlayKey{keytype: vars.TYPE_NOT_FOUND}
+	b.expires[key] = time.Time{}
+	return nil
+}
+
+func (b *ConfigBackendOverlay) GetHash(key string) (map[string]string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetHash(key)
+	}
+	value := make(map[string]string)
+	if entry.keytype != vars.TYPE_HASH {
+		// Same as HGETALL on a missing key
+		return value, nil
+	}
+	for k, v := range entry.hash {
+		value[k] = v
+	}
+	return value, nil
+}
+
+func (b *ConfigBackendOverlay) SetHash(key string, value map[string]string) error {
+	b.setHash(key, value)
+	b.expires[key] = time.Time{}
+	return nil
+}
+
+func (b *ConfigBackendOverlay) setHash(key string, value map[string]string) {
+	entry := &overlayKey{keytype: vars.TYPE_HASH, hash: make(map[string]string)}
+	for k, v := range value {
+		entry.hash[k] = v
+	}
+	b.keys[key] = entry
+}
+
+func (b *ConfigBackendOverlay) GetHashField(key string, field string) (string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetHashField(key, field)
+	}
+	value, ok := entry.hash[field]
+	if entry.keytype != vars.TYPE_HASH || !ok {
+		return "", fmt.Errorf("Hash field %s/%s not found", key, field)
+	}
+	return value, nil
+}
+
+func (b *ConfigBackendOverlay) SetHashField(key string, field string, value string) error {
+	keytype, err := b.GetType(key)
+	if err != nil {
+		return err
+	}
+	switch keytype {
+	case vars.TYPE_NOT_FOUND:
+		fallthrough
+	case vars.TYPE_HASH:
+		hash, err := b.GetHash(key)
+		if err != nil {
+			return err
+		}
+		hash[field] = value
+		b.setHash(key, hash)
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unsupported key type: %d", keytype))
+	}
+}
+
+func (b *ConfigBackendOverlay) DeleteHashField(key string, field string) error {
+	keytype, err := b.GetType(key)
+	if err != nil || keytype == vars.TYPE_NOT_FOUND {
+		return err
+	}
+	if keytype != vars.TYPE_HASH {
+		return errors.New(fmt.Sprintf("Unsupported key type: %d", keytype))
+	}
+	hash, err := b.GetHash(key)
+	if err != nil {
+		return err
+	}
+	delete(hash, field)
+	if len(hash) == 0 {
+		// Like Redis, an empty hash is removed
+		return b.DeleteKey(key)
+	}
+	b.setHash(key, hash)
+	return nil
+}
+
+func (b *ConfigBackendOverlay) HashFieldExists(key string, field string) (bool, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.HashFieldExists(key, field)
+	}
+	_, exists := entry.hash[field]
+	return entry.keytype == vars.TYPE_HASH && exists, nil
+}
+
+func (b *ConfigBackendOverlay) GetList(key string) ([]string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetList(key)
+	}
+	value := make([]string, 0)
+	if entry.keytype == vars.TYPE_LIST {
+		value = append(value, entry.list...)
+	}
+	return value, nil
+}
+
+func (b *ConfigBackendOverlay) GetListRange(key string, start int64, stop int64) ([]string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetListRange(key, start, stop)
+	}
+	value := make([]string, 0)
+	if entry.keytype == vars.TYPE_LIST {
+		value = append(value, listRange(entry.list, start, stop)...)
+	}
+	return value, nil
+}
+
+/*
+ * Elements start to stop of a list, with the index rules of Redis LRANGE
+ */
+func listRange(list []string, start int64, stop int64) []string {
+	length := int64(len(list))
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return []string{}
+	}
+	return list[start : stop+1]
+}
+
+func (b *ConfigBackendOverlay) SetList(key string, value []string) error {
+	b.setList(key, value)
+	b.expires[key] = time.Time{}
+	return nil
+}
+
+func (b *ConfigBackendOverlay) setList(key string, value []string) {
+	entry := &overlayKey{keytype: vars.TYPE_LIST, list: make([]string, 0, len(value))}
+	entry.list = append(entry.list, value...)
+	b.keys[key] = entry
+}
+
+func (b *ConfigBackendOverlay) GetListIndex(key string, index int64) (string, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.GetListIndex(key, index)
+	}
+	if entry.keytype != vars.TYPE_LIST || index < 0 || index >= int64(len(entry.list)) {
+		return "", fmt.Errorf("List index %s[%d] not found", key, index)
+	}
+	return entry.list[index], nil
+}
+
+func (b *ConfigBackendOverlay) ListIndexExists(key string, index int64) (bool, error) {
+	b.sweep()
+	entry, ok := b.keys[key]
+	if !ok {
+		return b.Backend.ListIndexExists(key, index)
+	}
+	return entry.keytype == vars.TYPE_LIST && index >= 0 && index < int64(len(entry.list)), nil
+}
+
+func (b *ConfigBackendOverlay) ListAppend(key string, value string) error {
+	keytype, err := b.GetType(key)
+	if err != nil {
+		return err
+	}
+	switch keytype {
+	case vars.TYPE_NOT_FOUND:
+		fallthrough
+	case vars.TYPE_LIST:
+		list, err := b.GetList(key)
+		if err != nil {
+			return err
+		}
+		b.setList(key, append(list, value))
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("Unsupported key type: %d", keytype))
+	}
+}
+
+func (b *ConfigBackendOverlay) ListTrim(key string, start int64, stop int64) error {
+	keytype, err := b.GetType(key)
+	if err != nil || keytype == vars.TYPE_NOT_FOUND {
+		return err
+	}
+	if keytype != vars.TYPE_LIST {
+		return errors.New(fmt.Sprintf("Unsupported key type: %d", keytype))
+	}
+	list, err := b.GetList(key)
+	if err != nil {
+		return err
+	}
+	list = listRange(list, start, stop)
+	if len(list) == 0 {
+		// Like Redis, an empty list is removed
+		return b.DeleteKey(key)
+	}
+	b.setList(key, list)
+	return nil
+}
+
+func (b *ConfigBackendOverlay) ListKeys(filter string) ([]string, error) {
+	b.sweep()
+	if filter == "" {
+		filter = "*"
+	}
+
+	keys, err := b.Backend.ListKeys(filter)
+	if err != nil {
+		return keys, err
+	}
+
+	value := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if _, ok := b.keys[key]; !ok {
+			value = append(value, key)
+		}
+	}
+	for key, entry := range b.keys {
+		if entry.keytype == vars.TYPE_NOT_FOUND {
+			continue
+		}
+		if globMatch(filter, key) {
+			value = append(value, key)
+		}
+	}
+
+	return value, nil
+}
+
+func (b *ConfigBackendOverlay) SetExpiry(key string, at time.Time) error {
+	keytype, err := b.GetType(key)
+	if err != nil || keytype == vars.TYPE_NOT_FOUND {
+		return err
+	}
+	b.expires[key] = at
+	return nil
+}
+
+func (b *ConfigBackendOverlay) GetExpiry(key string) (time.Time, error) {
+	b.sweep()
+	if at, ok := b.expires[key]; ok {
+		return at, nil
+	}
+	return b.Backend.GetExpiry(key)
+}
+
+/*
+ * Stage the writes on a further overlay and keep them only if all of them
+ * succeed. The overlay is not shared, so watched keys cannot change.
+ */
+func (b *ConfigBackendOverlay) Atomic(watch []string, check func() error, apply func(backend.ConfigWriter) error) error {
+	if err := check(); err != nil {
+		return err
+	}
+
+	staged := New(b)
+	if err := apply(staged); err != nil {
+		return err
+	}
+	for key, entry := range staged.keys {
+		b.keys[key] = entry
+	}
+	for key, at := range staged.expires {
+		b.expires[key] = at
+	}
+	return nil
+}
+
+func errNotType(key string, wanted string) error {
+	return fmt.Errorf("Key %s is not a %s", key, wanted)
+}
+
+/*
+ * Match a key against a pattern the way Redis KEYS does: * and ? match
+ * any character including '/', [...] is a set with ^ negation and a-z
+ * ranges, and \ escapes the next character.
+ */
+func globMatch(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for idx := 0; idx <= len(key); idx++ {
+				if globMatch(pattern[1:], key[idx:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					pattern = pattern[1:]
+					match = match || pattern[0] == key[0]
+				case len(pattern) > 2 && pattern[1] == '-':
+					start, end := pattern[0], pattern[2]
+					if start > end {
+						start, end = end, start
+					}
+					match = match || (key[0] >= start && key[0] <= end)
+					pattern = pattern[2:]
+				default:
+					match = match || pattern[0] == key[0]
+				}
+				pattern = pattern[1:]
+			}
+			if match == negate {
+				return false
+			}
+			key = key[1:]
+			// An unterminated set ends the pattern
+			if len(pattern) == 0 {
+				return len(key) == 0
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || pattern[0] != key[0] {
+				return false
+			}
+			key = key[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(key) == 0
+}
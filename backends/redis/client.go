@@ -18,7 +18,7 @@ type ConfigBackendRedisFactory struct {
 func NewFactory(config config.BackendConfig) backend.ConfigBackendFactory {
 	log.Infof("Connecting to redis at %s:%d", config.Address, config.Port)
 	factory := &ConfigBackendRedisFactory{
-		Pool: newRedisPool("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port)),
+		Pool: newRedisPool("tcp", fmt.Sprintf("%s:%d", config.Address, config.Port), config),
 	}
 
 	return factory
@@ -39,13 +39,29 @@ func (f *ConfigBackendRedisFactory) NewBackend() backend.ConfigBackend {
 	return backend
 }
 
-func newRedisPool(proto string, address string) *redis.Pool {
+func (f *ConfigBackendRedisFactory) Close() {
+	f.Pool.Close()
+}
+
+func newRedisPool(proto string, address string, config config.BackendConfig) *redis.Pool {
 	log.Infof("Setting up redis pool for: %s:%s", proto, address)
+	maxIdle := 5
+	if config.MaxIdle > 0 {
+		maxIdle = config.MaxIdle
+	}
+	maxActive := 5
+	if config.MaxActive > 0 {
+		maxActive = config.MaxActive
+	}
+	idleTimeout := 240
+	if config.IdleTimeout > 0 {
+		idleTimeout = config.IdleTimeout
+	}
 	return &redis.Pool{
-		MaxIdle:     5,
-		MaxActive:   5,
+		MaxIdle:     maxIdle,
+		MaxActive:   maxActive,
 		Wait:        true,
-		IdleTimeout: 240 * time.Second,
+		IdleTimeout: time.Duration(idleTimeout) * time.Second,
 		Dial: func() (redis.Conn, error) {
 			c, err := redis.Dial(proto, address)
 			if err != nil {
@@ -76,26 +92,54 @@ func (b ConfigBackendRedis) Close() {
 }
 
 func (b ConfigBackendRedis) GetType(key string) (int, error) {
-	var keytype int
-	var err error
-
 	redistype, err := redis.String(b.Conn.Do("TYPE", key))
-
 	if err != nil {
-		return keytype, err
+		return 0, err
 	}
 
+	return redisKeyType(redistype)
+}
+
+/*
+ * Pipeline TYPE for all keys, reading every reply even after an error
+ */
+func (b ConfigBackendRedis) GetTypes(keys []string) ([]int, error) {
+	types := make([]int, len(keys))
+	for _, key := range keys {
+		if err := b.Conn.Send("TYPE", key); err != nil {
+			return types, err
+		}
+	}
+	if err := b.Conn.Flush(); err != nil {
+		return types, err
+	}
+
+	var firstErr error
+	for idx := range keys {
+		redistype, err := redis.String(b.Conn.Receive())
+		if err == nil {
+			types[idx], err = redisKeyType(redistype)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return types, firstErr
+}
+
+func redisKeyType(redistype string) (int, error) {
 	switch redistype {
 	case "none":
-		return vars.TYPE_NOT_FOUND, err
+		return vars.TYPE_NOT_FOUND, nil
 	case "list":
-		return vars.TYPE_LIST, err
+		return vars.TYPE_LIST, nil
 	case "hash":
-		return vars.TYPE_HASH, err
+		return vars.TYPE_HASH, nil
 	case "string":
-		return vars.TYPE_STRING, err
+		return vars.TYPE_STRING, nil
 	default:
-		return keytype, errors.New("Invalid redis key type")
+		return 0, errors.New("Invalid redis key type")
 	}
 }
 
@@ -182,6 +226,11 @@ func (b ConfigBackendRedis) SetHashField(key string, field string, value string)
 	return err
 }
 
+func (b ConfigBackendRedis) DeleteHashField(key string, field string) error {
+	_, err := b.Conn.Do("HDEL", key, field)
+	return err
+}
+
 func (b ConfigBackendRedis) GetList(key string) ([]string, error) {
 	var value []string
 	var err error
@@ -191,6 +240,10 @@ func (b ConfigBackendRedis) GetList(key string) ([]string, error) {
 	return value, err
 }
 
+func (b ConfigBackendRedis) GetListRange(key string, start int64, stop int64) ([]string, error) {
+	return redis.Strings(b.Conn.Do("LRANGE", key, start, stop))
+}
+
 func (b ConfigBackendRedis) SetList(key string, value []string) error {
 	_, err := b.Conn.Do("DEL", key)
 	if err != nil {
@@ -210,6 +263,11 @@ func (b ConfigBackendRedis) ListAppend(key string, value string) error {
 	return err
 }
 
+func (b ConfigBackendRedis) ListTrim(key string, start int64, stop int64) error {
+	_, err := b.Conn.Do("LTRIM", key, start, stop)
+	return err
+}
+
 func (b ConfigBackendRedis) Exists(key string) (bool, error) {
 	var exists bool
 	var err error
@@ -262,3 +320,122 @@ func (b ConfigBackendRedis) ListIndexExists(key string, index int64) (bool, erro
 	}
 	return true, err
 }
+
+func (b ConfigBackendRedis) SetExpiry(key string, at time.Time) error {
+	if at.IsZero() {
+		_, err := b.Conn.Do("PERSIST", key)
+		return err
+	}
+	_, err := b.Conn.Do("PEXPIREAT", key, at.UnixNano()/int64(time.Millisecond))
+	return err
+}
+
+func (b ConfigBackendRedis) GetExpiry(key string) (time.Time, error) {
+	ttl, err := redis.Int64(b.Conn.Do("PTTL", key))
+	if err != nil || ttl < 0 {
+		return time.Time{}, err
+	}
+	return time.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+/*
+ * WATCH the keys while check runs, then queue the writes in MULTI/EXEC.
+ * EXEC fails, and nothing is written, if a watched key was modified.
+ */
+func (b ConfigBackendRedis) Atomic(watch []string, check func() error, apply func(backend.ConfigWriter) error) error {
+	if len(watch) > 0 {
+		args := make([]interface{}, len(watch))
+		for idx, key := range watch {
+			args[idx] = key
+		}
+		if _, err := b.Conn.Do("WATCH", args...); err != nil {
+			return err
+		}
+	}
+
+	if err := check(); err != nil {
+		b.Conn.Do("UNWATCH")
+		return err
+	}
+
+	if err := b.Conn.Send("MULTI"); err != nil {
+		b.Conn.Do("UNWATCH")
+		return err
+	}
+	if err := apply(redisTx{b.Conn}); err != nil {
+		b.Conn.Do("DISCARD")
+		return err
+	}
+
+	reply, err := b.Conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return backend.ErrConflict
+	}
+	return nil
+}
+
+/*
+ * Queues writes inside MULTI. Type checks have to be made before, while
+ * the keys are watched.
+ */
+type redisTx struct {
+	Conn redis.Conn
+}
+
+func (t redisTx) DeleteKey(key string) error {
+	return t.Conn.Send("DEL", key)
+}
+
+func (t redisTx) SetString(key string, value string) error {
+	return t.Conn.Send("SET", key, value)
+}
+
+func (t redisTx) SetHash(key string, value map[string]string) error {
+	if err := t.Conn.Send("DEL", key); err != nil {
+		return err
+	}
+	for field, v := range value {
+		if err := t.Conn.Send("HSET", key, field, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t redisTx) SetHashField(key string, field string, value string) error {
+	return t.Conn.Send("HSET", key, field, value)
+}
+
+func (t redisTx) DeleteHashField(key string, field string) error {
+	return t.Conn.Send("HDEL", key, field)
+}
+
+func (t redisTx) SetList(key string, value []string) error {
+	if err := t.Conn.Send("DEL", key); err != nil {
+		return err
+	}
+	for _, entry := range value {
+		if err := t.Conn.Send("RPUSH", key, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t redisTx) ListAppend(key string, value string) error {
+	return t.Conn.Send("RPUSH", key, value)
+}
+
+func (t redisTx) ListTrim(key string, start int64, stop int64) error {
+	return t.Conn.Send("LTRIM", key, start, stop)
+}
+
+func (t redisTx) SetExpiry(key string, at time.Time) error {
+	if at.IsZero() {
+		return t.Conn.Send("PERSIST", key)
+	}
+	return t.Conn.Send("PEXPIREAT", key, at.UnixNano()/int64(time.Millisecond))
+}
@@ -0,0 +1,744 @@
+package confmgr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/vars"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ChangePending  = "pending"
+	ChangeApplied  = "applied"
+	ChangeRejected = "rejected"
+)
+
+/*
+ * Routes writing data directly, rejected when main.require_review is set
+ * so that changes go through /admin/changes. Hierarchies and the node
+ * registry cannot be changed through change sets, they are read-only then.
+ */
+var reviewedRoutes = map[string]bool{
+	"HandleAdminKeyStore":        true,
+	"HandleAdminKeyDelete":       true,
+	"HandleAdminListAppend":      true,
+	"HandleAdminSetHashField":    true,
+	"HandleAdminKeyRollback":     true,
+	"HandleAdminTxn":             true,
+	"HandleAdminCreateSchedule":  true,
+	"HandleAdminStoreHierarchy":  true,
+	"HandleAdminRevertHierarchy": true,
+	"HandleAdminStoreNode":       true,
+	"HandleAdminDeleteNode":      true,
+}
+
+/*
+ * A set of writes waiting for review. Base holds the ETag each key had
+ * when the change set was created, empty for missing keys; the change set
+ * is only applied if the keys still have that content.
+ */
+type ChangeSet struct {
+	ID       string            `json:"id"`
+	Title    string            `json:"title"`
+	Author   string            `json:"author"`
+	Created  time.Time         `json:"created"`
+	Status   string            `json:"status"`
+	Ops      []TxnOp           `json:"ops"`
+	Base     map[string]string `json:"base"`
+	Reviewer string            `json:"reviewer,omitempty"`
+	Reviewed *time.Time        `json:"reviewed,omitempty"`
+	Comment  string            `json:"comment,omitempty"`
+}
+
+type ChangeRequest struct {
+	Title string  `json:"title"`
+	Ops   []TxnOp `json:"ops"`
+}
+
+type ReviewRequest struct {
+	Comment string `json:"comment"`
+}
+
+type ChangeResponse struct {
+	Type string    `json:"type"`
+	Data ChangeSet `json:"data"`
+}
+
+func (r ChangeResponse) ToString() string {
+	lines := []string{fmt.Sprintf("%s %s by %s: %s", r.Data.ID, r.Data.Status, r.Data.Author, r.Data.Title)}
+	for _, op := range r.Data.Ops {
+		lines = append(lines, fmt.Sprintf("  %s %s %s", op.Op, op.Key, op.Field))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ChangeResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+type ChangeListResponse struct {
+	Type string      `json:"type"`
+	Data []ChangeSet `json:"data"`
+}
+
+func (r ChangeListResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, change := range r.Data {
+		lines[idx] = fmt.Sprintf("%s %s %s by %s: %s", change.ID, change.Created.Format(time.RFC3339), change.Status, change.Author, change.Title)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ChangeListResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * Live and proposed value of a key touched by a change set
+ */
+type KeyDiff struct {
+	Key     string      `json:"key"`
+	Before  KeyResponse `json:"before"`
+	After   KeyResponse `json:"after"`
+	Changed bool        `json:"changed"`
+	// The live value changed since the change set was created
+	Stale bool `json:"stale"`
+}
+
+type ChangeDiffResponse struct {
+	Type string    `json:"type"`
+	ID   string    `json:"id"`
+	Data []KeyDiff `json:"data"`
+}
+
+func (r ChangeDiffResponse) ToString() string {
+	lines := make([]string, 0)
+	for _, diff := range r.Data {
+		state := "unchanged"
+		if diff.Changed {
+			state = "changed"
+		}
+		if diff.Stale {
+			state += " (stale)"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", diff.Key, state))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ChangeDiffResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * Lookups of a key touched by a change set, with and without the change
+ */
+type KeyPreview struct {
+	Key  string        `json:"key"`
+	Name string        `json:"name"`
+	Data []ScopeImpact `json:"data"`
+}
+
+type ChangePreviewResponse struct {
+	Type string       `json:"type"`
+	ID   string       `json:"id"`
+	Data []KeyPreview `json:"data"`
+}
+
+func (r ChangePreviewResponse) ToString() string {
+	lines := make([]string, 0)
+	for _, preview := range r.Data {
+		for _, entry := range preview.Data {
+			switch {
+			case entry.Error != "":
+				lines = append(lines, fmt.Sprintf("%s %s: error: %s", preview.Name, ScopeString(entry.Scope), entry.Error))
+			case entry.Changed:
+				lines = append(lines, fmt.Sprintf("%s %s: changed", preview.Name, ScopeString(entry.Scope)))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ChangePreviewResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * A change set that cannot be reviewed or applied in its current state
+ */
+type ChangeError struct {
+	Message string
+}
+
+func (e ChangeError) Error() string {
+	return e.Message
+}
+
+func (c *ConfMgr) changeKey(id string) string {
+	return fmt.Sprintf("%schange:%s:%s", c.Config.Main.MetaPrefix, c.Namespace, id)
+}
+
+func newChangeID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+/*
+ * Keys written by a change set, in order
+ */
+func (cs ChangeSet) Keys() []string {
+	keys := make([]string, 0, len(cs.Ops))
+	seen := make(map[string]bool)
+	for _, op := range cs.Ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	return keys
+}
+
+func (change ChangeSet) json() (string, error) {
+	jsonblob, err := json.Marshal(change)
+	return string(jsonblob), err
+}
+
+func (c *ConfMgr) saveChange(change ChangeSet, b backend.ConfigBackend) error {
+	value, err := change.json()
+	if err != nil {
+		return err
+	}
+	return b.SetString(c.changeKey(change.ID), value)
+}
+
+/*
+ * Time until which a change set or scheduled change that was just closed
+ * is kept, zero to keep it
+ */
+func (c *ConfMgr) retainUntil() time.Time {
+	if c.Config.Main.ChangeRetention.Duration <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(c.Config.Main.ChangeRetention.Duration)
+}
+
+/*
+ * Close a pending change set. The status is written together with apply,
+ * if given, and only if the stored change set is still the one reviewed.
+ */
+func (c *ConfMgr) reviewChange(r *http.Request, change ChangeSet, status string, reviewer string, comment string, txn *TxnRequest, b backend.ConfigBackend) (ChangeSet, error) {
+	current, err := change.json()
+	if err != nil {
+		return change, err
+	}
+
+	now := time.Now()
+	reviewed := change
+	reviewed.Status = status
+	reviewed.Reviewer = reviewer
+	reviewed.Reviewed = &now
+	reviewed.Comment = comment
+	updated, err := reviewed.json()
+	if err != nil {
+		return change, err
+	}
+
+	guard := &txnGuard{Key: c.changeKey(change.ID), Expected: current, Value: updated, Expires: c.retainUntil()}
+	if txn == nil {
+		err = guard.commit(b)
+	} else {
+		_, err = c.commitTxn(r, AuditTxn, *txn, guard, b)
+	}
+	if err != nil {
+		return change, err
+	}
+	return reviewed, nil
+}
+
+/*
+ * Read a change set, nil if it does not exist
+ */
+func (c *ConfMgr) GetChange(id string, b backend.ConfigBackend) (*ChangeSet, error) {
+	key := c.changeKey(id)
+	exists, err := b.Exists(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	value, err := b.GetString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ChangeSet
+	if err := json.Unmarshal([]byte(value), &change); err != nil {
+		return nil, fmt.Errorf("Corrupt change set %s: %s", id, err)
+	}
+	return &change, nil
+}
+
+/*
+ * All change sets of this namespace, oldest first
+ */
+func (c *ConfMgr) ListChanges(b backend.ConfigBackend) ([]ChangeSet, error) {
+	changes := make([]ChangeSet, 0)
+	prefix := c.changeKey("")
+
+	keys, err := b.ListKeys(prefix + "*")
+	if err != nil {
+		return changes, err
+	}
+	for _, key := range keys {
+		change, err := c.GetChange(strings.TrimPrefix(key, prefix), b)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Created.Before(changes[j].Created) })
+	return changes, nil
+}
+
+/*
+ * Stage a set of writes for review. Nothing is written to the keys.
+ */
+func (c *ConfMgr) CreateChange(author string, request ChangeRequest, b backend.ConfigBackend) (ChangeSet, error) {
+	txn := TxnRequest{Ops: request.Ops}
+	if err := c.prepareTxn(&txn); err != nil {
+		return ChangeSet{}, err
+	}
+
+	id, err := newChangeID()
+	if err != nil {
+		return ChangeSet{}, err
+	}
+	change := ChangeSet{
+		ID:      id,
+		Title:   request.Title,
+		Author:  author,
+		Created: time.Now(),
+		Status:  ChangePending,
+		Ops:     txn.Ops,
+		Base:    make(map[string]string),
+	}
+	for _, key := range change.Keys() {
+		if change.Base[key], err = c.currentETag(key, b); err != nil {
+			return change, err
+		}
+	}
+
+	// Reject changes that could never be applied, such as appends to a hash
+	if err := c.checkTxn(txn, b); err != nil {
+		return change, err
+	}
+
+	return change, c.saveChange(change, b)
+}
+
+/*
+ * The state of the backend after a change set would be applied
+ */
+func (c *ConfMgr) proposedState(change ChangeSet, b backend.ConfigBackend) (backend.ConfigBackend, error) {
+	proposed := overlay.New(b)
+	err := proposed.Atomic(nil, func() error { return nil }, func(w backend.ConfigWriter) error {
+		return applyTxn(TxnRequest{Ops: change.Ops}, w)
+	})
+	return proposed, err
+}
+
+func (c *ConfMgr) DiffChange(change ChangeSet, b backend.ConfigBackend) ([]KeyDiff, error) {
+	diffs := make([]KeyDiff, 0)
+
+	proposed, err := c.proposedState(change, b)
+	if err != nil {
+		return diffs, err
+	}
+
+	for _, key := range change.Keys() {
+		before, err := c.ReadKey(key, b)
+		if err != nil {
+			return diffs, err
+		}
+		after, err := c.ReadKey(key, proposed)
+		if err != nil {
+			return diffs, err
+		}
+
+		diff := KeyDiff{Key: key, Before: before, After: after}
+		beforeTag, afterTag := "", ""
+		if before != nil {
+			beforeTag, _ = KeyETag(before)
+		}
+		if after != nil {
+			afterTag, _ = KeyETag(after)
+		}
+		diff.Changed = beforeTag != afterTag
+		diff.Stale = beforeTag != change.Base[key]
+		diffs = append(diffs, diff)
+	}
+
+	return diffs, nil
+}
+
+/*
+ * Resolve the logical keys a change set touches for sample scopes, before
+ * and after the change. Keys not on any hierarchy level are skipped.
+ */
+func (c *ConfMgr) PreviewChange(change ChangeSet, scopes []map[string]string, b backend.ConfigBackend) ([]KeyPreview, error) {
+	previews := make([]KeyPreview, 0)
+
+	proposed, err := c.proposedState(change, b)
+	if err != nil {
+		return previews, err
+	}
+
+	for _, key := range change.Keys() {
+		location, ok := c.ParseKey(key)
+		if !ok {
+			continue
+		}
+		keytype, err := proposed.GetType(key)
+		if err != nil {
+			return previews, err
+		}
+		if keytype == vars.TYPE_NOT_FOUND {
+			if keytype, err = b.GetType(key); err != nil {
+				return previews, err
+			}
+		}
+
+		impacts, err := c.CompareLookups(location.Name, TypeToString(keytype), scopes, b, proposed)
+		if err != nil {
+			return previews, err
+		}
+		previews = append(previews, KeyPreview{key, location.Name, impacts})
+	}
+
+	return previews, nil
+}
+
+/*
+ * Apply a pending change set on behalf of a reviewer other than its author
+ */
+func (c *ConfMgr) ApproveChange(r *http.Request, change ChangeSet, reviewer string, comment string, b backend.ConfigBackend) (ChangeSet, error) {
+	if change.Status != ChangePending {
+		return change, ChangeError{fmt.Sprintf("Change set %s is %s", change.ID, change.Status)}
+	}
+	if reviewer == change.Author {
+		return change, ChangeError{"A change set cannot be approved by its author"}
+	}
+
+	txn := TxnRequest{Ops: change.Ops}
+	for _, key := range change.Keys() {
+		if etag := change.Base[key]; etag != "" {
+			txn.Preconditions = append(txn.Preconditions, TxnPrecondition{Key: key, ETag: etag})
+		} else {
+			exists := false
+			txn.Preconditions = append(txn.Preconditions, TxnPrecondition{Key: key, Exists: &exists})
+		}
+	}
+	approved, err := c.reviewChange(r, change, ChangeApplied, reviewer, comment, &txn, b)
+	if err != nil {
+		if _, ok := err.(PreconditionError); ok {
+			return change, ChangeError{fmt.Sprintf("Live data changed since the change set was created: %s", err)}
+		}
+		return change, err
+	}
+	log.Infof("Applied change set %s by %s, approved by %s", change.ID, change.Author, reviewer)
+	return approved, nil
+}
+
+func (c *ConfMgr) RejectChange(change ChangeSet, reviewer string, comment string, b backend.ConfigBackend) (ChangeSet, error) {
+	if change.Status != ChangePending {
+		return change, ChangeError{fmt.Sprintf("Change set %s is %s", change.ID, change.Status)}
+	}
+	return c.reviewChange(nil, change, ChangeRejected, reviewer, comment, nil, b)
+}
+
+/*
+ * Name of the requesting client as recorded in change sets
+ */
+func requestIdentity(r *http.Request) string {
+	if principal := RequestPrincipal(r); principal != nil {
+		return principal.String()
+	}
+	return AnonymousIdentity
+}
+
+/*
+ * Check the client may read, or apply, every operation of a change set
+ */
+func (c *ConfMgr) authorizeOps(r *http.Request, ops []TxnOp, read bool) error {
+	for _, op := range ops {
+		verb := VerbWrite
+		switch {
+		case read:
+			verb = VerbRead
+		case op.Op == TxnDelete:
+			verb = VerbDelete
+		}
+		if err := c.Authorize(r, verb, op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Authorize the operations of a change set, replying 403 if one is denied
+ */
+func (c *ConfMgr) checkChangeAccess(w http.ResponseWriter, r *http.Request, ops []TxnOp, read bool) bool {
+	if err := c.authorizeOps(r, ops, read); err != nil {
+		SendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Access denied: %s", err))
+		return false
+	}
+	return true
+}
+
+/*
+ * Load the change set named in the request, replying 404 if it does not
+ * exist
+ */
+func (c *ConfMgr) requestChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) *ChangeSet {
+	id := mux.Vars(r)["id"]
+	change, err := c.GetChange(id, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return nil
+	}
+	if change == nil {
+		SendErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Change set %s not found", id))
+		return nil
+	}
+	return change
+}
+
+func (c *ConfMgr) HandleAdminListChanges(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	changes, err := c.ListChanges(b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	visible := make([]ChangeSet, 0, len(changes))
+	for _, change := range changes {
+		if status != "" && change.Status != status {
+			continue
+		}
+		// Only show change sets the client could read with /admin/changes/{id}
+		if c.authorizeOps(r, change.Ops, true) == nil {
+			visible = append(visible, change)
+		}
+	}
+
+	SendResponse(w, r, ChangeListResponse{"changes", visible})
+}
+
+func (c *ConfMgr) HandleAdminCreateChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	if !checkNoExpiry(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var request ChangeRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	txn := TxnRequest{Ops: request.Ops}
+	if err := c.prepareTxn(&txn); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid change set: %s", err))
+		return
+	}
+	if !c.checkChangeAccess(w, r, txn.Ops, false) {
+		return
+	}
+
+	change, err := c.CreateChange(requestIdentity(r), request, b)
+	if _, ok := err.(TxnError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid change set: %s", err))
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	log.Infof("Created change set %s by %s", change.ID, change.Author)
+
+	SendResponse(w, r, ChangeResponse{"change", change})
+}
+
+func (c *ConfMgr) HandleAdminGetChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestChange(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, true) {
+		return
+	}
+
+	SendResponse(w, r, ChangeResponse{"change", *change})
+}
+
+func (c *ConfMgr) HandleAdminChangeDiff(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestChange(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, true) {
+		return
+	}
+
+	diffs, err := c.DiffChange(*change, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, ChangeDiffResponse{"diff", change.ID, diffs})
+}
+
+func (c *ConfMgr) HandleAdminPreviewChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestChange(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, true) {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var request ImpactRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &request); err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+			return
+		}
+	}
+
+	previews, err := c.PreviewChange(*change, request.Scopes, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Cannot preview change set: %s", err))
+		return
+	}
+
+	SendResponse(w, r, ChangePreviewResponse{"preview", change.ID, previews})
+}
+
+func (c *ConfMgr) readReview(w http.ResponseWriter, r *http.Request) (ReviewRequest, bool) {
+	var review ReviewRequest
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return review, false
+	}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &review); err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+			return review, false
+		}
+	}
+	return review, true
+}
+
+func (c *ConfMgr) HandleAdminApproveChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestChange(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, false) {
+		return
+	}
+	review, ok := c.readReview(w, r)
+	if !ok {
+		return
+	}
+	if RequestPrincipal(r) == nil {
+		SendErrorResponse(w, http.StatusForbidden, "Access denied: approving a change set needs an authenticated client")
+		return
+	}
+
+	applied, err := c.ApproveChange(r, *change, requestIdentity(r), review.Comment, b)
+	switch err.(type) {
+	case nil:
+	case ChangeError:
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	case TxnError:
+		SendErrorResponse(w, http.StatusConflict, fmt.Sprintf("Change set cannot be applied: %s", err))
+		return
+	default:
+		if err == backend.ErrConflict {
+			SendErrorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, ChangeResponse{"change", applied})
+}
+
+func (c *ConfMgr) HandleAdminRejectChange(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestChange(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, false) {
+		return
+	}
+	review, ok := c.readReview(w, r)
+	if !ok {
+		return
+	}
+
+	rejected, err := c.RejectChange(*change, requestIdentity(r), review.Comment, b)
+	if _, ok := err.(ChangeError); ok || err == backend.ErrConflict {
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, ChangeResponse{"change", rejected})
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -13,10 +14,14 @@ import (
 var (
 	logLevel     string
 	defaultsPath string
+	configPath   string
+	options      = config.OptionFlags{}
 )
 
 func init() {
 	flag.StringVar(&logLevel, "d", "warn", "Log level (debug|info|warn|error|fatal)")
+	flag.StringVar(&configPath, "c", "", "Config file (default: first of /etc/confmgr.toml, /confmgr.toml, ./confmgr.toml)")
+	flag.Var(options, "o", "Override a config setting, e.g. -o main_key_prefix=cfg: (repeatable)")
 	flag.StringVar(&defaultsPath, "p", "", "Directory containing defaults data")
 }
 
@@ -31,7 +36,14 @@ func main() {
 	lvl, _ := log.ParseLevel(logLevel)
 	log.SetLevel(lvl)
 
-	srv, err := confmgr.NewConfMgr()
+	// An explicit -d takes precedence over log_level in the config
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "d" {
+			options["MAIN_LOG_LEVEL"] = logLevel
+		}
+	})
+
+	srv, err := confmgr.NewConfMgrWithOptions(configPath, options)
 	if err != nil {
 		log.Fatalf("Cannot start server: %s", err)
 	}
@@ -1,29 +1,115 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
 var (
-	logLevel string
+	logLevel   string
+	configPath string
+	options    = config.OptionFlags{}
 )
 
 func init() {
 	flag.StringVar(&logLevel, "d", "warn", "Log level (debug|info|warn|error|fatal)")
+	flag.StringVar(&configPath, "c", "", "Config file (default: first of /etc/confmgr.toml, /confmgr.toml, ./confmgr.toml)")
+	flag.Var(options, "o", "Override a config setting, e.g. -o main_key_prefix=cfg: (repeatable)")
 }
 
 func main() {
-	flag.Parse()
+	// The subcommand may come before or after the flags
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if command == "" && flag.NArg() > 0 {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(flag.Args(), " "))
+		flag.Usage()
+		os.Exit(2)
+	}
 
 	lvl, _ := log.ParseLevel(logLevel)
 	log.SetLevel(lvl)
-	srv, err := confmgr.NewConfMgr()
+	// An explicit -d takes precedence over log_level in the config
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "d" {
+			options["MAIN_LOG_LEVEL"] = logLevel
+		}
+	})
+
+	switch command {
+	case "":
+	case "check-config":
+		checkConfig()
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	srv, err := confmgr.NewConfMgrWithOptions(configPath, options)
 	if err != nil {
 		log.Fatalf("Cannot start server: %s", err)
 	}
 	log.Info("initialized")
 
-	srv.Run()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Info("Received SIGHUP, reloading config")
+			if err := srv.Reload(); err != nil {
+				log.Errorf("Cannot reload config, keeping current one: %s", err)
+			}
+		}
+	}()
+	srv.StartBackgroundTasks()
+
+	// Drain in-flight requests on SIGTERM/SIGINT
+	stopped := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		log.Infof("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), srv.Config.Listen.ShutdownTimeout.Duration)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Shutdown did not complete: %s", err)
+		}
+		close(stopped)
+	}()
+
+	if err := srv.Run(); err != nil {
+		log.Fatalf("Cannot run server: %s", err)
+	}
+	<-stopped
+	log.Info("Stopped")
+}
+
+/*
+ * Validate the config without starting the server, exit status 1 if invalid
+ */
+func checkConfig() {
+	if err := confmgr.CheckConfig(configPath, options); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Config OK")
 }
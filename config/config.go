@@ -1,36 +1,224 @@
 package config
 
 import (
+	"fmt"
 	"github.com/BurntSushi/toml"
 	log "github.com/Sirupsen/logrus"
+	"time"
 )
 
 type ConfigMgrConfig struct {
 	Listen   ListenConfig `toml:"listen"`
 	Main     MainConfig   `toml:"main"`
+	Scope    ScopeConfig  `toml:"scope"`
 	Backends map[string]BackendConfig
+
+	Namespaces map[string]NamespaceConfig `toml:"namespaces"`
+	Auth       AuthConfig                 `toml:"auth"`
+	RBAC       RBACConfig                 `toml:"rbac"`
+	Audit      AuditConfig                `toml:"audit"`
+}
+
+type AuthConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Bearer tokens by client name
+	Tokens map[string]string `toml:"tokens"`
+	// bcrypt password hashes by user name, for basic auth
+	Users map[string]string `toml:"users"`
+	// Accept verified client certificates
+	MTLS  bool             `toml:"mtls"`
+	JWT   JWTConfig        `toml:"jwt"`
+	Rules []AuthRuleConfig `toml:"rules"`
+}
+
+/*
+ * Bearer tokens in JWT format signed by a local key
+ */
+type JWTConfig struct {
+	// HS256/384/512, RS256/384/512 or ES256/384/512, empty disables JWT
+	Algorithm string `toml:"algorithm"`
+	// HMAC secret, or file holding it
+	Secret     string `toml:"secret"`
+	SecretFile string `toml:"secret_file"`
+	// PEM public key or certificate for RSA and ECDSA
+	PublicKeyFile string `toml:"public_key_file"`
+	Issuer        string `toml:"issuer"`
+	Audience      string `toml:"audience"`
+	// Claims holding the client's scope and permissions
+	ScopeClaim       string `toml:"scope_claim"`
+	PermissionsClaim string `toml:"permissions_claim"`
+	// Ignore client supplied scope entirely for clients with a token scope
+	StrictScope bool     `toml:"strict_scope"`
+	Leeway      Duration `toml:"leeway"`
+}
+
+type RBACConfig struct {
+	Enabled bool             `toml:"enabled"`
+	Rules   []RBACRuleConfig `toml:"rules"`
+}
+
+/*
+ * Allow or deny identities the given verbs on keys matching a glob
+ */
+type RBACRuleConfig struct {
+	Name       string   `toml:"name"`
+	Identities []string `toml:"identities"`
+	Verbs      []string `toml:"verbs"`
+	Keys       []string `toml:"keys"`
+	Effect     string   `toml:"effect"`
+}
+
+/*
+ * Authentication requirement for routes whose name matches a glob
+ */
+type AuthRuleConfig struct {
+	Routes  string   `toml:"routes"`
+	Require bool     `toml:"require"`
+	Methods []string `toml:"methods"`
+}
+
+/*
+ * Where admin changes are recorded
+ */
+type AuditConfig struct {
+	// "file", "backend" or empty to disable auditing
+	Sink string `toml:"sink"`
+	// JSONL file for the file sink
+	File string `toml:"file"`
+	// Globs of key and hash field names whose values are not recorded
+	Redact []string `toml:"redact"`
+	// Newest entries kept by the backend sink, 0 keeps all
+	MaxEntries int `toml:"max_entries"`
 }
 
 type BackendConfig struct {
 	Port    int
 	Address string
+
+	// Connection pool settings, IdleTimeout in seconds
+	MaxIdle     int `toml:"max_idle"`
+	MaxActive   int `toml:"max_active"`
+	IdleTimeout int `toml:"idle_timeout"`
 }
 
 type ListenConfig struct {
 	Port    int
 	Address string
+
+	ReadTimeout       Duration `toml:"read_timeout"`
+	ReadHeaderTimeout Duration `toml:"read_header_timeout"`
+	WriteTimeout      Duration `toml:"write_timeout"`
+	IdleTimeout       Duration `toml:"idle_timeout"`
+	// How long to wait for in-flight requests on shutdown
+	ShutdownTimeout Duration `toml:"shutdown_timeout"`
+
+	TLS TLSConfig `toml:"tls"`
+}
+
+type TLSConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// CA bundle client certificates are verified against
+	ClientCA string `toml:"client_ca"`
+	// none, optional or require
+	ClientAuth string `toml:"client_auth"`
+	// Certificate field identifying a client, see scope.cert_fields
+	IdentityField string `toml:"identity_field"`
+}
+
+/*
+ * A time.Duration read from strings like "30s" or "2m"
+ */
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 type MainConfig struct {
-	KeyPaths  []string `toml:"key_paths"`
-	KeyPrefix string   `toml:"key_prefix"`
-	HdrPrefix string   `toml:"hdr_prefix"`
+	KeyPaths      []string `toml:"key_paths"`
+	KeyPrefix     string   `toml:"key_prefix"`
+	HdrPrefix     string   `toml:"hdr_prefix"`
+	MetaPrefix    string   `toml:"meta_prefix"`
+	RegistryToken string   `toml:"registry_token"`
+
+	Derived          map[string]DerivedTokenConfig `toml:"derived"`
+	Hierarchies      map[string][]string           `toml:"hierarchies"`
+	DefaultHierarchy string                        `toml:"default_hierarchy"`
+	HierarchyRules   []HierarchyRuleConfig         `toml:"hierarchy_rules"`
+	HierarchyHistory int                           `toml:"hierarchy_history"`
+	// Versions kept per key, 0 disables key history
+	KeyHistory int `toml:"key_history"`
+	// Key writes must go through a reviewed change set
+	RequireReview bool `toml:"require_review"`
+	// How long reviewed change sets and finished scheduled changes are
+	// kept, 0 keeps them
+	ChangeRetention Duration `toml:"change_retention"`
+
+	LogLevel string `toml:"log_level"`
+	// Seconds between checks of the config file for changes, 0 disables
+	WatchInterval int `toml:"watch_interval"`
+	// Seconds between checks for due scheduled changes, 0 disables
+	ScheduleInterval int `toml:"schedule_interval"`
+}
+
+type HierarchyRuleConfig struct {
+	Keys      string `toml:"keys"`
+	Hierarchy string `toml:"hierarchy"`
+}
+
+type DerivedTokenConfig struct {
+	From    string            `toml:"from"`
+	Map     map[string]string `toml:"map"`
+	Pattern string            `toml:"pattern"`
+	Default string            `toml:"default"`
+}
+
+type NamespaceConfig struct {
+	KeyPrefix        string                        `toml:"key_prefix"`
+	KeyPaths         []string                      `toml:"key_paths"`
+	Hierarchies      map[string][]string           `toml:"hierarchies"`
+	DefaultHierarchy string                        `toml:"default_hierarchy"`
+	HierarchyRules   []HierarchyRuleConfig         `toml:"hierarchy_rules"`
+	Derived          map[string]DerivedTokenConfig `toml:"derived"`
+	ReadOnly         bool                          `toml:"read_only"`
+	RequireReview    bool                          `toml:"require_review"`
+	Allow            []string                      `toml:"allow"`
+}
+
+type ScopeConfig struct {
+	Sources      []string                   `toml:"sources"`
+	QueryPrefix  string                     `toml:"query_prefix"`
+	CertFields   map[string]string          `toml:"cert_fields"`
+	PreserveCase bool                       `toml:"preserve_case"`
+	Rules        map[string]ScopeRuleConfig `toml:"rules"`
+}
+
+type ScopeRuleConfig struct {
+	Pattern string   `toml:"pattern"`
+	Allowed []string `toml:"allowed"`
 }
 
 func LoadConfig(c *ConfigMgrConfig, path string) error {
 	log.Infof("Reading config from: '%s'", path)
 
-	_, err := toml.DecodeFile(path, &c)
+	md, err := toml.DecodeFile(path, &c)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
 
-	return err
+	undecoded := md.Undecoded()
+	if len(undecoded) > 0 {
+		errs := make(ConfigErrors, len(undecoded))
+		for idx, key := range undecoded {
+			errs[idx] = ConfigError{key.String(), "unknown setting"}
+		}
+		return errs
+	}
+
+	return nil
 }
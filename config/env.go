@@ -0,0 +1,207 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of environment variables overriding config settings
+const EnvPrefix = "CONFMGR_"
+
+var errUnknownOption = errors.New("unknown setting")
+
+/*
+ * Override settings from CONFMGR_* environment variables, given as
+ * KEY=value pairs like os.Environ() returns them
+ */
+func ApplyEnv(c *ConfigMgrConfig, environ []string) error {
+	options := make(map[string]string)
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, EnvPrefix) {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		options[strings.TrimPrefix(parts[0], EnvPrefix)] = parts[1]
+	}
+
+	return ApplyOptions(c, options)
+}
+
+/*
+ * Apply several settings, in name order so results are predictable
+ */
+func ApplyOptions(c *ConfigMgrConfig, options map[string]string) error {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := SetOption(c, name, options[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Set a single setting by name. The name is the path of TOML keys joined
+ * with underscores, case-insensitive: MAIN_KEY_PREFIX, BACKENDS_REDIS_PORT,
+ * NAMESPACES_DBTEAM_READ_ONLY.
+ *
+ * Lists are comma separated or JSON, tables and lists of tables are JSON.
+ */
+func SetOption(c *ConfigMgrConfig, name string, value string) error {
+	segments := strings.Split(strings.ToLower(name), "_")
+	err := setValue(reflect.ValueOf(c).Elem(), segments, value)
+	if err == errUnknownOption {
+		return fmt.Errorf("Unknown config setting: %s", name)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid value for %s: %s", name, err)
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, segments []string, value string) error {
+	if len(segments) == 0 {
+		return parseValue(v, value)
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			fieldSegments := strings.Split(fieldName(t.Field(i)), "_")
+			if !hasSegments(segments, fieldSegments) {
+				continue
+			}
+			err := setValue(v.Field(i), segments[len(fieldSegments):], value)
+			if err != errUnknownOption {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		elemType := v.Type().Elem()
+
+		// Map keys may contain underscores, try every split point,
+		// ending with the whole remaining name as key
+		for i := 1; i <= len(segments); i++ {
+			if elemType.Kind() != reflect.Struct && i != len(segments) {
+				continue
+			}
+			key := reflect.ValueOf(strings.Join(segments[:i], "_"))
+			elem := reflect.New(elemType).Elem()
+			if existing := v.MapIndex(key); existing.IsValid() {
+				elem.Set(existing)
+			}
+			err := setValue(elem, segments[i:], value)
+			if err == errUnknownOption {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+			return nil
+		}
+	}
+
+	return errUnknownOption
+}
+
+func parseValue(v reflect.Value, value string) error {
+	if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			items := make([]string, 0)
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	case reflect.Map, reflect.Struct:
+		return json.Unmarshal([]byte(value), v.Addr().Interface())
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func fieldName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("toml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(field.Name)
+}
+
+func hasSegments(segments []string, prefix []string) bool {
+	if len(prefix) > len(segments) {
+		return false
+	}
+	for i := range prefix {
+		if segments[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * Collects -o NAME=value command line overrides
+ */
+type OptionFlags map[string]string
+
+func (o OptionFlags) String() string {
+	pairs := make([]string, 0, len(o))
+	for name, value := range o {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (o OptionFlags) Set(option string) error {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected NAME=value, got '%s'", option)
+	}
+	o[strings.TrimPrefix(strings.ToUpper(parts[0]), EnvPrefix)] = parts[1]
+	return nil
+}
@@ -0,0 +1,254 @@
+package config
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"net"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ * A problem with a single setting
+ */
+type ConfigError struct {
+	Setting string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Setting, e.Message)
+}
+
+/*
+ * All problems found in a config, one per line
+ */
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, len(e))
+	for idx, err := range e {
+		lines[idx] = err.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+var (
+	tokenNameRe     = regexp.MustCompile("^[a-z0-9_-]+$")
+	pathTokenNameRe = regexp.MustCompile("^[a-z0-9_-]+\\??$")
+)
+
+/*
+ * Check settings that would otherwise only fail at runtime, or not at all
+ */
+func Validate(c ConfigMgrConfig) error {
+	errs := make(ConfigErrors, 0)
+	add := func(setting string, format string, args ...interface{}) {
+		errs = append(errs, ConfigError{setting, fmt.Sprintf(format, args...)})
+	}
+
+	if c.Listen.Port < 1 || c.Listen.Port > 65535 {
+		add("listen.port", "must be between 1 and 65535, got %d", c.Listen.Port)
+	}
+	timeouts := map[string]Duration{
+		"read_timeout":        c.Listen.ReadTimeout,
+		"read_header_timeout": c.Listen.ReadHeaderTimeout,
+		"write_timeout":       c.Listen.WriteTimeout,
+		"idle_timeout":        c.Listen.IdleTimeout,
+		"shutdown_timeout":    c.Listen.ShutdownTimeout,
+	}
+	for name, timeout := range timeouts {
+		if timeout.Duration < 0 {
+			add("listen."+name, "must not be negative, got %s", timeout)
+		}
+	}
+	if c.Listen.TLS.CertFile != "" && c.Listen.TLS.KeyFile == "" {
+		add("listen.tls.key_file", "must be set with cert_file")
+	}
+	if c.Listen.TLS.CertFile == "" && (c.Listen.TLS.KeyFile != "" || c.Listen.TLS.ClientCA != "") {
+		add("listen.tls.cert_file", "must be set to enable TLS")
+	}
+
+	redis, ok := c.Backends["redis"]
+	if !ok {
+		add("backends.redis", "section is required")
+	} else {
+		if redis.Address == "" {
+			add("backends.redis.address", "must be set")
+		}
+		if redis.Port < 1 || redis.Port > 65535 {
+			add("backends.redis.port", "must be between 1 and 65535, got %d", redis.Port)
+		}
+		if redis.MaxIdle < 0 || redis.MaxActive < 0 || redis.IdleTimeout < 0 {
+			add("backends.redis", "pool settings must not be negative")
+		}
+	}
+	for name := range c.Backends {
+		if name != "redis" {
+			add("backends."+name, "unsupported backend")
+		}
+	}
+
+	if c.Main.KeyPrefix == "" {
+		add("main.key_prefix", "must not be empty")
+	}
+	if c.Main.MetaPrefix == "" {
+		add("main.meta_prefix", "must not be empty")
+	}
+	if c.Main.KeyPrefix != "" && c.Main.MetaPrefix != "" && prefixesOverlap(c.Main.KeyPrefix, c.Main.MetaPrefix) {
+		add("main.meta_prefix", "'%s' overlaps with key_prefix '%s'", c.Main.MetaPrefix, c.Main.KeyPrefix)
+	}
+	if !tokenNameRe.MatchString(c.Main.RegistryToken) {
+		add("main.registry_token", "invalid token name '%s'", c.Main.RegistryToken)
+	}
+	if c.Main.LogLevel != "" {
+		if _, err := log.ParseLevel(c.Main.LogLevel); err != nil {
+			add("main.log_level", "%s", err)
+		}
+	}
+	if c.Main.HierarchyHistory < 0 {
+		add("main.hierarchy_history", "must not be negative")
+	}
+	if c.Main.KeyHistory < 0 {
+		add("main.key_history", "must not be negative")
+	}
+	if c.Main.WatchInterval < 0 {
+		add("main.watch_interval", "must not be negative")
+	}
+	if c.Main.ScheduleInterval < 0 {
+		add("main.schedule_interval", "must not be negative")
+	}
+	if c.Main.ChangeRetention.Duration < 0 {
+		add("main.change_retention", "must not be negative")
+	}
+	validateHierarchies(add, "main", c.Main.KeyPaths, c.Main.Hierarchies, c.Main.Derived)
+
+	for name, ns := range c.Namespaces {
+		setting := "namespaces." + name
+		if ns.KeyPrefix == "" {
+			add(setting+".key_prefix", "must not be empty")
+		} else if c.Main.MetaPrefix != "" && prefixesOverlap(ns.KeyPrefix, c.Main.MetaPrefix) {
+			add(setting+".key_prefix", "'%s' overlaps with meta_prefix '%s'", ns.KeyPrefix, c.Main.MetaPrefix)
+		}
+		for idx, cidr := range ns.Allow {
+			if net.ParseIP(cidr) == nil {
+				if _, _, err := net.ParseCIDR(cidr); err != nil {
+					add(fmt.Sprintf("%s.allow[%d]", setting, idx), "invalid address or network '%s'", cidr)
+				}
+			}
+		}
+		validateHierarchies(add, setting, ns.KeyPaths, ns.Hierarchies, ns.Derived)
+	}
+
+	if c.Auth.Enabled {
+		if len(c.Auth.Tokens) == 0 && len(c.Auth.Users) == 0 && !c.Auth.MTLS && c.Auth.JWT.Algorithm == "" {
+			add("auth", "enabled without tokens, users, mtls or jwt")
+		}
+		if c.Auth.MTLS && (c.Listen.TLS.ClientCA == "" || c.Listen.TLS.ClientAuth == "none") {
+			add("auth.mtls", "needs listen.tls.client_ca and client_auth")
+		}
+	}
+
+	switch c.Audit.Sink {
+	case "", "backend":
+	case "file":
+		if c.Audit.File == "" {
+			add("audit.file", "must be set for the file sink")
+		}
+	default:
+		add("audit.sink", "must be file or backend, got '%s'", c.Audit.Sink)
+	}
+	if c.Audit.MaxEntries < 0 {
+		add("audit.max_entries", "must not be negative")
+	}
+	for idx, pattern := range c.Audit.Redact {
+		if _, err := path.Match(pattern, ""); err != nil {
+			add(fmt.Sprintf("audit.redact[%d]", idx), "invalid pattern '%s'", pattern)
+		}
+	}
+
+	for token, rule := range c.Scope.Rules {
+		if !tokenNameRe.MatchString(token) {
+			add("scope.rules."+token, "invalid token name")
+		}
+		if rule.Pattern != "" {
+			if _, err := regexp.Compile(rule.Pattern); err != nil {
+				add("scope.rules."+token+".pattern", "%s", err)
+			}
+		}
+	}
+	for token := range c.Scope.CertFields {
+		if !tokenNameRe.MatchString(token) {
+			add("scope.cert_fields."+token, "invalid token name")
+		}
+	}
+
+	if len(errs) > 0 {
+		// Settings in maps are checked in random order
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Setting < errs[j].Setting })
+		return errs
+	}
+	return nil
+}
+
+/*
+ * Whether keys below one prefix can also be below the other
+ */
+func prefixesOverlap(a string, b string) bool {
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+func validateHierarchies(add func(string, string, ...interface{}), setting string, keyPaths []string, hierarchies map[string][]string, derived map[string]DerivedTokenConfig) {
+	validateKeyPaths(add, setting+".key_paths", keyPaths)
+	for name, paths := range hierarchies {
+		validateKeyPaths(add, setting+".hierarchies."+name, paths)
+	}
+	for token, d := range derived {
+		if !tokenNameRe.MatchString(token) {
+			add(setting+".derived."+token, "invalid token name")
+		}
+		if !tokenNameRe.MatchString(d.From) {
+			add(setting+".derived."+token+".from", "invalid token name '%s'", d.From)
+		}
+	}
+}
+
+/*
+ * Check the %{token} syntax of key paths. Conditions are checked when
+ * the hierarchy is compiled.
+ */
+func validateKeyPaths(add func(string, string, ...interface{}), setting string, paths []string) {
+	for idx, path := range paths {
+		pathSetting := fmt.Sprintf("%s[%d]", setting, idx)
+		if strings.TrimSpace(path) == "" {
+			add(pathSetting, "must not be empty")
+			continue
+		}
+		if i := strings.Index(path, " when "); i >= 0 {
+			path = path[:i]
+		}
+
+		rest := path
+		for {
+			start := strings.Index(rest, "%{")
+			if start < 0 {
+				break
+			}
+			end := strings.Index(rest[start:], "}")
+			if end < 0 {
+				add(pathSetting, "unterminated token in '%s'", path)
+				break
+			}
+			name := rest[start+2 : start+end]
+			if !pathTokenNameRe.MatchString(name) {
+				add(pathSetting, "invalid token name '%s' in '%s'", name, path)
+			}
+			rest = rest[start+end+1:]
+		}
+		if strings.Contains(strings.Replace(path, "%{", "", -1), "{") || strings.Contains(rest, "}") {
+			add(pathSetting, "unbalanced braces in '%s'", path)
+		}
+	}
+}
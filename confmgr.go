@@ -1,64 +1,338 @@
 package confmgr
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/moensch/confmgr/backends"
 	"github.com/moensch/confmgr/backends/redis"
 	"github.com/moensch/confmgr/config"
+	"net"
 	"net/http"
 	"os"
+	"sync"
+	"time"
 )
 
 type ConfMgr struct {
-	Config       config.ConfigMgrConfig
-	Backend      backend.ConfigBackend
-	Router       *mux.Router
-	RequestScope map[string]string
+	Config         config.ConfigMgrConfig
+	Backend        backend.ConfigBackend
+	Router         *mux.Router
+	RequestScope   map[string]string
+	ScopeChain     ScopeChain
+	ScopeValidator *ScopeValidator
+	Hierarchies    map[string]*Hierarchy
+	Namespace      string
+	Namespaces     map[string]*ConfMgr
+	Policy         *NamespacePolicy
+	ConfigPath     string
+	Overrides      map[string]string
+	TLSConfig      *tls.Config
+	Auth           *Authenticator
+	RBAC           *RBACPolicy
+	Audit          *AuditLog
+	hierarchyLock  sync.RWMutex
+	reloadLock     sync.RWMutex
+	server         *http.Server
+	serverLock     sync.Mutex
+	tasks          backgroundTasks
+	// Server a request's view of the settings was taken from
+	live *ConfMgr
 }
 
 var (
 	BackendFactory backend.ConfigBackendFactory
+	// Held while a reload replaces BackendFactory
+	factoryLock sync.RWMutex
+	// Requests with a backend of the current BackendFactory
+	factoryUsers = &sync.WaitGroup{}
 )
 
-func NewConfMgr() (*ConfMgr, error) {
-	confmgr := &ConfMgr{
-		Config: config.ConfigMgrConfig{
-			Listen: config.ListenConfig{
-				Port:    8080,
-				Address: "0.0.0.0",
+/*
+ * Take a backend of the current factory. done closes it; a factory
+ * replaced by a reload is closed once all its backends are done.
+ */
+func newBackend() (b backend.ConfigBackend, done func()) {
+	factoryLock.RLock()
+	factory, users := BackendFactory, factoryUsers
+	users.Add(1)
+	factoryLock.RUnlock()
+
+	b = factory.NewBackend()
+	return b, func() {
+		b.Close()
+		users.Done()
+	}
+}
+
+/*
+ * Settings used for anything not set in the config file
+ */
+func DefaultConfig() config.ConfigMgrConfig {
+	return config.ConfigMgrConfig{
+		Listen: config.ListenConfig{
+			Port:              8080,
+			Address:           "0.0.0.0",
+			ReadTimeout:       config.Duration{Duration: 10 * time.Second},
+			ReadHeaderTimeout: config.Duration{Duration: 5 * time.Second},
+			WriteTimeout:      config.Duration{Duration: 30 * time.Second},
+			IdleTimeout:       config.Duration{Duration: 120 * time.Second},
+			ShutdownTimeout:   config.Duration{Duration: 30 * time.Second},
+			TLS: config.TLSConfig{
+				ClientAuth:    "none",
+				IdentityField: "cn",
 			},
 		},
+		Main: config.MainConfig{
+			HdrPrefix:        "x-cfg-",
+			MetaPrefix:       "confmgr:",
+			RegistryToken:    "fqdn",
+			DefaultHierarchy: "default",
+			HierarchyHistory: 20,
+			KeyHistory:       10,
+			ScheduleInterval: 10,
+			ChangeRetention:  config.Duration{Duration: 30 * 24 * time.Hour},
+		},
+		Scope: config.ScopeConfig{
+			Sources:     []string{"header"},
+			QueryPrefix: "scope.",
+		},
+		Audit: config.AuditConfig{
+			Redact:     []string{"*password*", "*secret*", "*token*", "*private*"},
+			MaxEntries: 100000,
+		},
+	}
+}
+
+func NewConfMgr() (*ConfMgr, error) {
+	return NewConfMgrWithOptions("", nil)
+}
+
+/*
+ * Create a server from an explicit config file, or the first one found in
+ * the default locations if configPath is empty. Settings are taken from,
+ * in increasing precedence: defaults, the config file, CONFMGR_*
+ * environment variables and the given overrides.
+ */
+func NewConfMgrWithOptions(configPath string, overrides map[string]string) (*ConfMgr, error) {
+	confmgr := &ConfMgr{
+		Namespace:  DefaultNamespace,
+		Config:     DefaultConfig(),
+		ConfigPath: configPath,
+		Overrides:  overrides,
+	}
+
+	if confmgr.ConfigPath == "" {
+		confmgr.ConfigPath = FindConfigFile()
+	}
+
+	cfg, err := confmgr.LoadConfig()
+	if err != nil {
+		return confmgr, err
 	}
 
+	// The backend is needed to load hierarchies stored through the admin API
+	BackendFactory = redis.NewFactory(cfg.Backends["redis"])
+
+	err = confmgr.ApplyConfig(cfg)
+	if err != nil {
+		return confmgr, err
+	}
+
+	confmgr.Router = confmgr.NewRouter()
+
+	return confmgr, err
+}
+
+/*
+ * Return the first config file found in the default locations, if any
+ */
+func FindConfigFile() string {
 	configLocations := []string{
 		"/etc/confmgr.toml",
 		"/confmgr.toml",
 		"confmgr.toml",
 	}
 
-	var err error
-	// Parse config if exists in any of our search locations
 	for _, configpath := range configLocations {
 		log.Debugf("Checking for config in %s", configpath)
 		if _, err := os.Stat(configpath); err == nil {
-			err = config.LoadConfig(&confmgr.Config, configpath)
-			if err != nil {
-				log.Fatalf("Cannot load config: %s", err)
-			}
-			break
+			return configpath
 		}
 	}
+	return ""
+}
 
-	BackendFactory = redis.NewFactory(confmgr.Config.Backends["redis"])
-	confmgr.Router = confmgr.NewRouter()
+/*
+ * Read the configuration from all sources without applying it
+ */
+func (c *ConfMgr) LoadConfig() (config.ConfigMgrConfig, error) {
+	cfg := DefaultConfig()
 
-	return confmgr, err
+	if c.ConfigPath != "" {
+		if err := config.LoadConfig(&cfg, c.ConfigPath); err != nil {
+			return cfg, err
+		}
+	}
+	if err := config.ApplyEnv(&cfg, os.Environ()); err != nil {
+		return cfg, err
+	}
+	if err := config.ApplyOptions(&cfg, c.Overrides); err != nil {
+		return cfg, err
+	}
+
+	return cfg, config.Validate(cfg)
 }
 
-func (c *ConfMgr) Run() {
+/*
+ * Load and compile a configuration without connecting to the backend
+ */
+func CheckConfig(configPath string, overrides map[string]string) error {
+	if configPath == "" {
+		configPath = FindConfigFile()
+	}
+	if configPath == "" {
+		return fmt.Errorf("No config file found")
+	}
+
+	c := &ConfMgr{
+		Namespace:  DefaultNamespace,
+		ConfigPath: configPath,
+		Overrides:  overrides,
+	}
+	cfg, err := c.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	return c.ApplyConfig(cfg)
+}
+
+/*
+ * Build everything derived from the configuration and make it active
+ */
+func (c *ConfMgr) ApplyConfig(cfg config.ConfigMgrConfig) error {
+	level := log.GetLevel()
+	if cfg.Main.LogLevel != "" {
+		lvl, err := log.ParseLevel(cfg.Main.LogLevel)
+		if err != nil {
+			return err
+		}
+		level = lvl
+	}
+	chain, err := NewScopeChain(cfg.Scope, cfg.Main.HdrPrefix)
+	if err != nil {
+		return err
+	}
+	validator, err := NewScopeValidator(cfg.Scope)
+	if err != nil {
+		return err
+	}
+	hierarchies, err := NewHierarchies(cfg.Main)
+	if err != nil {
+		return err
+	}
+	c.mergeStoredHierarchies(hierarchies, cfg.Main)
+	namespaces, err := c.NewNamespaces(cfg)
+	if err != nil {
+		return err
+	}
+	auth, err := NewAuthenticator(cfg.Auth)
+	if err != nil {
+		return err
+	}
+	rbac, err := NewRBACPolicy(cfg.RBAC)
+	if err != nil {
+		return err
+	}
+	audit, err := NewAuditLog(cfg.Audit, cfg.Main.MetaPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err := CertField(&x509.Certificate{}, cfg.Listen.TLS.IdentityField); err != nil {
+		return fmt.Errorf("listen.tls.identity_field: %s", err)
+	}
+	// Namespaces share the listener
+	tlsConfig := c.TLSConfig
+	if c.Namespace == DefaultNamespace {
+		tlsConfig, err = NewTLSConfig(cfg.Listen.TLS)
+		if err != nil {
+			return fmt.Errorf("TLS: %s", err)
+		}
+	}
+
+	c.Config = cfg
+	c.ScopeChain = chain
+	c.ScopeValidator = validator
+	c.setHierarchies(hierarchies)
+	c.Namespaces = namespaces
+	c.TLSConfig = tlsConfig
+	c.Auth = auth
+	c.RBAC = rbac
+	c.Audit = audit
+	log.SetLevel(level)
+
+	return nil
+}
+
+/*
+ * Serve requests until Shutdown is called
+ */
+func (c *ConfMgr) Run() error {
 	listenAddr := fmt.Sprintf("%s:%d", c.Config.Listen.Address, c.Config.Listen.Port)
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
 	log.Infof("Listening on: %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, c.Router))
+
+	return c.Serve(listener)
+}
+
+func (c *ConfMgr) Serve(listener net.Listener) error {
+	if c.TLSConfig != nil {
+		log.Infof("Serving TLS, client certificates: %s", c.Config.Listen.TLS.ClientAuth)
+		listener = tls.NewListener(listener, c.TLSConfig)
+	}
+
+	c.serverLock.Lock()
+	c.server = &http.Server{
+		Handler:           c.Router,
+		ReadTimeout:       c.Config.Listen.ReadTimeout.Duration,
+		ReadHeaderTimeout: c.Config.Listen.ReadHeaderTimeout.Duration,
+		WriteTimeout:      c.Config.Listen.WriteTimeout.Duration,
+		IdleTimeout:       c.Config.Listen.IdleTimeout.Duration,
+	}
+	server := c.server
+	c.serverLock.Unlock()
+
+	err := server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+/*
+ * Stop accepting connections, wait for in-flight requests until ctx is
+ * done, then close the backend
+ */
+func (c *ConfMgr) Shutdown(ctx context.Context) error {
+	c.serverLock.Lock()
+	server := c.server
+	c.serverLock.Unlock()
+
+	var err error
+	if server != nil {
+		log.Info("Shutting down, draining requests")
+		err = server.Shutdown(ctx)
+	}
+	if BackendFactory != nil {
+		BackendFactory.Close()
+	}
+
+	return err
 }
@@ -0,0 +1,198 @@
+package confmgr
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/vars"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+ * Strong entity tag of a key's content. Hashes are serialized with sorted
+ * fields, so equal content always gives the same tag.
+ */
+func KeyETag(resp KeyResponse) (string, error) {
+	jsonstr, err := resp.ToJsonString()
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum([]byte(jsonstr))
+	return "\"" + hex.EncodeToString(sum[:]) + "\"", nil
+}
+
+/*
+ * Check an If-Match or If-None-Match header value against a tag. Weak
+ * tags only match with weak comparison, as used for If-None-Match.
+ */
+func etagMatches(header string, etag string, weak bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return etag != ""
+	}
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		} else if strings.HasPrefix(candidate, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+		if candidate != "" && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * Send a response with its ETag, or 304 if the client has it already
+ */
+func sendWithETag(w http.ResponseWriter, r *http.Request, resp KeyResponse, etag string) {
+	w.Header().Set("ETag", etag)
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	SendResponse(w, r, resp)
+}
+
+/*
+ * Send a lookup result with a weak ETag. Lookups are served in several
+ * formats and depend on scope, so the tag is derived from the result.
+ */
+func SendCachedResponse(w http.ResponseWriter, r *http.Request, resp KeyResponse) {
+	etag, err := KeyETag(resp)
+	if err != nil {
+		SendResponse(w, r, resp)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	sendWithETag(w, r, resp, "W/"+etag)
+}
+
+/*
+ * Current ETag of an absolute key, empty if it does not exist
+ */
+func (c *ConfMgr) currentETag(keyName string, b backend.ConfigBackend) (string, error) {
+	resp, err := c.ReadKey(keyName, b)
+	if err != nil || resp == nil {
+		return "", err
+	}
+	return KeyETag(resp)
+}
+
+// Attempts of a key write whose key is modified concurrently
+const maxWriteAttempts = 3
+
+/*
+ * Write a single key, honoring If-Match. The ETag is compared while the
+ * key is watched and the write is dropped if the key changes before it
+ * is committed, so two clients holding the same ETag cannot both succeed.
+ * The key's history gets entry in the same commit. check may reject the
+ * write based on the current value. Returns the values before and after
+ * the write, or replies with an error and returns false.
+ */
+func (c *ConfMgr) writeKey(w http.ResponseWriter, r *http.Request, keyName string, entry KeyVersion, check func(KeyResponse) error, apply func(backend.ConfigWriter) error, b backend.ConfigBackend) (KeyResponse, KeyResponse, time.Time, bool) {
+	header := r.Header.Get("If-Match")
+
+	var old, value KeyResponse
+	var expiresAt time.Time
+	var history []string
+	var err error
+	for attempt := 1; attempt <= maxWriteAttempts; attempt++ {
+		err = b.Atomic([]string{keyName, c.keyHistoryKey(keyName)}, func() error {
+			var err error
+			if old, err = c.ReadKey(keyName, b); err != nil {
+				return err
+			}
+			if header != "" {
+				etag := ""
+				if old != nil {
+					if etag, err = KeyETag(old); err != nil {
+						return err
+					}
+				}
+				if !etagMatches(header, etag, false) {
+					return PreconditionError{fmt.Sprintf("key %s was modified", keyName)}
+				}
+			}
+			if check != nil {
+				if err := check(old); err != nil {
+					return err
+				}
+			}
+
+			values, expiries, err := c.stagedKeys([]string{keyName}, apply, b)
+			if err != nil {
+				return err
+			}
+			value = values[keyName]
+			expiresAt = expiries[keyName]
+			entry.ExpiresAt = expiryField(expiresAt)
+			history, err = c.nextKeyHistory(r, keyName, old, value, entry, b)
+			return err
+		}, func(tx backend.ConfigWriter) error {
+			if err := apply(tx); err != nil {
+				return err
+			}
+			return c.storeKeyHistory(map[string][]string{keyName: history}, tx)
+		})
+		if err != backend.ErrConflict {
+			break
+		}
+	}
+
+	switch err.(type) {
+	case nil:
+		return old, value, expiresAt, true
+	case PreconditionError:
+		SendErrorResponse(w, http.StatusPreconditionFailed, fmt.Sprintf("Precondition failed: %s", err))
+	case TxnError:
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+	default:
+		switch {
+		case err == backend.ErrConflict && header != "":
+			SendErrorResponse(w, http.StatusPreconditionFailed, fmt.Sprintf("Precondition failed: key %s was modified", keyName))
+		case err == backend.ErrConflict:
+			SendErrorResponse(w, http.StatusConflict, err.Error())
+		default:
+			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		}
+	}
+	return old, value, expiresAt, false
+}
+
+/*
+ * Reject writes to a key that exists with another type
+ */
+func requireType(keyName string, keytype int) func(KeyResponse) error {
+	return func(current KeyResponse) error {
+		actual := vars.TYPE_NOT_FOUND
+		switch current.(type) {
+		case *StringKeyResponse:
+			actual = vars.TYPE_STRING
+		case *HashKeyResponse:
+			actual = vars.TYPE_HASH
+		case *ListKeyResponse:
+			actual = vars.TYPE_LIST
+		}
+		if actual != vars.TYPE_NOT_FOUND && actual != keytype {
+			return TxnError{fmt.Sprintf("%s is a %s, not a %s", keyName, TypeToString(actual), TypeToString(keytype))}
+		}
+		return nil
+	}
+}
+
+/*
+ * Tell the client the ETag of a key it just changed
+ */
+func (c *ConfMgr) setETag(w http.ResponseWriter, keyName string, b backend.ConfigBackend) {
+	if etag, err := c.currentETag(keyName, b); err == nil && etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
@@ -0,0 +1,144 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * Expiry requested for a key write: ?ttl= as a duration ("4h") or in
+ * seconds, or ?expires_at= in RFC3339. Zero if neither is given.
+ */
+func requestExpiry(r *http.Request) (time.Time, error) {
+	query := r.URL.Query()
+	ttl := query.Get("ttl")
+	expiresAt := query.Get("expires_at")
+
+	switch {
+	case ttl != "" && expiresAt != "":
+		return time.Time{}, fmt.Errorf("ttl and expires_at are exclusive")
+	case ttl != "":
+		duration, err := time.ParseDuration(ttl)
+		if err != nil {
+			seconds, serr := strconv.Atoi(ttl)
+			if serr != nil {
+				return time.Time{}, fmt.Errorf("Invalid ttl: %s", err)
+			}
+			duration = time.Duration(seconds) * time.Second
+		}
+		if duration <= 0 {
+			return time.Time{}, fmt.Errorf("ttl must be positive")
+		}
+		return time.Now().Add(duration), nil
+	case expiresAt != "":
+		at, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Invalid expires_at: %s", err)
+		}
+		if !at.After(time.Now()) {
+			return time.Time{}, fmt.Errorf("expires_at must be in the future")
+		}
+		return at, nil
+	}
+	return time.Time{}, nil
+}
+
+/*
+ * Parse the requested expiry, replying 400 if it is invalid
+ */
+func checkExpiry(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	at, err := requestExpiry(r)
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, err.Error())
+		return at, false
+	}
+	return at, true
+}
+
+var errExpiryUnsupported = fmt.Errorf("ttl and expires_at are only supported on single key writes")
+
+/*
+ * Reply 400 to an expiry requested for writes that cannot set one
+ */
+func checkNoExpiry(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	if query.Get("ttl") != "" || query.Get("expires_at") != "" {
+		SendErrorResponse(w, http.StatusBadRequest, errExpiryUnsupported.Error())
+		return false
+	}
+	return true
+}
+
+/*
+ * Set a requested expiry in the commit of the write it belongs to. Whole
+ * key writes remove the expiry, so a write without one leaves it at that.
+ */
+func setExpiry(w backend.ConfigWriter, keyName string, at time.Time) error {
+	if at.IsZero() {
+		return nil
+	}
+	return w.SetExpiry(keyName, at)
+}
+
+/*
+ * Expiry as an optional JSON field, nil if the key does not expire
+ */
+func expiryField(at time.Time) *time.Time {
+	if at.IsZero() {
+		return nil
+	}
+	at = at.UTC()
+	return &at
+}
+
+// Remaining seconds until a key expires, rounded up
+func remainingTTL(at time.Time) int64 {
+	return int64(math.Max(math.Ceil(time.Until(at).Seconds()), 0))
+}
+
+/*
+ * Tell the client when a key expires and its remaining TTL in seconds.
+ * Returns the expiry, zero if the key does not expire.
+ */
+func (c *ConfMgr) setExpiryHeaders(w http.ResponseWriter, keyName string, b backend.ConfigBackend) time.Time {
+	at, err := b.GetExpiry(keyName)
+	if err != nil || at.IsZero() {
+		return time.Time{}
+	}
+	w.Header().Set("X-Confmgr-Expires", at.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Confmgr-TTL", strconv.FormatInt(remainingTTL(at), 10))
+	return at
+}
+
+/*
+ * A key as returned by /admin/key, with when it expires. The ETag is
+ * computed from the key alone.
+ */
+type ExpiringKeyResponse struct {
+	KeyResponse
+	ExpiresAt time.Time
+}
+
+func (r ExpiringKeyResponse) ToString() string {
+	return fmt.Sprintf("%s\n# expires_at: %s (ttl %ds)", r.KeyResponse.ToString(), r.ExpiresAt.UTC().Format(time.RFC3339), remainingTTL(r.ExpiresAt))
+}
+
+func (r ExpiringKeyResponse) ToJsonString() (string, error) {
+	jsonstr, err := r.KeyResponse.ToJsonString()
+	if err != nil {
+		return jsonstr, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonstr), &fields); err != nil {
+		return "", err
+	}
+	fields["expires_at"] = r.ExpiresAt.UTC().Format(time.RFC3339)
+	fields["ttl"] = remainingTTL(r.ExpiresAt)
+	jsonblob, err := json.Marshal(fields)
+	return string(jsonblob), err
+}
@@ -12,34 +12,31 @@ func (c *ConfMgr) Index(w http.ResponseWriter, r *http.Request, b backend.Config
 	fmt.Fprintln(w, "Welcome!")
 }
 
-/*
- * Extract scope variables from x-cfg-FOO request headers
- */
-func (c *ConfMgr) SetRequestScopeFromHeaders(headers http.Header) {
-	c.RequestScope = make(map[string]string)
-	for hdrname, hdrval := range headers {
-		hdrname = strings.ToLower(hdrname)
-		if strings.HasPrefix(hdrname, "x-cfg-") {
-			scopevar := strings.TrimPrefix(hdrname, "x-cfg-")
-			scopeval := strings.ToLower(hdrval[0])
-			c.RequestScope[scopevar] = scopeval
-		}
-	}
-}
-
-func ScopeFromHeaders(headers http.Header) map[string]string {
+func ScopeFromHeaders(headers http.Header, prefix string) map[string]string {
 	scope := make(map[string]string)
+	prefix = strings.ToLower(prefix)
 	for hdrname, hdrval := range headers {
 		hdrname = strings.ToLower(hdrname)
-		if strings.HasPrefix(hdrname, "x-cfg-") {
-			scopevar := strings.TrimPrefix(hdrname, "x-cfg-")
-			scopeval := strings.ToLower(hdrval[0])
-			scope[scopevar] = scopeval
+		if strings.HasPrefix(hdrname, prefix) {
+			scopevar := strings.TrimPrefix(hdrname, prefix)
+			scope[scopevar] = hdrval[0]
 		}
 	}
 
 	return scope
 }
+
+/*
+ * Hierarchy selected through the X-Confmgr-Hierarchy header or the
+ * hierarchy query parameter
+ */
+func RequestedHierarchy(r *http.Request) string {
+	if name := r.Header.Get("X-Confmgr-Hierarchy"); name != "" {
+		return name
+	}
+	return r.URL.Query().Get("hierarchy")
+}
+
 func GetRequestScope(r *http.Request) map[string]string {
 	return context.Get(r, ReqScope).(map[string]string)
 }
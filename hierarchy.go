@@ -0,0 +1,425 @@
+package confmgr
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/config"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Scope entry carrying the hierarchy explicitly selected by a request
+const HierarchyScopeKey = "@hierarchy"
+
+/*
+ * A compiled set of key paths. Levels are kept in configured order,
+ * most specific first.
+ *
+ * Level syntax:
+ *   sites:%{site}                        plain token interpolation
+ *   apps:%{app}:%{env?}                  optional token, dropped with its separator if unset
+ *   regions:%{region} when site =~ ^us-  only used if all conditions hold (joined with "and")
+ *
+ * Conditions support ==, !=, =~ and !~. Unset tokens compare as "".
+ */
+type Hierarchy struct {
+	Levels  []HierarchyLevel
+	Derived map[string]DerivedToken
+	Paths   []string
+	Source  string
+	Version int
+}
+
+type HierarchyLevel struct {
+	Path       string
+	Conditions []LevelCondition
+	pattern    *regexp.Regexp
+	tokens     []string
+}
+
+type LevelCondition struct {
+	Token    string
+	Operator string
+	Value    string
+	re       *regexp.Regexp
+}
+
+/*
+ * A token computed from another scope token, either through a
+ * mapping table or the first capture group of a pattern
+ */
+type DerivedToken struct {
+	From    string
+	Map     map[string]string
+	Pattern *regexp.Regexp
+	Default string
+}
+
+var (
+	levelTokenRe     = regexp.MustCompile("%{(.*?)}")
+	levelTokenNameRe = regexp.MustCompile("^[a-z0-9_-]+\\??$")
+	levelConditionRe = regexp.MustCompile("^\\s*([a-z0-9_-]+)\\s*(==|!=|=~|!~)\\s*(.*?)\\s*$")
+)
+
+/*
+ * Compile all named hierarchies. key_paths defines the "default" hierarchy.
+ */
+func NewHierarchies(cfg config.MainConfig) (map[string]*Hierarchy, error) {
+	hierarchies := make(map[string]*Hierarchy)
+
+	definitions := make(map[string][]string)
+	for name, paths := range cfg.Hierarchies {
+		definitions[name] = paths
+	}
+	if len(cfg.KeyPaths) > 0 {
+		if _, ok := definitions["default"]; ok {
+			return hierarchies, fmt.Errorf("Hierarchy 'default' is defined by both key_paths and hierarchies")
+		}
+		definitions["default"] = cfg.KeyPaths
+	}
+
+	for name, paths := range definitions {
+		h, err := NewHierarchy(paths, cfg.Derived)
+		if err != nil {
+			return hierarchies, fmt.Errorf("Hierarchy %s: %s", name, err)
+		}
+		h.Source = "config"
+		hierarchies[name] = h
+	}
+
+	if _, ok := hierarchies[cfg.DefaultHierarchy]; !ok && len(hierarchies) > 0 {
+		return hierarchies, fmt.Errorf("Default hierarchy '%s' is not defined", cfg.DefaultHierarchy)
+	}
+
+	for _, rule := range cfg.HierarchyRules {
+		if _, err := path.Match(rule.Keys, ""); err != nil {
+			return hierarchies, fmt.Errorf("Hierarchy rule '%s': %s", rule.Keys, err)
+		}
+		if _, ok := hierarchies[rule.Hierarchy]; !ok {
+			return hierarchies, fmt.Errorf("Hierarchy rule '%s': unknown hierarchy '%s'", rule.Keys, rule.Hierarchy)
+		}
+	}
+
+	return hierarchies, nil
+}
+
+/*
+ * Return the hierarchy names, default first
+ */
+func (c *ConfMgr) HierarchyNames() []string {
+	hierarchies := c.GetHierarchies()
+	names := make([]string, 0, len(hierarchies))
+	for name := range hierarchies {
+		if name != c.Config.Main.DefaultHierarchy {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if _, ok := hierarchies[c.Config.Main.DefaultHierarchy]; ok {
+		names = append([]string{c.Config.Main.DefaultHierarchy}, names...)
+	}
+	return names
+}
+
+/*
+ * Pick the hierarchy for a key: an explicit selection in the request scope
+ * wins, then the first hierarchy rule matching the key name, then the default
+ */
+func (c *ConfMgr) HierarchyFor(keyName string, scope map[string]string) *Hierarchy {
+	hierarchies := c.GetHierarchies()
+	if name, ok := scope[HierarchyScopeKey]; ok {
+		if h, ok := hierarchies[name]; ok {
+			return h
+		}
+	}
+
+	if keyName != "" {
+		for _, rule := range c.Config.Main.HierarchyRules {
+			if matched, _ := path.Match(rule.Keys, keyName); matched {
+				log.Debugf("Key %s uses hierarchy %s", keyName, rule.Hierarchy)
+				return hierarchies[rule.Hierarchy]
+			}
+		}
+	}
+
+	if h, ok := hierarchies[c.Config.Main.DefaultHierarchy]; ok {
+		return h
+	}
+	return &Hierarchy{}
+}
+
+func NewHierarchy(paths []string, derived map[string]config.DerivedTokenConfig) (*Hierarchy, error) {
+	h := &Hierarchy{
+		Levels:  make([]HierarchyLevel, 0, len(paths)),
+		Derived: make(map[string]DerivedToken),
+		Paths:   paths,
+	}
+
+	for _, path := range paths {
+		level, err := parseLevel(path)
+		if err != nil {
+			return h, fmt.Errorf("Invalid key path '%s': %s", path, err)
+		}
+		h.Levels = append(h.Levels, level)
+	}
+
+	for token, cfg := range derived {
+		if cfg.From == "" {
+			return h, fmt.Errorf("Derived token %s: missing 'from'", token)
+		}
+		d := DerivedToken{
+			From:    cfg.From,
+			Map:     cfg.Map,
+			Default: cfg.Default,
+		}
+		if cfg.Pattern != "" {
+			pattern, err := regexp.Compile(cfg.Pattern)
+			if err != nil {
+				return h, fmt.Errorf("Derived token %s: %s", token, err)
+			}
+			if pattern.NumSubexp() < 1 {
+				return h, fmt.Errorf("Derived token %s: pattern needs a capture group", token)
+			}
+			d.Pattern = pattern
+		}
+		h.Derived[token] = d
+	}
+
+	return h, nil
+}
+
+func parseLevel(definition string) (HierarchyLevel, error) {
+	var level HierarchyLevel
+
+	path := definition
+	if idx := strings.Index(definition, " when "); idx >= 0 {
+		path = definition[:idx]
+		for _, cond := range strings.Split(definition[idx+len(" when "):], " and ") {
+			condition, err := parseCondition(cond)
+			if err != nil {
+				return level, err
+			}
+			level.Conditions = append(level.Conditions, condition)
+		}
+	}
+	level.Path = strings.TrimSpace(path)
+
+	if strings.Count(level.Path, "%{") != len(levelTokenRe.FindAllString(level.Path, -1)) {
+		return level, fmt.Errorf("unterminated token")
+	}
+
+	// Build a pattern to map expanded paths back onto this level
+	var pattern string
+	segments := strings.Split(level.Path, ":")
+	for idx, segment := range segments {
+		sep := ":"
+		if idx == 0 {
+			sep = ""
+		}
+
+		var segPattern string
+		last := 0
+		optional := false
+		for _, loc := range levelTokenRe.FindAllStringSubmatchIndex(segment, -1) {
+			name := segment[loc[2]:loc[3]]
+			if !levelTokenNameRe.MatchString(name) {
+				return level, fmt.Errorf("invalid token name '%s'", name)
+			}
+			if strings.HasSuffix(name, "?") {
+				optional = true
+				name = strings.TrimSuffix(name, "?")
+			}
+			segPattern += regexp.QuoteMeta(segment[last:loc[0]]) + "([^:]+)"
+			level.tokens = append(level.tokens, name)
+			last = loc[1]
+		}
+		segPattern += regexp.QuoteMeta(segment[last:])
+
+		switch {
+		case optional && idx == 0 && len(segments) > 1:
+			pattern += "(?:" + segPattern + ":)?"
+		case optional:
+			pattern += "(?:" + sep + segPattern + ")?"
+		default:
+			pattern += sep + segPattern
+		}
+	}
+
+	var err error
+	level.pattern, err = regexp.Compile("^" + pattern + "$")
+	return level, err
+}
+
+func parseCondition(definition string) (LevelCondition, error) {
+	var condition LevelCondition
+
+	matches := levelConditionRe.FindStringSubmatch(definition)
+	if matches == nil {
+		return condition, fmt.Errorf("invalid condition '%s'", strings.TrimSpace(definition))
+	}
+	condition.Token = matches[1]
+	condition.Operator = matches[2]
+	condition.Value = strings.Trim(matches[3], "\"'")
+
+	if condition.Operator == "=~" || condition.Operator == "!~" {
+		re, err := regexp.Compile(condition.Value)
+		if err != nil {
+			return condition, fmt.Errorf("invalid condition '%s': %s", strings.TrimSpace(definition), err)
+		}
+		condition.re = re
+	}
+
+	return condition, nil
+}
+
+func (cond LevelCondition) Matches(scope map[string]string) bool {
+	value := scope[cond.Token]
+
+	switch cond.Operator {
+	case "==":
+		return value == cond.Value
+	case "!=":
+		return value != cond.Value
+	case "=~":
+		return cond.re.MatchString(value)
+	case "!~":
+		return !cond.re.MatchString(value)
+	default:
+		return false
+	}
+}
+
+/*
+ * Return a copy of scope with all derivable tokens filled in.
+ * Tokens already present in the scope are left alone.
+ */
+func (h *Hierarchy) DeriveScope(scope map[string]string) map[string]string {
+	derived := make(map[string]string)
+	for token, value := range scope {
+		derived[token] = value
+	}
+
+	for token, d := range h.Derived {
+		if _, ok := derived[token]; ok {
+			continue
+		}
+		source, ok := scope[d.From]
+		if !ok {
+			continue
+		}
+
+		var value string
+		if mapped, ok := d.Map[source]; ok {
+			value = mapped
+		} else if d.Pattern != nil {
+			if matches := d.Pattern.FindStringSubmatch(source); matches != nil {
+				value = matches[1]
+			}
+		}
+		if value == "" {
+			value = d.Default
+		}
+		if value != "" {
+			log.Debugf("   Derived token '%s' = '%s' from '%s'", token, value, d.From)
+			derived[token] = value
+		}
+	}
+
+	return derived
+}
+
+/**
+ * Returns the paths in reverse order as this is how all other functions
+ * will consume it
+ **/
+func (h *Hierarchy) SearchPaths(reqscope map[string]string) []string {
+	newKeyPaths := make([]string, 0)
+	scope := h.DeriveScope(reqscope)
+
+PathsLoop:
+	for _, level := range h.Levels {
+		path := level.Path
+		log.Debugf("Config key path: '%s'", path)
+
+		for _, cond := range level.Conditions {
+			if !cond.Matches(scope) {
+				log.Debugf("  Ignoring path %s because condition '%s %s %s' does not hold", path, cond.Token, cond.Operator, cond.Value)
+				continue PathsLoop
+			}
+		}
+
+		collapse := false
+		matches := levelTokenRe.FindAllStringSubmatch(path, -1)
+		for _, match := range matches {
+			token_str := match[0]
+			token_name := strings.TrimSuffix(match[1], "?")
+			optional := token_name != match[1]
+
+			// Check if this token is defined in the request scope
+			if val, ok := scope[token_name]; ok {
+				log.Debugf("   Token '%s' is defined in the request as '%s'", token_name, val)
+				path = strings.Replace(path, token_str, val, 1)
+				log.Debugf("    Modified path: %s", path)
+			} else if optional {
+				log.Debugf("   Optional token '%s' is not set", token_name)
+				path = strings.Replace(path, token_str, "", 1)
+				collapse = true
+			} else {
+				// Cannot replace this token, ignore this path completely
+				log.Debugf("  Ignoring path %s because token %s is not set", path, token_name)
+				continue PathsLoop
+			}
+		}
+
+		if collapse {
+			// Drop the separators of unset optional tokens
+			segments := make([]string, 0)
+			for _, segment := range strings.Split(path, ":") {
+				if segment != "" {
+					segments = append(segments, segment)
+				}
+			}
+			path = strings.Join(segments, ":")
+			if path == "" {
+				continue
+			}
+		}
+
+		// Poor man's prepend. Make new slice with current value at the beginning
+		// Then iterate over existing entries and append them one by one
+		var tmpslice = make([]string, 1)
+		tmpslice[0] = path
+		for _, entry := range newKeyPaths {
+			tmpslice = append(tmpslice, entry)
+		}
+		newKeyPaths = tmpslice
+	}
+
+	return newKeyPaths
+}
+
+/*
+ * Match an expanded path like "sites:lon" against the levels
+ * and return the matching level along with the token values used
+ */
+func (h *Hierarchy) MatchLevel(path string) (string, map[string]string, bool) {
+	for _, level := range h.Levels {
+		matches := level.pattern.FindStringSubmatch(path)
+		if matches == nil {
+			continue
+		}
+
+		tokens := make(map[string]string)
+		for idx, name := range level.tokens {
+			if matches[idx+1] != "" {
+				tokens[name] = matches[idx+1]
+			}
+		}
+		return level.Path, tokens, true
+	}
+
+	return "", nil, false
+}
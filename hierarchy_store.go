@@ -0,0 +1,301 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/config"
+	"regexp"
+	"strings"
+	"time"
+)
+
+/*
+ * Hierarchies changed through the admin API are stored in the backend
+ * as a list of versions, the last entry being the active one
+ */
+type HierarchyVersion struct {
+	Version      int       `json:"version"`
+	Time         time.Time `json:"time"`
+	Paths        []string  `json:"paths"`
+	RevertedFrom int       `json:"reverted_from,omitempty"`
+}
+
+type HierarchyRequest struct {
+	Data []string `json:"data"`
+}
+
+type HierarchyResponse struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Source  string   `json:"source"`
+	Version int      `json:"version"`
+	Data    []string `json:"data"`
+}
+
+func (r HierarchyResponse) ToString() string {
+	return strings.Join(r.Data, "\n")
+}
+
+func (r HierarchyResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+type HierarchyHistoryResponse struct {
+	Type string             `json:"type"`
+	Data []HierarchyVersion `json:"data"`
+}
+
+func (r HierarchyHistoryResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, entry := range r.Data {
+		lines[idx] = fmt.Sprintf("%d %s: %s", entry.Version, entry.Time.Format(time.RFC3339), strings.Join(entry.Paths, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r HierarchyHistoryResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * A rejected hierarchy change, as opposed to a backend failure
+ */
+type HierarchyError struct {
+	Message string
+}
+
+func (e HierarchyError) Error() string {
+	return e.Message
+}
+
+var (
+	hierarchyNameRe = regexp.MustCompile("^[a-z0-9_-]+$")
+)
+
+func hierarchyKey(cfg config.MainConfig, namespace string, name string) string {
+	return fmt.Sprintf("%shierarchy:%s:%s", cfg.MetaPrefix, namespace, name)
+}
+
+/*
+ * Read the active version of every hierarchy stored for this namespace
+ */
+func (c *ConfMgr) StoredHierarchies(cfg config.MainConfig, b backend.ConfigBackend) (map[string]HierarchyVersion, error) {
+	stored := make(map[string]HierarchyVersion)
+	prefix := hierarchyKey(cfg, c.Namespace, "")
+
+	keys, err := b.ListKeys(prefix + "*")
+	if err != nil {
+		return stored, err
+	}
+
+	for _, key := range keys {
+		history, err := c.readHierarchyHistory(key, b)
+		if err != nil {
+			return stored, err
+		}
+		if len(history) > 0 {
+			stored[strings.TrimPrefix(key, prefix)] = history[len(history)-1]
+		}
+	}
+
+	return stored, nil
+}
+
+func (c *ConfMgr) readHierarchyHistory(key string, b backend.ConfigBackend) ([]HierarchyVersion, error) {
+	history := make([]HierarchyVersion, 0)
+
+	entries, err := b.GetList(key)
+	if err != nil {
+		return history, err
+	}
+
+	for _, entry := range entries {
+		var version HierarchyVersion
+		if err := json.Unmarshal([]byte(entry), &version); err != nil {
+			return history, fmt.Errorf("Corrupt hierarchy history in %s: %s", key, err)
+		}
+		history = append(history, version)
+	}
+
+	return history, nil
+}
+
+func (c *ConfMgr) HierarchyHistory(name string, b backend.ConfigBackend) ([]HierarchyVersion, error) {
+	return c.readHierarchyHistory(hierarchyKey(c.Config.Main, c.Namespace, name), b)
+}
+
+/*
+ * Validate and store a new version of a hierarchy, then make it active
+ * for new requests
+ */
+func (c *ConfMgr) StoreHierarchy(name string, paths []string, b backend.ConfigBackend) (HierarchyVersion, error) {
+	return c.storeHierarchyVersion(name, HierarchyVersion{Paths: paths}, b)
+}
+
+/*
+ * Make a previous version of a hierarchy active again
+ */
+func (c *ConfMgr) RevertHierarchy(name string, version int, b backend.ConfigBackend) (HierarchyVersion, error) {
+	return c.storeHierarchyVersion(name, HierarchyVersion{RevertedFrom: version}, b)
+}
+
+/*
+ * Append a version to the stored history of a hierarchy, taking the paths
+ * of entry.RevertedFrom if it is set. The history is read and written in
+ * one transaction so concurrent changes get distinct version numbers.
+ */
+func (c *ConfMgr) storeHierarchyVersion(name string, entry HierarchyVersion, b backend.ConfigBackend) (HierarchyVersion, error) {
+	if !hierarchyNameRe.MatchString(name) {
+		return entry, HierarchyError{fmt.Sprintf("Invalid hierarchy name: %s", name)}
+	}
+
+	key := hierarchyKey(c.Config.Main, c.Namespace, name)
+	var compiled *Hierarchy
+	var entries []string
+	check := func() error {
+		history, err := c.readHierarchyHistory(key, b)
+		if err != nil {
+			return err
+		}
+
+		if entry.RevertedFrom != 0 {
+			for _, previous := range history {
+				if previous.Version == entry.RevertedFrom {
+					entry.Paths = previous.Paths
+				}
+			}
+			if entry.Paths == nil {
+				return HierarchyError{fmt.Sprintf("Hierarchy %s has no version %d", name, entry.RevertedFrom)}
+			}
+		}
+		if len(entry.Paths) == 0 {
+			return HierarchyError{"A hierarchy needs at least one key path"}
+		}
+		if compiled, err = NewHierarchy(entry.Paths, c.Config.Main.Derived); err != nil {
+			return HierarchyError{err.Error()}
+		}
+
+		if len(history) == 0 {
+			// Keep the configured hierarchy as the first version so it can be reverted to
+			if current, ok := c.GetHierarchies()[name]; ok {
+				history = append(history, HierarchyVersion{
+					Version: 1,
+					Time:    time.Now(),
+					Paths:   current.Paths,
+				})
+			}
+		}
+
+		entry.Version = 1
+		if len(history) > 0 {
+			entry.Version = history[len(history)-1].Version + 1
+		}
+		entry.Time = time.Now()
+		history = append(history, entry)
+		if depth := c.Config.Main.HierarchyHistory; depth > 0 && len(history) > depth {
+			history = history[len(history)-depth:]
+		}
+
+		entries = make([]string, len(history))
+		for idx, version := range history {
+			jsonblob, err := json.Marshal(version)
+			if err != nil {
+				return err
+			}
+			entries[idx] = string(jsonblob)
+		}
+		return nil
+	}
+	apply := func(w backend.ConfigWriter) error {
+		return w.SetList(key, entries)
+	}
+
+	if err := b.Atomic([]string{key}, check, apply); err != nil {
+		return entry, err
+	}
+
+	compiled.Source = "backend"
+	compiled.Version = entry.Version
+	c.setHierarchy(name, compiled)
+	log.Infof("Activated version %d of hierarchy %s in namespace %s", entry.Version, name, c.Namespace)
+
+	return entry, nil
+}
+
+/*
+ * Load stored hierarchies on top of the configured ones. Failing to reach
+ * the backend is not fatal, the configured hierarchies are used instead.
+ */
+func (c *ConfMgr) mergeStoredHierarchies(hierarchies map[string]*Hierarchy, cfg config.MainConfig) {
+	if BackendFactory == nil {
+		return
+	}
+
+	b := BackendFactory.NewBackend()
+	defer b.Close()
+
+	stored, err := c.StoredHierarchies(cfg, b)
+	if err != nil {
+		log.Warnf("Cannot load stored hierarchies, using configured ones: %s", err)
+		return
+	}
+
+	for name, version := range stored {
+		h, err := NewHierarchy(version.Paths, cfg.Derived)
+		if err != nil {
+			log.Warnf("Ignoring invalid stored hierarchy %s version %d: %s", name, version.Version, err)
+			continue
+		}
+		h.Source = "backend"
+		h.Version = version.Version
+		hierarchies[name] = h
+	}
+}
+
+func (c *ConfMgr) GetHierarchies() map[string]*Hierarchy {
+	c = c.origin()
+	c.hierarchyLock.RLock()
+	defer c.hierarchyLock.RUnlock()
+	return c.Hierarchies
+}
+
+func (c *ConfMgr) setHierarchies(hierarchies map[string]*Hierarchy) {
+	c = c.origin()
+	c.hierarchyLock.Lock()
+	defer c.hierarchyLock.Unlock()
+	c.Hierarchies = hierarchies
+}
+
+/*
+ * Swap in a single hierarchy. The map is copied so readers holding
+ * the previous one are unaffected.
+ */
+func (c *ConfMgr) setHierarchy(name string, h *Hierarchy) {
+	c = c.origin()
+	c.hierarchyLock.Lock()
+	defer c.hierarchyLock.Unlock()
+
+	// A concurrent change committed a later version first
+	if existing, ok := c.Hierarchies[name]; ok && existing.Source == h.Source && existing.Version > h.Version {
+		return
+	}
+
+	hierarchies := make(map[string]*Hierarchy)
+	for n, existing := range c.Hierarchies {
+		hierarchies[n] = existing
+	}
+	hierarchies[name] = h
+	c.Hierarchies = hierarchies
+}
@@ -0,0 +1,197 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type ImpactRequest struct {
+	Type   string              `json:"type"`
+	Scopes []map[string]string `json:"scopes"`
+}
+
+type ScopeImpact struct {
+	Scope   map[string]string `json:"scope"`
+	Changed bool              `json:"changed"`
+	Before  KeyResponse       `json:"before"`
+	After   KeyResponse       `json:"after"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type ImpactResponse struct {
+	Type string        `json:"type"`
+	Key  string        `json:"key"`
+	Name string        `json:"name"`
+	Data []ScopeImpact `json:"data"`
+}
+
+func (r ImpactResponse) ToString() string {
+	lines := make([]string, 0)
+	for _, entry := range r.Data {
+		switch {
+		case entry.Error != "":
+			lines = append(lines, fmt.Sprintf("%s: error: %s", ScopeString(entry.Scope), entry.Error))
+		case entry.Changed:
+			lines = append(lines, fmt.Sprintf("%s: changed", ScopeString(entry.Scope)))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ImpactResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * An impact request that cannot be evaluated, nothing was looked up
+ */
+type ImpactError struct {
+	Message string
+}
+
+func (e ImpactError) Error() string {
+	return e.Message
+}
+
+/*
+ * Resolve keyName's logical key for every scope with and without the
+ * proposed write. Nothing is persisted, the write only lives in an overlay.
+ */
+func (c *ConfMgr) ImpactOfWrite(keyName string, jsondata []byte, b backend.ConfigBackend) (ImpactResponse, error) {
+	var resp ImpactResponse
+	var request ImpactRequest
+
+	resp.Type = "list"
+	resp.Key = keyName
+	resp.Data = make([]ScopeImpact, 0)
+
+	if err := json.Unmarshal(jsondata, &request); err != nil {
+		return resp, ImpactError{err.Error()}
+	}
+
+	location, ok := c.ParseKey(keyName)
+	if !ok {
+		return resp, ImpactError{fmt.Sprintf("Key %s is not on any hierarchy level", keyName)}
+	}
+	resp.Name = location.Name
+
+	// Writes to an overlay only fail on invalid data
+	proposed := overlay.New(b)
+	if err := c.SaveKeyFromJSON(keyName, jsondata, proposed); err != nil {
+		return resp, ImpactError{err.Error()}
+	}
+
+	impacts, err := c.CompareLookups(location.Name, request.Type, request.Scopes, b, proposed)
+	if err != nil {
+		return resp, err
+	}
+	resp.Data = impacts
+
+	return resp, nil
+}
+
+/*
+ * Resolve a logical key for every scope against the live backend and a
+ * proposed state. Without scopes, the scopes of all registered nodes are
+ * used.
+ */
+func (c *ConfMgr) CompareLookups(name string, keyType string, scopes []map[string]string, b backend.ConfigBackend, proposed backend.ConfigBackend) ([]ScopeImpact, error) {
+	impacts := make([]ScopeImpact, 0)
+
+	if len(scopes) == 0 {
+		registered, err := c.RegisteredScopes(b)
+		if err != nil {
+			return impacts, err
+		}
+		scopes = registered
+	}
+	if len(scopes) == 0 {
+		return impacts, ImpactError{"No scopes supplied and no nodes registered"}
+	}
+
+	for _, scope := range scopes {
+		scope, err := c.ScopeValidator.Normalize(scope)
+		if err != nil {
+			return impacts, err
+		}
+		scope, err = c.ExpandScope(scope, b)
+		if err != nil {
+			return impacts, err
+		}
+		impact := ScopeImpact{Scope: scope}
+
+		failures := make([]string, 0, 2)
+		before, err := c.LookupKey(name, keyType, scope, b)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("Current lookup failed: %s", err))
+		}
+		after, err := c.LookupKey(name, keyType, scope, proposed)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("Proposed lookup failed: %s", err))
+		}
+		impact.Error = strings.Join(failures, "; ")
+
+		impact.Before = before
+		impact.After = after
+		impact.Changed = !reflect.DeepEqual(ResolvedValue(before), ResolvedValue(after))
+		impacts = append(impacts, impact)
+	}
+
+	return impacts, nil
+}
+
+/*
+ * Strip the source information from a lookup response so two
+ * lookups can be compared by value
+ */
+func ResolvedValue(resp KeyResponse) interface{} {
+	switch r := resp.(type) {
+	case LookupStringResponse:
+		if r.Data.Source == "" {
+			return nil
+		}
+		return r.Data.Value
+	case LookupHashResponse:
+		if len(r.Data) == 0 {
+			return nil
+		}
+		value := make(map[string]string)
+		for k, v := range r.Data {
+			value[k] = v.Value
+		}
+		return value
+	case LookupListResponse:
+		if len(r.Data) == 0 {
+			return nil
+		}
+		value := make([]string, len(r.Data))
+		for idx, entry := range r.Data {
+			value[idx] = entry.Value
+		}
+		return value
+	default:
+		return nil
+	}
+}
+
+/*
+ * Format a scope as "site=lon,pod=a" with sorted token names
+ */
+func ScopeString(scope map[string]string) string {
+	tokens := make([]string, 0, len(scope))
+	for token, value := range scope {
+		tokens = append(tokens, fmt.Sprintf("%s=%s", token, value))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, ",")
+}
@@ -0,0 +1,310 @@
+package confmgr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/moensch/confmgr/config"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var jwtHashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+/*
+ * Verifies JWTs signed with a single configured algorithm and key.
+ * Tokens announcing any other algorithm are rejected.
+ */
+type JWTVerifier struct {
+	Algorithm        string
+	Issuer           string
+	Audience         string
+	ScopeClaim       string
+	PermissionsClaim string
+	StrictScope      bool
+	Leeway           time.Duration
+
+	hash      crypto.Hash
+	secret    []byte
+	publicKey crypto.PublicKey
+}
+
+/*
+ * Compile the JWT settings, nil if JWT authentication is not configured
+ */
+func NewJWTVerifier(cfg config.JWTConfig) (*JWTVerifier, error) {
+	if cfg.Algorithm == "" {
+		return nil, nil
+	}
+
+	v := &JWTVerifier{
+		Algorithm:        cfg.Algorithm,
+		Issuer:           cfg.Issuer,
+		Audience:         cfg.Audience,
+		ScopeClaim:       cfg.ScopeClaim,
+		PermissionsClaim: cfg.PermissionsClaim,
+		StrictScope:      cfg.StrictScope,
+		Leeway:           cfg.Leeway.Duration,
+	}
+	if v.ScopeClaim == "" {
+		v.ScopeClaim = "scope"
+	}
+	if v.PermissionsClaim == "" {
+		v.PermissionsClaim = "permissions"
+	}
+
+	if len(cfg.Algorithm) != 5 {
+		return v, fmt.Errorf("Unsupported JWT algorithm '%s'", cfg.Algorithm)
+	}
+	hash, ok := jwtHashes[cfg.Algorithm[2:]]
+	if !ok {
+		return v, fmt.Errorf("Unsupported JWT algorithm '%s'", cfg.Algorithm)
+	}
+	v.hash = hash
+
+	switch cfg.Algorithm[:2] {
+	case "HS":
+		v.secret = []byte(cfg.Secret)
+		if cfg.SecretFile != "" {
+			secret, err := ioutil.ReadFile(cfg.SecretFile)
+			if err != nil {
+				return v, err
+			}
+			v.secret = []byte(strings.TrimSpace(string(secret)))
+		}
+		if len(v.secret) == 0 {
+			return v, fmt.Errorf("JWT algorithm %s needs secret or secret_file", cfg.Algorithm)
+		}
+	case "RS", "ES":
+		key, err := loadPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return v, err
+		}
+		switch key.(type) {
+		case *rsa.PublicKey:
+			if cfg.Algorithm[:2] != "RS" {
+				return v, fmt.Errorf("JWT algorithm %s needs an ECDSA key", cfg.Algorithm)
+			}
+		case *ecdsa.PublicKey:
+			if cfg.Algorithm[:2] != "ES" {
+				return v, fmt.Errorf("JWT algorithm %s needs an RSA key", cfg.Algorithm)
+			}
+		default:
+			return v, fmt.Errorf("Unsupported public key type %T", key)
+		}
+		v.publicKey = key
+	default:
+		return v, fmt.Errorf("Unsupported JWT algorithm '%s'", cfg.Algorithm)
+	}
+
+	return v, nil
+}
+
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	if file == "" {
+		return nil, fmt.Errorf("JWT public_key_file must be set")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data in %s", file)
+	}
+
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+/*
+ * Check a token's signature and claims and return the client it identifies
+ */
+func (v *JWTVerifier) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	if header.Alg != v.Algorithm {
+		return nil, fmt.Errorf("unexpected algorithm '%s'", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %s", err)
+	}
+	if err := v.verifySignature(parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %s", err)
+	}
+
+	return v.principal(claims)
+}
+
+func decodeJWTPart(part string, target interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+func (v *JWTVerifier) verifySignature(signed string, signature []byte) error {
+	h := v.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := v.publicKey.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, v.hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	}
+
+	mac := hmac.New(v.hash.New, v.secret)
+	mac.Write([]byte(signed))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func (v *JWTVerifier) principal(claims map[string]interface{}) (*Principal, error) {
+	now := time.Now()
+	// A leaked token must not grant its scope and permissions forever
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("missing expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("token not valid yet")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return nil, fmt.Errorf("unexpected issuer")
+	}
+	if v.Audience != "" && !jwtAudience(claims["aud"], v.Audience) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("missing subject")
+	}
+	principal := &Principal{Name: subject, Method: AuthJWT}
+
+	if raw, ok := claims[v.ScopeClaim]; ok {
+		values, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("claim %s must be an object", v.ScopeClaim)
+		}
+		principal.Scope = make(map[string]string)
+		for token, value := range values {
+			str, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("scope token %s must be a string", token)
+			}
+			principal.Scope[token] = str
+		}
+	}
+
+	if raw, ok := claims[v.PermissionsClaim]; ok {
+		values, ok := raw.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("claim %s must be a list", v.PermissionsClaim)
+		}
+		principal.Permissions = make([]Permission, 0, len(values))
+		for _, value := range values {
+			str, _ := value.(string)
+			permission, err := ParsePermission(str)
+			if err != nil {
+				return nil, err
+			}
+			principal.Permissions = append(principal.Permissions, permission)
+		}
+	}
+
+	return principal, nil
+}
+
+func jwtAudience(aud interface{}, expected string) bool {
+	switch value := aud.(type) {
+	case string:
+		return value == expected
+	case []interface{}:
+		for _, entry := range value {
+			if entry == expected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * Combine client supplied scope with scope from a verified token. Token
+ * values always win; with strict_scope the client scope is ignored.
+ */
+func (c *ConfMgr) TrustedScope(scope map[string]string, tokenScope map[string]string) (map[string]string, error) {
+	trusted, err := c.ScopeValidator.Normalize(tokenScope)
+	if err != nil {
+		return scope, err
+	}
+	if c.Auth != nil && c.Auth.JWT != nil && c.Auth.JWT.StrictScope {
+		return trusted, nil
+	}
+
+	merged := make(map[string]string)
+	for token, value := range scope {
+		merged[token] = value
+	}
+	for token, value := range trusted {
+		merged[token] = value
+	}
+	return merged, nil
+}
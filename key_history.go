@@ -0,0 +1,327 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * A value a key had after an admin change. The history of a key is kept
+ * in the backend as a list of versions, the last entry being the current
+ * value.
+ */
+type KeyVersion struct {
+	Version        int         `json:"version"`
+	Time           time.Time   `json:"time"`
+	Author         string      `json:"author,omitempty"`
+	Op             string      `json:"op"`
+	Type           string      `json:"type,omitempty"`
+	Data           interface{} `json:"data,omitempty"`
+	Deleted        bool        `json:"deleted,omitempty"`
+	RolledBackFrom int         `json:"rolled_back_from,omitempty"`
+	ExpiresAt      *time.Time  `json:"expires_at,omitempty"`
+}
+
+type KeyHistoryResponse struct {
+	Type string       `json:"type"`
+	Key  string       `json:"key"`
+	Data []KeyVersion `json:"data"`
+}
+
+func (r KeyHistoryResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, entry := range r.Data {
+		author := entry.Author
+		if author == "" {
+			author = "-"
+		}
+		lines[idx] = fmt.Sprintf("%d %s %s %s", entry.Version, entry.Time.Format(time.RFC3339), author, entry.Op)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r KeyHistoryResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * A rollback to a version that does not exist
+ */
+type KeyHistoryError struct {
+	Message string
+}
+
+func (e KeyHistoryError) Error() string {
+	return e.Message
+}
+
+func (c *ConfMgr) keyHistoryKey(keyName string) string {
+	return c.Config.Main.MetaPrefix + "history:" + keyName
+}
+
+/*
+ * Current value of a key, nil if the key does not exist or neither the
+ * audit log nor key history need it
+ */
+func (c *ConfMgr) keySnapshot(keyName string, b backend.ConfigBackend) KeyResponse {
+	if c.Audit == nil && c.Config.Main.KeyHistory <= 0 {
+		return nil
+	}
+	value, err := c.ReadKey(keyName, b)
+	if err != nil {
+		log.Warnf("Cannot read %s before change: %s", keyName, err)
+		return nil
+	}
+	return value
+}
+
+func newKeyVersion(op string, value KeyResponse) (KeyVersion, error) {
+	version := KeyVersion{Time: time.Now(), Op: op}
+	if value == nil {
+		version.Deleted = true
+		return version, nil
+	}
+
+	jsonstr, err := value.ToJsonString()
+	if err != nil {
+		return version, err
+	}
+	var generic GenericRequest
+	if err := json.Unmarshal([]byte(jsonstr), &generic); err != nil {
+		return version, err
+	}
+	version.Type = generic.Type
+	version.Data = generic.Data
+	return version, nil
+}
+
+func (c *ConfMgr) KeyHistory(keyName string, b backend.ConfigBackend) ([]KeyVersion, error) {
+	history := make([]KeyVersion, 0)
+	key := c.keyHistoryKey(keyName)
+
+	entries, err := b.GetList(key)
+	if err != nil {
+		return history, err
+	}
+
+	for _, entry := range entries {
+		var version KeyVersion
+		if err := json.Unmarshal([]byte(entry), &version); err != nil {
+			return history, fmt.Errorf("Corrupt key history in %s: %s", key, err)
+		}
+		history = append(history, version)
+	}
+
+	return history, nil
+}
+
+/*
+ * Values of keys after a write, and when they expire, read from the write
+ * staged on an overlay of the backend. nil if neither the audit log nor
+ * key history need them.
+ */
+func (c *ConfMgr) stagedKeys(keys []string, apply func(backend.ConfigWriter) error, b backend.ConfigBackend) (map[string]KeyResponse, map[string]time.Time, error) {
+	if c.Audit == nil && c.Config.Main.KeyHistory <= 0 {
+		return nil, nil, nil
+	}
+
+	staged := overlay.New(b)
+	if err := apply(staged); err != nil {
+		return nil, nil, err
+	}
+
+	values := make(map[string]KeyResponse)
+	expiries := make(map[string]time.Time)
+	for _, key := range keys {
+		value, err := c.ReadKey(key, staged)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[key] = value
+		if value == nil {
+			continue
+		}
+		if expiries[key], err = staged.GetExpiry(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return values, expiries, nil
+}
+
+/*
+ * History of a key with the value it has after a change appended,
+ * serialized for the backend. The value before the first recorded change
+ * is kept as version 1. Built while the history is watched, so it is
+ * stored in the same commit as the change. nil if history is disabled.
+ */
+func (c *ConfMgr) nextKeyHistory(r *http.Request, keyName string, old KeyResponse, value KeyResponse, entry KeyVersion, b backend.ConfigBackend) ([]string, error) {
+	depth := c.Config.Main.KeyHistory
+	if depth <= 0 {
+		return nil, nil
+	}
+
+	history, err := c.KeyHistory(keyName, b)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 && old != nil {
+		initial, err := newKeyVersion("initial", old)
+		if err != nil {
+			return nil, err
+		}
+		initial.Version = 1
+		history = append(history, initial)
+	}
+
+	version, err := newKeyVersion(entry.Op, value)
+	if err != nil {
+		return nil, err
+	}
+	version.RolledBackFrom = entry.RolledBackFrom
+	version.ExpiresAt = entry.ExpiresAt
+	version.Version = 1
+	if len(history) > 0 {
+		version.Version = history[len(history)-1].Version + 1
+	}
+	if principal := RequestPrincipal(r); principal != nil {
+		version.Author = principal.String()
+	}
+	history = append(history, version)
+	if len(history) > depth {
+		history = history[len(history)-depth:]
+	}
+
+	entries := make([]string, len(history))
+	for idx, version := range history {
+		jsonblob, err := json.Marshal(version)
+		if err != nil {
+			return nil, err
+		}
+		entries[idx] = string(jsonblob)
+	}
+	return entries, nil
+}
+
+/*
+ * Store histories built by nextKeyHistory, inside the commit of the change
+ */
+func (c *ConfMgr) storeKeyHistory(histories map[string][]string, w backend.ConfigWriter) error {
+	for keyName, entries := range histories {
+		if entries == nil {
+			continue
+		}
+		if err := w.SetList(c.keyHistoryKey(keyName), entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Find a version in the history of a key
+ */
+func (c *ConfMgr) FindKeyVersion(keyName string, version int, b backend.ConfigBackend) (KeyVersion, error) {
+	history, err := c.KeyHistory(keyName, b)
+	if err != nil {
+		return KeyVersion{}, err
+	}
+
+	for _, entry := range history {
+		if entry.Version == version {
+			return entry, nil
+		}
+	}
+
+	return KeyVersion{}, KeyHistoryError{fmt.Sprintf("Key %s has no version %d", keyName, version)}
+}
+
+/*
+ * Write the value a key had in a version, deleting it if the version was
+ * a delete
+ */
+func (c *ConfMgr) RestoreKeyVersion(keyName string, entry KeyVersion, b backend.ConfigWriter) error {
+	if entry.Deleted {
+		return b.DeleteKey(keyName)
+	}
+	jsonblob, err := json.Marshal(GenericRequest{entry.Type, entry.Data})
+	if err != nil {
+		return err
+	}
+	return c.SaveKeyFromJSON(keyName, jsonblob, b)
+}
+
+func (c *ConfMgr) HandleAdminKeyHistory(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	keyName := reqVars["keyName"]
+	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
+		keyName = c.Config.Main.KeyPrefix + keyName
+	}
+	if !c.checkAccess(w, r, VerbRead, keyName) {
+		return
+	}
+
+	history, err := c.KeyHistory(keyName, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	SendResponse(w, r, KeyHistoryResponse{"history", keyName, history})
+}
+
+func (c *ConfMgr) HandleAdminKeyRollback(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	reqVars := mux.Vars(r)
+	keyName := reqVars["keyName"]
+	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
+		keyName = c.Config.Main.KeyPrefix + keyName
+	}
+	if !c.checkAccess(w, r, VerbWrite, keyName) {
+		return
+	}
+
+	version, err := strconv.Atoi(reqVars["version"])
+	if err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid version: %s", err))
+		return
+	}
+
+	entry, err := c.FindKeyVersion(keyName, version, b)
+	if _, ok := err.(KeyHistoryError); ok {
+		SendErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	old, value, _, ok := c.writeKey(w, r, keyName, KeyVersion{Op: AuditRollback, RolledBackFrom: version}, nil, func(tx backend.ConfigWriter) error {
+		return c.RestoreKeyVersion(keyName, entry, tx)
+	}, b)
+	if !ok {
+		return
+	}
+	log.Infof("Rolled back %s to version %d", keyName, entry.Version)
+
+	c.RecordChange(r, b, AuditRollback, keyName, "", old, value)
+
+	history, err := c.KeyHistory(keyName, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	c.setETag(w, keyName, b)
+	SendResponse(w, r, KeyHistoryResponse{"history", keyName, history})
+}
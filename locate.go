@@ -0,0 +1,141 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"sort"
+	"strings"
+)
+
+type KeyLocation struct {
+	Key       string            `json:"key"`
+	Name      string            `json:"name"`
+	Hierarchy string            `json:"hierarchy"`
+	Level     string            `json:"level"`
+	Tokens    map[string]string `json:"tokens"`
+}
+
+type LocatedKey struct {
+	KeyLocation
+	Value KeyResponse `json:"value"`
+}
+
+type LocateResponse struct {
+	Type string       `json:"type"`
+	Data []LocatedKey `json:"data"`
+}
+
+func (r LocateResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, entry := range r.Data {
+		level := entry.Level
+		if level == "" {
+			level = "unknown level"
+		}
+		lines[idx] = fmt.Sprintf("%s (%s)", entry.Key, level)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r LocateResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * A key name that cannot be located
+ */
+type LocateError struct {
+	Message string
+}
+
+func (e LocateError) Error() string {
+	return e.Message
+}
+
+/*
+ * Find every concrete key defining keyName on any hierarchy level
+ */
+func (c *ConfMgr) LocateKey(keyName string, b backend.ConfigBackend) (LocateResponse, error) {
+	var resp LocateResponse
+	resp.Type = "list"
+	resp.Data = make([]LocatedKey, 0)
+
+	// keyName becomes part of a glob
+	if idx := strings.IndexAny(keyName, "*?[]\\"); idx >= 0 {
+		return resp, LocateError{fmt.Sprintf("Key name %s must not contain '%c'", keyName, keyName[idx])}
+	}
+
+	keys, err := b.ListKeys(fmt.Sprintf("%s*:%s", c.Config.Main.KeyPrefix, keyName))
+	if err != nil {
+		return resp, err
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, err := c.ReadKey(key, b)
+		if err != nil {
+			return resp, err
+		}
+		if value == nil {
+			// Deleted since we listed it
+			continue
+		}
+
+		path := strings.TrimSuffix(strings.TrimPrefix(key, c.Config.Main.KeyPrefix), ":"+keyName)
+		location, _ := c.MatchLevel(path)
+		location.Key = key
+		location.Name = keyName
+
+		resp.Data = append(resp.Data, LocatedKey{location, value})
+	}
+
+	return resp, err
+}
+
+/*
+ * Map a concrete key back onto the hierarchy level that produced it.
+ * The most specific level (shortest remaining key name) wins.
+ */
+func (c *ConfMgr) ParseKey(keyName string) (KeyLocation, bool) {
+	location := KeyLocation{Key: keyName}
+
+	if !strings.HasPrefix(keyName, c.Config.Main.KeyPrefix) {
+		return location, false
+	}
+	path := strings.TrimPrefix(keyName, c.Config.Main.KeyPrefix)
+
+	for idx := strings.LastIndex(path, ":"); idx > 0; idx = strings.LastIndex(path[:idx], ":") {
+		if match, ok := c.MatchLevel(path[:idx]); ok {
+			match.Key = keyName
+			match.Name = path[idx+1:]
+			return match, true
+		}
+	}
+
+	return location, false
+}
+
+/*
+ * Match an expanded path like "sites:lon" against the levels of all
+ * hierarchies (default first) and return the first matching level
+ * along with the token values used
+ */
+func (c *ConfMgr) MatchLevel(path string) (KeyLocation, bool) {
+	for _, name := range c.HierarchyNames() {
+		if level, tokens, ok := c.GetHierarchies()[name].MatchLevel(path); ok {
+			return KeyLocation{
+				Hierarchy: name,
+				Level:     level,
+				Tokens:    tokens,
+			}, true
+		}
+	}
+
+	return KeyLocation{}, false
+}
@@ -1,11 +1,38 @@
 package confmgr
 
 import (
+	"fmt"
+	"github.com/gorilla/context"
 	"net/http"
 )
 
-func (c *ConfMgr) ClientHandler(inner http.Handler, name string) http.HandlerFunc {
+func (c *ConfMgr) ClientHandler(inner HandlerFuncBackend, name string) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		inner.ServeHTTP(w, r)
+		// Keep the config stable for the whole request without holding up reloads
+		view := c.view()
+
+		if view.Policy != nil {
+			if ok, reason := view.Policy.Permits(r, name); !ok {
+				SendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Access denied to namespace %s: %s", view.Namespace, reason))
+				return
+			}
+		}
+		if view.Config.Main.RequireReview && reviewedRoutes[name] {
+			SendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Access denied to namespace %s: changes must be submitted to /admin/changes for review", view.Namespace))
+			return
+		}
+		if view.Auth != nil {
+			principal, err := view.Auth.Check(r, name, view.ClientIdentity(r))
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Basic realm="confmgr"`)
+				SendErrorResponse(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err))
+				return
+			}
+			if principal != nil {
+				context.Set(r, ReqPrincipal, principal)
+				defer context.Clear(r)
+			}
+		}
+		view.handlerDecorate(inner).ServeHTTP(w, r)
 	})
 }
@@ -76,6 +76,22 @@ func (c *ConfMgr) LookupHash(keyName string, scope map[string]string, b backend.
 	return resp, err
 }
 
+/*
+ * Resolve a key by type name (string, hash or list)
+ */
+func (c *ConfMgr) LookupKey(keyName string, keyType string, scope map[string]string, b backend.ConfigBackend) (KeyResponse, error) {
+	switch keyType {
+	case TypeToString(vars.TYPE_STRING):
+		return c.LookupString(keyName, scope, b)
+	case TypeToString(vars.TYPE_HASH):
+		return c.LookupHash(keyName, scope, b)
+	case TypeToString(vars.TYPE_LIST):
+		return c.LookupList(keyName, scope, b)
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", keyType)
+	}
+}
+
 func (c *ConfMgr) LookupStringByString(searchString string, scope map[string]string, b backend.ConfigBackend) (string, error) {
 	// ${key}
 	string_vars := regexp.MustCompile("\\${(\\S+?)}")
@@ -264,7 +280,7 @@ func (c *ConfMgr) SubstituteValues(input string, scope map[string]string, b back
 func (c *ConfMgr) ExistingKeys(key string, wantedType int, scope map[string]string, b backend.ConfigBackend) []string {
 	foundKeys := make([]string, 0)
 
-	for _, path := range c.SearchPaths(scope) {
+	for _, path := range c.SearchPathsFor(key, scope) {
 		keyName := fmt.Sprintf("%s%s:%s", c.Config.Main.KeyPrefix, path, key)
 		log.Debugf("Searching key: '%s'", keyName)
 		keytype, _ := b.GetType(keyName)
@@ -283,44 +299,14 @@ func (c *ConfMgr) ExistingKeys(key string, wantedType int, scope map[string]stri
  * will consume it
  **/
 func (c *ConfMgr) SearchPaths(reqscope map[string]string) []string {
-	log.Debugf("SearchPaths scope: %q\n", reqscope)
-
-	newKeyPaths := make([]string, 0)
-
-	// Find all tokens in the configured paths
-	token_re := regexp.MustCompile("%{(\\S+?)}")
-
-PathsLoop:
-	for _, path := range c.Config.Main.KeyPaths {
-		log.Debugf("Config key path: '%s'", path)
-		matches := token_re.FindAllStringSubmatch(path, -1)
-		if len(matches) > 0 {
-			for _, match := range matches {
-				token_str := match[0]
-				token_name := match[1]
-
-				// Check if this token is defined in the request scope
-				if val, ok := reqscope[token_name]; ok {
-					log.Debugf("   Token '%s' is defined in the request as '%s'", token_name, val)
-					path = strings.Replace(path, token_str, val, 1)
-					log.Debugf("    Modified path: %s", path)
-				} else {
-					// Cannot replace this token, ignore this path completely
-					log.Debugf("  Ignoring path %s because token %s is not set", path, token_name)
-					continue PathsLoop
-				}
-			}
-		}
+	return c.SearchPathsFor("", reqscope)
+}
 
-		// Poor man's prepend. Make new slice with current value at the beginning
-		// Then iterate over existing entries and append them one by one
-		var tmpslice = make([]string, 1)
-		tmpslice[0] = path
-		for _, entry := range newKeyPaths {
-			tmpslice = append(tmpslice, entry)
-		}
-		newKeyPaths = tmpslice
-	}
+/*
+ * Search paths for a specific key, using the hierarchy selected for it
+ */
+func (c *ConfMgr) SearchPathsFor(keyName string, reqscope map[string]string) []string {
+	log.Debugf("SearchPaths scope: %q\n", reqscope)
 
-	return newKeyPaths
+	return c.HierarchyFor(keyName, reqscope).SearchPaths(reqscope)
 }
@@ -11,6 +11,9 @@ import (
 func (c *ConfMgr) HandleLookupHash(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
+	if !c.checkAccess(w, r, VerbLookup, c.lookupKey(keyName)) {
+		return
+	}
 
 	//log.Printf("Requesting hash lookup: %s", keyName)
 
@@ -26,12 +29,15 @@ func (c *ConfMgr) HandleLookupHash(w http.ResponseWriter, r *http.Request, b bac
 		fmt.Fprintf(w, "Key %s not found\n", keyName)
 		return
 	}
-	SendResponse(w, r, resp)
+	SendCachedResponse(w, r, resp)
 }
 
 func (c *ConfMgr) HandleLookupString(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
+	if !c.checkAccess(w, r, VerbLookup, c.lookupKey(keyName)) {
+		return
+	}
 
 	//log.Printf("Requesting string lookup: %s", keyName)
 
@@ -48,12 +54,15 @@ func (c *ConfMgr) HandleLookupString(w http.ResponseWriter, r *http.Request, b b
 		return
 	}
 
-	SendResponse(w, r, resp)
+	SendCachedResponse(w, r, resp)
 }
 
 func (c *ConfMgr) HandleLookupList(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
+	if !c.checkAccess(w, r, VerbLookup, c.lookupKey(keyName)) {
+		return
+	}
 
 	//log.Printf("Requesting list lookup: %s", keyName)
 
@@ -70,13 +79,16 @@ func (c *ConfMgr) HandleLookupList(w http.ResponseWriter, r *http.Request, b bac
 		return
 	}
 
-	SendResponse(w, r, resp)
+	SendCachedResponse(w, r, resp)
 }
 
 func (c *ConfMgr) HandleLookupHashField(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
 	fieldName := reqVars["fieldName"]
+	if !c.checkAccess(w, r, VerbLookup, c.lookupKey(keyName)) {
+		return
+	}
 
 	//log.Printf("Requesting hash field lookup: %s/%s", keyName, fieldName)
 
@@ -93,13 +105,16 @@ func (c *ConfMgr) HandleLookupHashField(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	SendResponse(w, r, resp)
+	SendCachedResponse(w, r, resp)
 }
 
 func (c *ConfMgr) HandleLookupListIndex(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
 	reqVars := mux.Vars(r)
 	keyName := reqVars["keyName"]
 	listIndex, _ := strconv.ParseInt(reqVars["listIndex"], 10, 64)
+	if !c.checkAccess(w, r, VerbLookup, c.lookupKey(keyName)) {
+		return
+	}
 
 	//log.Printf("Requesting list index lookup: %s[%d]", keyName, listIndex)
 
@@ -116,5 +131,5 @@ func (c *ConfMgr) HandleLookupListIndex(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
-	SendResponse(w, r, resp)
+	SendCachedResponse(w, r, resp)
 }
@@ -0,0 +1,194 @@
+package confmgr
+
+import (
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/moensch/confmgr/config"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const DefaultNamespace = "default"
+
+/*
+ * Access policy of a namespace
+ */
+type NamespacePolicy struct {
+	ReadOnly bool
+	Allow    []*net.IPNet
+}
+
+/*
+ * Routes that modify data, rejected in read-only namespaces
+ */
+var writeRoutes = map[string]bool{
+	"HandleAdminKeyStore":        true,
+	"HandleAdminKeyDelete":       true,
+	"HandleAdminListAppend":      true,
+	"HandleAdminSetHashField":    true,
+	"HandleAdminStoreNode":       true,
+	"HandleAdminDeleteNode":      true,
+	"HandleAdminStoreHierarchy":  true,
+	"HandleAdminRevertHierarchy": true,
+	"HandleAdminKeyRollback":     true,
+	"HandleAdminTxn":             true,
+	"HandleAdminCreateChange":    true,
+	"HandleAdminApproveChange":   true,
+	"HandleAdminRejectChange":    true,
+	"HandleAdminCreateSchedule":  true,
+	"HandleAdminCancelSchedule":  true,
+}
+
+/*
+ * Routes changing the node registry, which is shared by all namespaces.
+ * They are only served by the default namespace.
+ */
+var registryRoutes = map[string]bool{
+	"HandleAdminStoreNode":  true,
+	"HandleAdminDeleteNode": true,
+}
+
+func NewNamespacePolicy(cfg config.NamespaceConfig) (*NamespacePolicy, error) {
+	policy := &NamespacePolicy{
+		ReadOnly: cfg.ReadOnly,
+		Allow:    make([]*net.IPNet, 0),
+	}
+
+	for _, cidr := range cfg.Allow {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return policy, err
+		}
+		policy.Allow = append(policy.Allow, network)
+	}
+
+	return policy, nil
+}
+
+/*
+ * Check whether a request for the named route is permitted
+ */
+func (p *NamespacePolicy) Permits(r *http.Request, routeName string) (bool, string) {
+	if p.ReadOnly && writeRoutes[routeName] {
+		return false, "namespace is read-only"
+	}
+	if registryRoutes[routeName] {
+		return false, "the node registry can only be changed in the default namespace"
+	}
+
+	if len(p.Allow) == 0 {
+		return true, ""
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, network := range p.Allow {
+		if ip != nil && network.Contains(ip) {
+			return true, ""
+		}
+	}
+
+	return false, fmt.Sprintf("client %s is not allowed", host)
+}
+
+/*
+ * Build one ConfMgr per configured namespace. Each shares the global
+ * settings but has its own key prefix, hierarchies and access policy.
+ */
+func (c *ConfMgr) NewNamespaces(cfg config.ConfigMgrConfig) (map[string]*ConfMgr, error) {
+	namespaces := make(map[string]*ConfMgr)
+	prefixes := map[string]string{DefaultNamespace: cfg.Main.KeyPrefix}
+
+	for name, nsCfg := range cfg.Namespaces {
+		if name == DefaultNamespace {
+			return namespaces, fmt.Errorf("Namespace name '%s' is reserved", name)
+		}
+		if nsCfg.KeyPrefix == "" {
+			return namespaces, fmt.Errorf("Namespace %s: key_prefix must be set", name)
+		}
+		// Would allow writing the registry, history and audit data as keys
+		if strings.HasPrefix(nsCfg.KeyPrefix, cfg.Main.MetaPrefix) || strings.HasPrefix(cfg.Main.MetaPrefix, nsCfg.KeyPrefix) {
+			return namespaces, fmt.Errorf("Namespace %s: key_prefix '%s' overlaps with meta_prefix '%s'", name, nsCfg.KeyPrefix, cfg.Main.MetaPrefix)
+		}
+		prefixes[name] = nsCfg.KeyPrefix
+
+		childCfg := cfg
+		childCfg.Namespaces = nil
+		childCfg.Main.KeyPrefix = nsCfg.KeyPrefix
+		childCfg.Main.KeyPaths = nsCfg.KeyPaths
+		childCfg.Main.Hierarchies = nsCfg.Hierarchies
+		childCfg.Main.HierarchyRules = nsCfg.HierarchyRules
+		childCfg.Main.RequireReview = nsCfg.RequireReview
+		if nsCfg.DefaultHierarchy != "" {
+			childCfg.Main.DefaultHierarchy = nsCfg.DefaultHierarchy
+		}
+		if nsCfg.Derived != nil {
+			childCfg.Main.Derived = nsCfg.Derived
+		}
+
+		policy, err := NewNamespacePolicy(nsCfg)
+		if err != nil {
+			return namespaces, fmt.Errorf("Namespace %s: %s", name, err)
+		}
+
+		ns := &ConfMgr{
+			Namespace: name,
+			Policy:    policy,
+		}
+		if err := ns.ApplyConfig(childCfg); err != nil {
+			return namespaces, fmt.Errorf("Namespace %s: %s", name, err)
+		}
+		ns.Router = ns.NewRouter()
+		namespaces[name] = ns
+	}
+
+	// Overlapping prefixes would let one namespace address another's keys
+	names := make([]string, 0, len(prefixes))
+	for name := range prefixes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, a := range names {
+		for _, b := range names {
+			if a != b && strings.HasPrefix(prefixes[b], prefixes[a]) {
+				return namespaces, fmt.Errorf("Key prefix of namespace %s ('%s') overlaps with namespace %s ('%s')", b, prefixes[b], a, prefixes[a])
+			}
+		}
+	}
+
+	return namespaces, nil
+}
+
+/*
+ * Dispatch /ns/{namespace}/... to the namespace's own router
+ */
+func (c *ConfMgr) HandleNamespace(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["namespace"]
+
+	if name == DefaultNamespace {
+		http.StripPrefix("/ns/"+name, c.Router).ServeHTTP(w, r)
+		return
+	}
+
+	c.reloadLock.RLock()
+	ns, ok := c.Namespaces[name]
+	c.reloadLock.RUnlock()
+	if !ok {
+		SendErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Namespace %s not found", name))
+		return
+	}
+
+	http.StripPrefix("/ns/"+name, ns.Router).ServeHTTP(w, r)
+}
@@ -0,0 +1,224 @@
+package confmgr
+
+import (
+	"fmt"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const (
+	VerbRead   = "read"
+	VerbLookup = "lookup"
+	VerbWrite  = "write"
+	VerbDelete = "delete"
+	VerbList   = "list"
+)
+
+// Identity matched by rules for requests without credentials
+const AnonymousIdentity = "anonymous"
+
+var rbacVerbs = map[string]bool{
+	VerbRead:   true,
+	VerbLookup: true,
+	VerbWrite:  true,
+	VerbDelete: true,
+	VerbList:   true,
+}
+
+type RBACRule struct {
+	Name       string
+	Identities []string
+	Verbs      map[string]bool
+	Keys       []string
+	Allow      bool
+}
+
+/*
+ * Ordered access rules, the first rule matching identity, verb and key
+ * decides. Anything not matched by a rule is denied.
+ */
+type RBACPolicy struct {
+	Rules []RBACRule
+}
+
+/*
+ * A single grant carried by a token, written as verb:keyglob,
+ * e.g. write:cfg:databases*
+ */
+type Permission struct {
+	Verb string `json:"verb"`
+	Keys string `json:"keys"`
+}
+
+func ParsePermission(permission string) (Permission, error) {
+	parts := strings.SplitN(permission, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Permission{}, fmt.Errorf("invalid permission '%s', expected verb:keys", permission)
+	}
+	if parts[0] != "*" && !rbacVerbs[parts[0]] {
+		return Permission{}, fmt.Errorf("invalid permission '%s': unknown verb '%s'", permission, parts[0])
+	}
+	if _, err := path.Match(parts[1], ""); err != nil {
+		return Permission{}, fmt.Errorf("invalid permission '%s': %s", permission, err)
+	}
+	return Permission{parts[0], parts[1]}, nil
+}
+
+/*
+ * Check a verb and key against the permissions a token carries
+ */
+func (p *Principal) Permits(verb string, key string) error {
+	for _, permission := range p.Permissions {
+		if permission.Verb != verb && permission.Verb != "*" {
+			continue
+		}
+		if matched, _ := path.Match(permission.Keys, key); matched {
+			return nil
+		}
+	}
+	return AccessError{fmt.Sprintf("%s %s on %s not permitted by token", p, verb, key)}
+}
+
+type AccessError struct {
+	Message string
+}
+
+func (e AccessError) Error() string {
+	return e.Message
+}
+
+/*
+ * Compile the RBAC rules, nil if RBAC is disabled
+ */
+func NewRBACPolicy(cfg config.RBACConfig) (*RBACPolicy, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+
+	policy := &RBACPolicy{Rules: make([]RBACRule, 0, len(cfg.Rules))}
+	for idx, ruleCfg := range cfg.Rules {
+		rule := RBACRule{
+			Name:       ruleCfg.Name,
+			Identities: ruleCfg.Identities,
+			Verbs:      make(map[string]bool),
+			Keys:       ruleCfg.Keys,
+		}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rbac.rules[%d]", idx)
+		}
+
+		switch ruleCfg.Effect {
+		case "allow", "":
+			rule.Allow = true
+		case "deny":
+			rule.Allow = false
+		default:
+			return policy, fmt.Errorf("%s: invalid effect '%s'", rule.Name, ruleCfg.Effect)
+		}
+
+		for _, verb := range ruleCfg.Verbs {
+			if verb != "*" && !rbacVerbs[verb] {
+				return policy, fmt.Errorf("%s: unknown verb '%s'", rule.Name, verb)
+			}
+			rule.Verbs[verb] = true
+		}
+		for _, pattern := range append(append([]string{}, rule.Identities...), rule.Keys...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return policy, fmt.Errorf("%s: invalid pattern '%s': %s", rule.Name, pattern, err)
+			}
+		}
+
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return policy, nil
+}
+
+func matchAny(patterns []string, values ...string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, _ := path.Match(pattern, value); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * Decide whether an identity may apply a verb to a key
+ */
+func (p *RBACPolicy) Check(principal *Principal, verb string, key string) error {
+	identities := []string{AnonymousIdentity}
+	if principal != nil {
+		identities = []string{principal.Name, principal.String()}
+	}
+
+	for _, rule := range p.Rules {
+		if !matchAny(rule.Identities, identities...) {
+			continue
+		}
+		if !rule.Verbs[verb] && !rule.Verbs["*"] {
+			continue
+		}
+		if !matchAny(rule.Keys, key) {
+			continue
+		}
+		if rule.Allow {
+			return nil
+		}
+		return AccessError{fmt.Sprintf("%s %s on %s denied by rule %s", identities[len(identities)-1], verb, key, rule.Name)}
+	}
+
+	return AccessError{fmt.Sprintf("%s %s on %s not allowed by any rule", identities[len(identities)-1], verb, key)}
+}
+
+/*
+ * Check the requesting client's access to a key. Permissions carried by
+ * a token are used instead of the RBAC rules.
+ */
+func (c *ConfMgr) Authorize(r *http.Request, verb string, key string) error {
+	principal := RequestPrincipal(r)
+	if principal != nil && principal.Permissions != nil {
+		return principal.Permits(verb, key)
+	}
+	if c.RBAC == nil {
+		return nil
+	}
+	return c.RBAC.Check(principal, verb, key)
+}
+
+/*
+ * Key name lookups of a logical key are authorized as, with the key prefix
+ * like the keys of read and write checks
+ */
+func (c *ConfMgr) lookupKey(keyName string) string {
+	return c.Config.Main.KeyPrefix + keyName
+}
+
+/*
+ * Authorize a request, replying 403 if it is denied
+ */
+func (c *ConfMgr) checkAccess(w http.ResponseWriter, r *http.Request, verb string, key string) bool {
+	if err := c.Authorize(r, verb, key); err != nil {
+		SendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Access denied: %s", err))
+		return false
+	}
+	return true
+}
+
+/*
+ * Drop the keys the requesting client may not apply verb to. Keys are
+ * checked with prefix prepended.
+ */
+func (c *ConfMgr) filterKeys(r *http.Request, verb string, prefix string, keys []string) []string {
+	allowed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if c.Authorize(r, verb, prefix+key) == nil {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,102 @@
+package confmgr
+
+import (
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"sort"
+	"strings"
+)
+
+type FactsRequest struct {
+	Data map[string]string `json:"data"`
+}
+
+func (c *ConfMgr) registryKey(identity string) string {
+	return fmt.Sprintf("%sregistry:%s", c.Config.Main.MetaPrefix, strings.ToLower(identity))
+}
+
+/*
+ * List the identities of all registered nodes
+ */
+func (c *ConfMgr) ListNodes(b backend.ConfigBackend) ([]string, error) {
+	prefix := c.registryKey("")
+	keys, err := b.ListKeys(prefix + "*")
+	if err != nil {
+		return keys, err
+	}
+
+	nodes := make([]string, len(keys))
+	for idx, key := range keys {
+		nodes[idx] = strings.TrimPrefix(key, prefix)
+	}
+	sort.Strings(nodes)
+
+	return nodes, nil
+}
+
+func (c *ConfMgr) GetFacts(identity string, b backend.ConfigBackend) (map[string]string, error) {
+	return b.GetHash(c.registryKey(identity))
+}
+
+func (c *ConfMgr) SetFacts(identity string, facts map[string]string, b backend.ConfigBackend) error {
+	normalized, err := c.ScopeValidator.Normalize(facts)
+	if err != nil {
+		return err
+	}
+	return b.SetHash(c.registryKey(identity), normalized)
+}
+
+func (c *ConfMgr) DeleteFacts(identity string, b backend.ConfigBackend) error {
+	return b.DeleteKey(c.registryKey(identity))
+}
+
+/*
+ * Fill in a request scope from the registry if it carries a known node
+ * identity. Registered facts take precedence over client supplied ones.
+ */
+func (c *ConfMgr) ExpandScope(scope map[string]string, b backend.ConfigBackend) (map[string]string, error) {
+	identity, ok := scope[c.Config.Main.RegistryToken]
+	if !ok || identity == "" {
+		return scope, nil
+	}
+
+	facts, err := c.GetFacts(identity, b)
+	if err != nil {
+		return scope, err
+	}
+	if len(facts) == 0 {
+		return scope, nil
+	}
+
+	expanded := make(map[string]string)
+	for token, value := range scope {
+		expanded[token] = value
+	}
+	for token, value := range facts {
+		expanded[token] = value
+	}
+
+	return expanded, nil
+}
+
+/*
+ * Return the full scope of every registered node
+ */
+func (c *ConfMgr) RegisteredScopes(b backend.ConfigBackend) ([]map[string]string, error) {
+	scopes := make([]map[string]string, 0)
+
+	nodes, err := c.ListNodes(b)
+	if err != nil {
+		return scopes, err
+	}
+
+	for _, node := range nodes {
+		scope, err := c.ExpandScope(map[string]string{c.Config.Main.RegistryToken: node}, b)
+		if err != nil {
+			return scopes, err
+		}
+		scopes = append(scopes, scope)
+	}
+
+	return scopes, nil
+}
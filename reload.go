@@ -0,0 +1,214 @@
+package confmgr
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/backends/redis"
+	"github.com/moensch/confmgr/config"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+/*
+ * Re-read the config file and environment and apply them. In-flight
+ * requests finish with the settings they started with, new requests get
+ * the new ones. If the new config is invalid the current one stays active.
+ */
+func (c *ConfMgr) Reload() error {
+	cfg, err := c.LoadConfig()
+	if err != nil {
+		return err
+	}
+
+	if err := c.applyReload(cfg); err != nil {
+		return err
+	}
+	log.Info("Reloaded config")
+
+	// An interval changed from 0 starts its loop
+	c.tasks.lock.Lock()
+	if c.tasks.started {
+		c.startTasks()
+	}
+	c.tasks.lock.Unlock()
+
+	return nil
+}
+
+func (c *ConfMgr) applyReload(cfg config.ConfigMgrConfig) error {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+
+	if cfg.Listen != c.Config.Listen {
+		log.Warn("Listen settings changed, restart to apply")
+	}
+
+	// Stored hierarchies are loaded through the new backend, if it changed
+	oldFactory := BackendFactory
+	backendChanged := !reflect.DeepEqual(cfg.Backends, c.Config.Backends)
+	if backendChanged {
+		factoryLock.Lock()
+		defer factoryLock.Unlock()
+		BackendFactory = redis.NewFactory(cfg.Backends["redis"])
+	}
+
+	if err := c.ApplyConfig(cfg); err != nil {
+		if backendChanged {
+			BackendFactory.Close()
+			BackendFactory = oldFactory
+		}
+		return err
+	}
+
+	if backendChanged && oldFactory != nil {
+		// Requests that started before the reload may still use it
+		users := factoryUsers
+		factoryUsers = &sync.WaitGroup{}
+		go func() {
+			users.Wait()
+			oldFactory.Close()
+		}()
+	}
+	return nil
+}
+
+/*
+ * Copy of the settings to serve one request with, taken under the reload
+ * lock so the request sees either the old or the new config throughout.
+ * Hierarchies stay shared with the live server.
+ */
+func (c *ConfMgr) view() *ConfMgr {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+
+	return &ConfMgr{
+		Config:         c.Config,
+		Backend:        c.Backend,
+		Router:         c.Router,
+		RequestScope:   c.RequestScope,
+		ScopeChain:     c.ScopeChain,
+		ScopeValidator: c.ScopeValidator,
+		Namespace:      c.Namespace,
+		Namespaces:     c.Namespaces,
+		Policy:         c.Policy,
+		ConfigPath:     c.ConfigPath,
+		Overrides:      c.Overrides,
+		TLSConfig:      c.TLSConfig,
+		Auth:           c.Auth,
+		RBAC:           c.RBAC,
+		Audit:          c.Audit,
+		live:           c.origin(),
+	}
+}
+
+/*
+ * The server itself, for a view the server it was taken from
+ */
+func (c *ConfMgr) origin() *ConfMgr {
+	if c.live != nil {
+		return c.live
+	}
+	return c
+}
+
+/*
+ * The config watcher and scheduler loops, each running at most once
+ */
+type backgroundTasks struct {
+	lock       sync.Mutex
+	started    bool
+	watching   bool
+	scheduling bool
+}
+
+/*
+ * Start the config watcher and scheduler if their interval is set. After
+ * this, every reload starts a loop whose interval changed from 0.
+ */
+func (c *ConfMgr) StartBackgroundTasks() {
+	c.tasks.lock.Lock()
+	defer c.tasks.lock.Unlock()
+
+	c.tasks.started = true
+	c.startTasks()
+}
+
+func (c *ConfMgr) startTasks() {
+	c.reloadLock.RLock()
+	watch := c.ConfigPath != "" && c.Config.Main.WatchInterval > 0
+	schedule := c.Config.Main.ScheduleInterval > 0
+	c.reloadLock.RUnlock()
+
+	if watch && !c.tasks.watching {
+		c.tasks.watching = true
+		go c.WatchConfig()
+	}
+	if schedule && !c.tasks.scheduling {
+		c.tasks.scheduling = true
+		go c.RunScheduler()
+	}
+}
+
+/*
+ * Whether the config watcher and the scheduler are running
+ */
+func (c *ConfMgr) BackgroundTasks() (bool, bool) {
+	c.tasks.lock.Lock()
+	defer c.tasks.lock.Unlock()
+	return c.tasks.watching, c.tasks.scheduling
+}
+
+/*
+ * Current interval of a loop. A loop seeing 0 must return; it is marked
+ * stopped under the task lock, so a reload either leaves it running with
+ * the new interval or starts a new one.
+ */
+func (c *ConfMgr) taskInterval(running *bool, interval func(config.MainConfig) int) int {
+	c.tasks.lock.Lock()
+	defer c.tasks.lock.Unlock()
+
+	c.reloadLock.RLock()
+	value := interval(c.Config.Main)
+	c.reloadLock.RUnlock()
+	if value <= 0 {
+		*running = false
+	}
+	return value
+}
+
+/*
+ * Reload whenever the config file's modification time changes. Returns
+ * once watch_interval is set to 0.
+ */
+func (c *ConfMgr) WatchConfig() {
+	var lastMod time.Time
+	if info, err := os.Stat(c.ConfigPath); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	for {
+		interval := c.taskInterval(&c.tasks.watching, func(main config.MainConfig) int {
+			return main.WatchInterval
+		})
+		if interval <= 0 {
+			log.Infof("Stopped watching %s", c.ConfigPath)
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		info, err := os.Stat(c.ConfigPath)
+		if err != nil {
+			log.Warnf("Cannot check config file: %s", err)
+			continue
+		}
+		if info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		if err := c.Reload(); err != nil {
+			log.Errorf("Cannot reload config, keeping current one: %s", err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package confmgr
 
 import (
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
@@ -12,9 +13,7 @@ import (
 func (c *ConfMgr) NewRouter() *mux.Router {
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range c.RouteDefinitions() {
-		var handler http.Handler
-		handler = route.HandlerFunc
-		handler = c.ClientHandler(handler, route.Name)
+		handler := c.ClientHandler(route.HandlerFunc, route.Name)
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
@@ -22,28 +21,73 @@ func (c *ConfMgr) NewRouter() *mux.Router {
 			Handler(handler)
 	}
 
+	if c.Namespace == DefaultNamespace {
+		router.PathPrefix("/ns/{namespace}/").Handler(http.HandlerFunc(c.HandleNamespace))
+	}
+
 	return router
 }
 
 const ReqScope = 0
+const ReqPrincipal = 1
 
-type HandlerFuncBackend func(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend)
+/*
+ * A route handler, called on the settings the request is served with
+ */
+type HandlerFuncBackend func(c *ConfMgr, w http.ResponseWriter, r *http.Request, b backend.ConfigBackend)
 
-func handlerDecorate(f HandlerFuncBackend) http.HandlerFunc {
+func (c *ConfMgr) handlerDecorate(f HandlerFuncBackend) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		scope := ScopeFromHeaders(r.Header)
+		b, done := newBackend()
+		defer done()
+
+		scope, err := c.ScopeChain.Scope(r)
+		if err == nil {
+			scope, err = c.ScopeValidator.Normalize(scope)
+		}
+		if err != nil {
+			SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid scope: %s", err))
+			return
+		}
+		// Client supplied tokens < registry facts < tokens pinned by a JWT
+		var pinned map[string]string
+		if principal := RequestPrincipal(r); principal != nil && principal.Scope != nil {
+			scope, err = c.TrustedScope(scope, principal.Scope)
+			if err == nil {
+				pinned, err = c.ScopeValidator.Normalize(principal.Scope)
+			}
+			if err != nil {
+				SendErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Invalid scope in token: %s", err))
+				return
+			}
+		}
+		scope, err = c.ExpandScope(scope, b)
+		if err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+			return
+		}
+		for token, value := range pinned {
+			scope[token] = value
+		}
+		if name := RequestedHierarchy(r); name != "" {
+			if _, ok := c.GetHierarchies()[name]; !ok {
+				SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Unknown hierarchy: %s", name))
+				return
+			}
+			scope[HierarchyScopeKey] = name
+		}
 		context.Set(r, ReqScope, scope)
 
-		b := BackendFactory.NewBackend()
-		defer b.Close()
-		f(w, r, b)
+		f(c, w, r, b)
 		log.WithFields(log.Fields{
-			"method": r.Method,
-			"uri":    r.RequestURI,
-			"client": r.RemoteAddr,
-			"time":   time.Since(start),
-			"scope":  scope,
+			"method":   r.Method,
+			"uri":      r.RequestURI,
+			"client":   r.RemoteAddr,
+			"identity": c.ClientIdentity(r),
+			"user":     RequestPrincipal(r),
+			"time":     time.Since(start),
+			"scope":    scope,
 		}).Info("Request")
 		context.Clear(r)
 	})
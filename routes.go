@@ -1,14 +1,10 @@
 package confmgr
 
-import (
-	"net/http"
-)
-
 type Route struct {
 	Name        string
 	Method      string
 	Pattern     string
-	HandlerFunc http.HandlerFunc
+	HandlerFunc HandlerFuncBackend
 }
 
 type Routes []Route
@@ -19,103 +15,313 @@ func (c *ConfMgr) RouteDefinitions() Routes {
 			"Index",
 			"GET",
 			"/",
-			handlerDecorate(c.Index),
+			(*ConfMgr).Index,
 		},
 		Route{
 			"HandleAdminListKeys",
 			"GET",
 			"/admin/keys",
-			handlerDecorate(c.HandleAdminListKeys),
+			(*ConfMgr).HandleAdminListKeys,
 		},
 		Route{
 			"HandleAdminListKeysFiltered",
 			"GET",
 			"/admin/keys/{filter}",
-			handlerDecorate(c.HandleAdminListKeysFiltered),
+			(*ConfMgr).HandleAdminListKeysFiltered,
 		},
 		Route{
 			"HandleAdminListHashFields",
 			"GET",
 			"/admin/util/hashfields/{keyName}",
-			handlerDecorate(c.HandleAdminListHashFields),
+			(*ConfMgr).HandleAdminListHashFields,
 		},
 		Route{
 			"HandleAdminGetKeyType",
 			"GET",
 			"/admin/util/type/{keyName}",
-			handlerDecorate(c.HandleAdminGetKeyType),
+			(*ConfMgr).HandleAdminGetKeyType,
 		},
 		Route{
 			"HandleAdminGetKey",
 			"GET",
 			"/admin/key/{keyName}",
-			handlerDecorate(c.HandleAdminKeyGet),
+			(*ConfMgr).HandleAdminKeyGet,
 		},
 		Route{
 			"HandleAdminKeyStore",
 			"POST",
 			"/admin/key/{keyName}",
-			handlerDecorate(c.HandleAdminKeyStore),
+			(*ConfMgr).HandleAdminKeyStore,
 		},
 		Route{
 			"HandleAdminKeyDelete",
 			"DELETE",
 			"/admin/key/{keyName}",
-			handlerDecorate(c.HandleAdminKeyDelete),
+			(*ConfMgr).HandleAdminKeyDelete,
+		},
+		Route{
+			"HandleAdminKeyHistory",
+			"GET",
+			"/admin/history/key/{keyName}",
+			(*ConfMgr).HandleAdminKeyHistory,
+		},
+		Route{
+			"HandleAdminKeyRollback",
+			"POST",
+			"/admin/key/{keyName}/rollback/{version:[0-9]+}",
+			(*ConfMgr).HandleAdminKeyRollback,
 		},
 		Route{
 			"HandleAdminGetHashField",
 			"GET",
 			"/admin/key/{keyName}/{fieldName}",
-			handlerDecorate(c.HandleAdminGetHashField),
+			(*ConfMgr).HandleAdminGetHashField,
 		},
 		Route{
 			"HandleAdminListAppend",
 			"PATCH",
 			"/admin/key/append/{keyName}",
-			handlerDecorate(c.HandleAdminListAppend),
+			(*ConfMgr).HandleAdminListAppend,
 		},
 		Route{
 			"HandleAdminSetHashField",
 			"POST",
 			"/admin/key/{keyName}/{fieldName}",
-			handlerDecorate(c.HandleAdminSetHashField),
+			(*ConfMgr).HandleAdminSetHashField,
 		},
 		Route{
 			"HandleAdminGetListIndex",
 			"GET",
 			"/admin/key/{keyName}/index/{listIndex:[0-9]+}",
-			handlerDecorate(c.HandleAdminGetListIndex),
+			(*ConfMgr).HandleAdminGetListIndex,
+		},
+		Route{
+			"HandleAdminTxn",
+			"POST",
+			"/admin/txn",
+			(*ConfMgr).HandleAdminTxn,
+		},
+		Route{
+			"HandleAdminListChanges",
+			"GET",
+			"/admin/changes",
+			(*ConfMgr).HandleAdminListChanges,
+		},
+		Route{
+			"HandleAdminCreateChange",
+			"POST",
+			"/admin/changes",
+			(*ConfMgr).HandleAdminCreateChange,
+		},
+		Route{
+			"HandleAdminGetChange",
+			"GET",
+			"/admin/changes/{id}",
+			(*ConfMgr).HandleAdminGetChange,
+		},
+		Route{
+			"HandleAdminChangeDiff",
+			"GET",
+			"/admin/changes/{id}/diff",
+			(*ConfMgr).HandleAdminChangeDiff,
+		},
+		Route{
+			"HandleAdminPreviewChange",
+			"POST",
+			"/admin/changes/{id}/preview",
+			(*ConfMgr).HandleAdminPreviewChange,
+		},
+		Route{
+			"HandleAdminApproveChange",
+			"POST",
+			"/admin/changes/{id}/approve",
+			(*ConfMgr).HandleAdminApproveChange,
+		},
+		Route{
+			"HandleAdminRejectChange",
+			"POST",
+			"/admin/changes/{id}/reject",
+			(*ConfMgr).HandleAdminRejectChange,
+		},
+		Route{
+			"HandleAdminListSchedules",
+			"GET",
+			"/admin/schedule",
+			(*ConfMgr).HandleAdminListSchedules,
+		},
+		Route{
+			"HandleAdminCreateSchedule",
+			"POST",
+			"/admin/schedule",
+			(*ConfMgr).HandleAdminCreateSchedule,
+		},
+		Route{
+			"HandleAdminGetSchedule",
+			"GET",
+			"/admin/schedule/{id}",
+			(*ConfMgr).HandleAdminGetSchedule,
+		},
+		Route{
+			"HandleAdminCancelSchedule",
+			"DELETE",
+			"/admin/schedule/{id}",
+			(*ConfMgr).HandleAdminCancelSchedule,
+		},
+		Route{
+			"HandleAdminLocateKey",
+			"GET",
+			"/admin/locate/{keyName}",
+			(*ConfMgr).HandleAdminLocateKey,
+		},
+		Route{
+			"HandleAdminKeyImpact",
+			"POST",
+			"/admin/impact/{keyName}",
+			(*ConfMgr).HandleAdminKeyImpact,
+		},
+		Route{
+			"HandleAdminScopeDiff",
+			"GET",
+			"/admin/diff",
+			(*ConfMgr).HandleAdminScopeDiff,
+		},
+		Route{
+			"HandleAdminScopeDiffJSON",
+			"POST",
+			"/admin/diff",
+			(*ConfMgr).HandleAdminScopeDiff,
+		},
+		Route{
+			"HandleAdminListNodes",
+			"GET",
+			"/admin/registry",
+			(*ConfMgr).HandleAdminListNodes,
+		},
+		Route{
+			"HandleAdminGetNode",
+			"GET",
+			"/admin/registry/{identity}",
+			(*ConfMgr).HandleAdminGetNode,
+		},
+		Route{
+			"HandleAdminStoreNode",
+			"POST",
+			"/admin/registry/{identity}",
+			(*ConfMgr).HandleAdminStoreNode,
+		},
+		Route{
+			"HandleAdminDeleteNode",
+			"DELETE",
+			"/admin/registry/{identity}",
+			(*ConfMgr).HandleAdminDeleteNode,
+		},
+		Route{
+			"HandleAdminAudit",
+			"GET",
+			"/admin/audit",
+			(*ConfMgr).HandleAdminAudit,
+		},
+		Route{
+			"HandleAdminListHierarchies",
+			"GET",
+			"/admin/hierarchies",
+			(*ConfMgr).HandleAdminListHierarchies,
+		},
+		Route{
+			"HandleAdminGetHierarchy",
+			"GET",
+			"/admin/hierarchy",
+			(*ConfMgr).HandleAdminGetHierarchy,
+		},
+		Route{
+			"HandleAdminStoreHierarchy",
+			"PUT",
+			"/admin/hierarchy",
+			(*ConfMgr).HandleAdminStoreHierarchy,
+		},
+		Route{
+			"HandleAdminGetHierarchy",
+			"GET",
+			"/admin/hierarchy/{name}",
+			(*ConfMgr).HandleAdminGetHierarchy,
+		},
+		Route{
+			"HandleAdminStoreHierarchy",
+			"PUT",
+			"/admin/hierarchy/{name}",
+			(*ConfMgr).HandleAdminStoreHierarchy,
+		},
+		Route{
+			"HandleAdminHierarchyHistory",
+			"GET",
+			"/admin/hierarchy/{name}/history",
+			(*ConfMgr).HandleAdminHierarchyHistory,
+		},
+		Route{
+			"HandleAdminRevertHierarchy",
+			"POST",
+			"/admin/hierarchy/{name}/revert/{version:[0-9]+}",
+			(*ConfMgr).HandleAdminRevertHierarchy,
 		},
 		Route{
 			"HandleLookupHash",
 			"GET",
 			"/hash/{keyName}",
-			handlerDecorate(c.HandleLookupHash),
+			(*ConfMgr).HandleLookupHash,
+		},
+		Route{
+			"HandleLookupHashJSON",
+			"POST",
+			"/hash/{keyName}",
+			(*ConfMgr).HandleLookupHash,
 		},
 		Route{
 			"HandleLookupString",
 			"GET",
 			"/string/{keyName}",
-			handlerDecorate(c.HandleLookupString),
+			(*ConfMgr).HandleLookupString,
+		},
+		Route{
+			"HandleLookupStringJSON",
+			"POST",
+			"/string/{keyName}",
+			(*ConfMgr).HandleLookupString,
 		},
 		Route{
 			"HandleLookupList",
 			"GET",
 			"/list/{keyName}",
-			handlerDecorate(c.HandleLookupList),
+			(*ConfMgr).HandleLookupList,
+		},
+		Route{
+			"HandleLookupListJSON",
+			"POST",
+			"/list/{keyName}",
+			(*ConfMgr).HandleLookupList,
 		},
 		Route{
 			"HandleLookupHashField",
 			"GET",
 			"/string/{keyName}/{fieldName}",
-			handlerDecorate(c.HandleLookupHashField),
+			(*ConfMgr).HandleLookupHashField,
+		},
+		Route{
+			"HandleLookupHashFieldJSON",
+			"POST",
+			"/string/{keyName}/{fieldName}",
+			(*ConfMgr).HandleLookupHashField,
 		},
 		Route{
 			"HandleLookupListIndex",
 			"GET",
 			"/string/{keyName}/index/{listIndex}",
-			handlerDecorate(c.HandleLookupListIndex),
+			(*ConfMgr).HandleLookupListIndex,
+		},
+		Route{
+			"HandleLookupListIndexJSON",
+			"POST",
+			"/string/{keyName}/index/{listIndex}",
+			(*ConfMgr).HandleLookupListIndex,
 		},
 	}
 }
@@ -0,0 +1,481 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SchedulePending   = "pending"
+	ScheduleApplied   = "applied"
+	ScheduleCancelled = "cancelled"
+	ScheduleFailed    = "failed"
+)
+
+/*
+ * Writes to apply at a given time. Scheduled changes are stored in the
+ * backend, so they survive restarts and are applied by whichever instance
+ * sees them due first.
+ */
+type ScheduledChange struct {
+	ID      string     `json:"id"`
+	ApplyAt time.Time  `json:"apply_at"`
+	Author  string     `json:"author"`
+	Created time.Time  `json:"created"`
+	Status  string     `json:"status"`
+	Ops     []TxnOp    `json:"ops"`
+	Applied *time.Time `json:"applied,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+type ScheduleRequest struct {
+	ApplyAt time.Time `json:"apply_at"`
+	Ops     []TxnOp   `json:"ops"`
+}
+
+type ScheduleResponse struct {
+	Type string          `json:"type"`
+	Data ScheduledChange `json:"data"`
+}
+
+func (r ScheduleResponse) ToString() string {
+	lines := []string{fmt.Sprintf("%s %s %s by %s", r.Data.ID, r.Data.ApplyAt.Format(time.RFC3339), r.Data.Status, r.Data.Author)}
+	for _, op := range r.Data.Ops {
+		lines = append(lines, fmt.Sprintf("  %s %s %s", op.Op, op.Key, op.Field))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ScheduleResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+type ScheduleListResponse struct {
+	Type string            `json:"type"`
+	Data []ScheduledChange `json:"data"`
+}
+
+func (r ScheduleListResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, change := range r.Data {
+		lines[idx] = fmt.Sprintf("%s %s %s by %s", change.ID, change.ApplyAt.Format(time.RFC3339), change.Status, change.Author)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ScheduleListResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func (c *ConfMgr) scheduleKey(id string) string {
+	return fmt.Sprintf("%sschedule:%s:%s", c.Config.Main.MetaPrefix, c.Namespace, id)
+}
+
+/*
+ * Hash of the pending scheduled changes of this namespace, with the time
+ * they apply at by ID. The scheduler only reads this instead of all of
+ * them.
+ */
+func (c *ConfMgr) pendingSchedulesKey() string {
+	return fmt.Sprintf("%spending_schedules:%s", c.Config.Main.MetaPrefix, c.Namespace)
+}
+
+func (change ScheduledChange) Keys() []string {
+	return ChangeSet{Ops: change.Ops}.Keys()
+}
+
+func (change ScheduledChange) json() (string, error) {
+	jsonblob, err := json.Marshal(change)
+	return string(jsonblob), err
+}
+
+/*
+ * Store a new scheduled change and add it to the pending ones
+ */
+func (c *ConfMgr) saveSchedule(change ScheduledChange, b backend.ConfigBackend) error {
+	value, err := change.json()
+	if err != nil {
+		return err
+	}
+	return b.Atomic(nil, func() error { return nil }, func(w backend.ConfigWriter) error {
+		if err := w.SetString(c.scheduleKey(change.ID), value); err != nil {
+			return err
+		}
+		return w.SetHashField(c.pendingSchedulesKey(), change.ID, change.ApplyAt.Format(time.RFC3339Nano))
+	})
+}
+
+/*
+ * Guard for closing a pending scheduled change: the record is kept for
+ * main.change_retention and leaves the pending ones in the same commit
+ */
+func (c *ConfMgr) closeScheduleGuard(id string, current string, updated string) *txnGuard {
+	return &txnGuard{
+		Key:      c.scheduleKey(id),
+		Expected: current,
+		Value:    updated,
+		Expires:  c.retainUntil(),
+		Apply: func(w backend.ConfigWriter) error {
+			return w.DeleteHashField(c.pendingSchedulesKey(), id)
+		},
+	}
+}
+
+/*
+ * Read a scheduled change, nil if it does not exist
+ */
+func (c *ConfMgr) GetSchedule(id string, b backend.ConfigBackend) (*ScheduledChange, error) {
+	key := c.scheduleKey(id)
+	exists, err := b.Exists(key)
+	if err != nil || !exists {
+		return nil, err
+	}
+	value, err := b.GetString(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var change ScheduledChange
+	if err := json.Unmarshal([]byte(value), &change); err != nil {
+		return nil, fmt.Errorf("Corrupt scheduled change %s: %s", id, err)
+	}
+	return &change, nil
+}
+
+/*
+ * All scheduled changes of this namespace, in the order they apply
+ */
+func (c *ConfMgr) ListSchedules(b backend.ConfigBackend) ([]ScheduledChange, error) {
+	changes := make([]ScheduledChange, 0)
+	prefix := c.scheduleKey("")
+
+	keys, err := b.ListKeys(prefix + "*")
+	if err != nil {
+		return changes, err
+	}
+	for _, key := range keys {
+		change, err := c.GetSchedule(strings.TrimPrefix(key, prefix), b)
+		if err != nil {
+			return changes, err
+		}
+		if change != nil {
+			changes = append(changes, *change)
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ApplyAt.Before(changes[j].ApplyAt) })
+	return changes, nil
+}
+
+func (c *ConfMgr) CreateSchedule(author string, request ScheduleRequest, b backend.ConfigBackend) (ScheduledChange, error) {
+	if request.ApplyAt.IsZero() {
+		return ScheduledChange{}, TxnError{"apply_at must be set"}
+	}
+	txn := TxnRequest{Ops: request.Ops}
+	if err := c.prepareTxn(&txn); err != nil {
+		return ScheduledChange{}, err
+	}
+	if err := c.checkTxn(txn, b); err != nil {
+		return ScheduledChange{}, err
+	}
+
+	id, err := newChangeID()
+	if err != nil {
+		return ScheduledChange{}, err
+	}
+	change := ScheduledChange{
+		ID:      id,
+		ApplyAt: request.ApplyAt.UTC(),
+		Author:  author,
+		Created: time.Now().UTC(),
+		Status:  SchedulePending,
+		Ops:     txn.Ops,
+	}
+	return change, c.saveSchedule(change, b)
+}
+
+func (c *ConfMgr) CancelSchedule(change ScheduledChange, b backend.ConfigBackend) (ScheduledChange, error) {
+	if change.Status != SchedulePending {
+		return change, ChangeError{fmt.Sprintf("Scheduled change %s is %s", change.ID, change.Status)}
+	}
+
+	current, err := change.json()
+	if err != nil {
+		return change, err
+	}
+	change.Status = ScheduleCancelled
+	return change, c.updateSchedule(change, current, b)
+}
+
+/*
+ * Store the final state of a scheduled change, unless it changed since it
+ * was read. Schedulers and cancels race for the same record, the loser
+ * gets ErrConflict.
+ */
+func (c *ConfMgr) updateSchedule(change ScheduledChange, current string, b backend.ConfigBackend) error {
+	updated, err := change.json()
+	if err != nil {
+		return err
+	}
+	return c.closeScheduleGuard(change.ID, current, updated).commit(b)
+}
+
+/*
+ * Request to record scheduled writes with, carrying the author's identity
+ * for the audit log. Must be released with context.Clear.
+ */
+func scheduleRequest(author string) *http.Request {
+	r := &http.Request{RemoteAddr: "scheduler", Header: make(http.Header)}
+	if idx := strings.Index(author, ":"); idx >= 0 {
+		context.Set(r, ReqPrincipal, &Principal{Name: author[idx+1:], Method: author[:idx]})
+	}
+	return r
+}
+
+/*
+ * Apply a due change. The ops and the new status are committed together,
+ * so the change is applied once even if several instances run it.
+ */
+func (c *ConfMgr) applySchedule(change ScheduledChange, b backend.ConfigBackend) (ScheduledChange, error) {
+	current, err := change.json()
+	if err != nil {
+		return change, err
+	}
+
+	now := time.Now().UTC()
+	change.Status = ScheduleApplied
+	change.Applied = &now
+	updated, err := change.json()
+	if err != nil {
+		return change, err
+	}
+
+	r := scheduleRequest(change.Author)
+	defer context.Clear(r)
+	guard := c.closeScheduleGuard(change.ID, current, updated)
+	_, err = c.commitTxn(r, AuditScheduled, TxnRequest{Ops: change.Ops}, guard, b)
+	switch err.(type) {
+	case nil:
+		log.Infof("Applied scheduled change %s by %s", change.ID, change.Author)
+		return change, nil
+	case TxnError, PreconditionError:
+		// The keys no longer fit the change, it would never apply
+		change.Status = ScheduleFailed
+		change.Applied = nil
+		change.Error = err.Error()
+		log.Errorf("Cannot apply scheduled change %s: %s", change.ID, err)
+		return change, c.updateSchedule(change, current, b)
+	default:
+		return change, err
+	}
+}
+
+/*
+ * Apply all pending changes due at the given time, in the order they are
+ * due. Changes that were modified concurrently are left for the next run.
+ */
+func (c *ConfMgr) ApplyDueSchedules(now time.Time, b backend.ConfigBackend) error {
+	index := c.pendingSchedulesKey()
+	pending, err := b.GetHash(index)
+	if err != nil {
+		return err
+	}
+
+	due := make([]string, 0)
+	dueAt := make(map[string]time.Time)
+	for id, value := range pending {
+		// Unreadable times are left to the record to decide
+		applyAt, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil && applyAt.After(now) {
+			continue
+		}
+		due = append(due, id)
+		dueAt[id] = applyAt
+	}
+	sort.Slice(due, func(i, j int) bool { return dueAt[due[i]].Before(dueAt[due[j]]) })
+
+	for _, id := range due {
+		change, err := c.GetSchedule(id, b)
+		if err != nil {
+			log.Errorf("Cannot read scheduled change %s, retrying: %s", id, err)
+			continue
+		}
+		if change == nil || change.Status != SchedulePending {
+			// Removed or closed without leaving the index
+			if err := b.DeleteHashField(index, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if change.ApplyAt.After(now) {
+			continue
+		}
+		if _, err := c.applySchedule(*change, b); err != nil && err != backend.ErrConflict {
+			log.Errorf("Cannot apply scheduled change %s, retrying: %s", change.ID, err)
+		}
+	}
+	return nil
+}
+
+/*
+ * Apply due scheduled changes of all namespaces every schedule_interval
+ * seconds. Returns once schedule_interval is set to 0.
+ */
+func (c *ConfMgr) RunScheduler() {
+	for {
+		interval := c.taskInterval(&c.tasks.scheduling, func(main config.MainConfig) int {
+			return main.ScheduleInterval
+		})
+		if interval <= 0 {
+			log.Info("Stopped applying scheduled changes")
+			return
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+
+		view := c.view()
+		managers := []*ConfMgr{view}
+		for _, ns := range view.Namespaces {
+			managers = append(managers, ns)
+		}
+		b, done := newBackend()
+		for _, m := range managers {
+			if err := m.ApplyDueSchedules(time.Now(), b); err != nil {
+				log.Errorf("Cannot check scheduled changes of namespace %s: %s", m.Namespace, err)
+			}
+		}
+		done()
+	}
+}
+
+/*
+ * Load the scheduled change named in the request, replying 404 if it does
+ * not exist
+ */
+func (c *ConfMgr) requestSchedule(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) *ScheduledChange {
+	id := mux.Vars(r)["id"]
+	change, err := c.GetSchedule(id, b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return nil
+	}
+	if change == nil {
+		SendErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Scheduled change %s not found", id))
+		return nil
+	}
+	return change
+}
+
+func (c *ConfMgr) HandleAdminListSchedules(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	changes, err := c.ListSchedules(b)
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	visible := make([]ScheduledChange, 0, len(changes))
+	for _, change := range changes {
+		if status != "" && change.Status != status {
+			continue
+		}
+		// Only show changes the client could read with /admin/schedule/{id}
+		if c.authorizeOps(r, change.Ops, true) == nil {
+			visible = append(visible, change)
+		}
+	}
+
+	SendResponse(w, r, ScheduleListResponse{"schedule", visible})
+}
+
+func (c *ConfMgr) HandleAdminCreateSchedule(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	if !checkNoExpiry(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var request ScheduleRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	txn := TxnRequest{Ops: request.Ops}
+	if err := c.prepareTxn(&txn); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid scheduled change: %s", err))
+		return
+	}
+	if !c.checkChangeAccess(w, r, txn.Ops, false) {
+		return
+	}
+
+	change, err := c.CreateSchedule(requestIdentity(r), request, b)
+	if _, ok := err.(TxnError); ok {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid scheduled change: %s", err))
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	log.Infof("Scheduled change %s by %s for %s", change.ID, change.Author, change.ApplyAt.Format(time.RFC3339))
+
+	SendResponse(w, r, ScheduleResponse{"scheduled", change})
+}
+
+func (c *ConfMgr) HandleAdminGetSchedule(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestSchedule(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, true) {
+		return
+	}
+
+	SendResponse(w, r, ScheduleResponse{"scheduled", *change})
+}
+
+func (c *ConfMgr) HandleAdminCancelSchedule(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	change := c.requestSchedule(w, r, b)
+	if change == nil || !c.checkChangeAccess(w, r, change.Ops, false) {
+		return
+	}
+
+	cancelled, err := c.CancelSchedule(*change, b)
+	if _, ok := err.(ChangeError); ok || err == backend.ErrConflict {
+		SendErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	log.Infof("Cancelled scheduled change %s", change.ID)
+
+	SendResponse(w, r, ScheduleResponse{"scheduled", cancelled})
+}
@@ -0,0 +1,297 @@
+package confmgr
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/config"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+/*
+ * A ScopeSource extracts scope variables from one part of a request
+ */
+type ScopeSource interface {
+	Scope(r *http.Request) (map[string]string, error)
+}
+
+/*
+ * ScopeChain merges the scope of all its sources. Sources earlier in the
+ * chain take precedence over later ones.
+ */
+type ScopeChain []ScopeSource
+
+func NewScopeChain(cfg config.ScopeConfig, hdrPrefix string) (ScopeChain, error) {
+	chain := make(ScopeChain, 0)
+
+	for _, name := range cfg.Sources {
+		switch name {
+		case "header":
+			chain = append(chain, HeaderScopeSource{hdrPrefix})
+		case "query":
+			chain = append(chain, QueryScopeSource{cfg.QueryPrefix})
+		case "body":
+			chain = append(chain, BodyScopeSource{})
+		case "cert":
+			for _, field := range cfg.CertFields {
+				if _, err := CertField(&x509.Certificate{}, field); err != nil {
+					return chain, err
+				}
+			}
+			chain = append(chain, CertScopeSource{cfg.CertFields})
+		default:
+			return chain, fmt.Errorf("Unknown scope source: %s", name)
+		}
+	}
+
+	return chain, nil
+}
+
+func (s ScopeChain) Scope(r *http.Request) (map[string]string, error) {
+	scope := make(map[string]string)
+
+	for idx := len(s) - 1; idx >= 0; idx-- {
+		found, err := s[idx].Scope(r)
+		if err != nil {
+			return scope, err
+		}
+		for token, value := range found {
+			scope[token] = value
+		}
+	}
+
+	return scope, nil
+}
+
+/*
+ * ScopeValidator normalizes scope values and rejects anything that could
+ * address keys outside of the configured hierarchy
+ */
+type ScopeValidator struct {
+	PreserveCase bool
+	Rules        map[string]ScopeRule
+}
+
+type ScopeRule struct {
+	Pattern *regexp.Regexp
+	Allowed map[string]bool
+}
+
+type ScopeError struct {
+	Token string
+	Value string
+	Issue string
+}
+
+func (e ScopeError) Error() string {
+	return fmt.Sprintf("Invalid value '%s' for scope token '%s': %s", e.Value, e.Token, e.Issue)
+}
+
+var (
+	scopeTokenRe = regexp.MustCompile("^[a-z0-9_-]+$")
+)
+
+func NewScopeValidator(cfg config.ScopeConfig) (*ScopeValidator, error) {
+	validator := &ScopeValidator{
+		PreserveCase: cfg.PreserveCase,
+		Rules:        make(map[string]ScopeRule),
+	}
+
+	for token, ruleCfg := range cfg.Rules {
+		var rule ScopeRule
+		if ruleCfg.Pattern != "" {
+			pattern, err := regexp.Compile(ruleCfg.Pattern)
+			if err != nil {
+				return validator, fmt.Errorf("Invalid pattern for scope token %s: %s", token, err)
+			}
+			rule.Pattern = pattern
+		}
+		if len(ruleCfg.Allowed) > 0 {
+			rule.Allowed = make(map[string]bool)
+			for _, value := range ruleCfg.Allowed {
+				if !cfg.PreserveCase {
+					value = strings.ToLower(value)
+				}
+				rule.Allowed[value] = true
+			}
+		}
+		validator.Rules[strings.ToLower(token)] = rule
+	}
+
+	return validator, nil
+}
+
+/*
+ * Return a normalized copy of scope or a ScopeError for the first
+ * invalid token. Empty values are treated as unset.
+ */
+func (v *ScopeValidator) Normalize(scope map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string)
+
+	for token, value := range scope {
+		token = strings.ToLower(token)
+		if value == "" {
+			continue
+		}
+		if !scopeTokenRe.MatchString(token) {
+			return normalized, ScopeError{token, value, "token names may only contain a-z, 0-9, '_' and '-'"}
+		}
+		if !v.PreserveCase {
+			value = strings.ToLower(value)
+		}
+		if idx := strings.IndexFunc(value, invalidScopeRune); idx >= 0 {
+			return normalized, ScopeError{token, value, fmt.Sprintf("must not contain '%c'", []rune(value[idx:])[0])}
+		}
+		if rule, ok := v.Rules[token]; ok {
+			if rule.Pattern != nil && !rule.Pattern.MatchString(value) {
+				return normalized, ScopeError{token, value, fmt.Sprintf("does not match %s", rule.Pattern)}
+			}
+			if rule.Allowed != nil && !rule.Allowed[value] {
+				return normalized, ScopeError{token, value, "not an allowed value"}
+			}
+		}
+		normalized[token] = value
+	}
+
+	return normalized, nil
+}
+
+func invalidScopeRune(r rune) bool {
+	return strings.ContainsRune(":*?[]\\%{}", r) || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+/*
+ * Scope from request headers: x-cfg-site: lon
+ */
+type HeaderScopeSource struct {
+	Prefix string
+}
+
+func (s HeaderScopeSource) Scope(r *http.Request) (map[string]string, error) {
+	return ScopeFromHeaders(r.Header, s.Prefix), nil
+}
+
+/*
+ * Scope from query parameters: ?scope.site=lon
+ */
+type QueryScopeSource struct {
+	Prefix string
+}
+
+func (s QueryScopeSource) Scope(r *http.Request) (map[string]string, error) {
+	scope := make(map[string]string)
+	for param, values := range r.URL.Query() {
+		if strings.HasPrefix(param, s.Prefix) && len(values) > 0 {
+			scope[strings.ToLower(strings.TrimPrefix(param, s.Prefix))] = values[0]
+		}
+	}
+
+	return scope, nil
+}
+
+/*
+ * Scope from a JSON request body: {"scope": {"site": "lon"}}
+ * The body is left in place for the handler.
+ */
+type BodyScopeSource struct{}
+
+type ScopeRequest struct {
+	Scope map[string]string `json:"scope"`
+}
+
+func (s BodyScopeSource) Scope(r *http.Request) (map[string]string, error) {
+	scope := make(map[string]string)
+	if r.Method != "POST" || r.Body == nil {
+		return scope, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		return scope, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var request ScopeRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		log.Debugf("Ignoring non-JSON request body for scope: %s", err)
+		return scope, nil
+	}
+	for token, value := range request.Scope {
+		scope[strings.ToLower(token)] = value
+	}
+
+	return scope, nil
+}
+
+/*
+ * Scope from a verified TLS client certificate. Fields maps scope
+ * tokens to certificate attributes, e.g. fqdn = "cn"
+ */
+type CertScopeSource struct {
+	Fields map[string]string
+}
+
+func (s CertScopeSource) Scope(r *http.Request) (map[string]string, error) {
+	scope := make(map[string]string)
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return scope, nil
+	}
+
+	cert := r.TLS.PeerCertificates[0]
+	for token, field := range s.Fields {
+		value, err := CertField(cert, field)
+		if err != nil {
+			return scope, err
+		}
+		if value != "" {
+			scope[strings.ToLower(token)] = value
+		}
+	}
+
+	return scope, nil
+}
+
+/*
+ * Return the first value of a certificate subject or SAN attribute
+ */
+func CertField(cert *x509.Certificate, field string) (string, error) {
+	var values []string
+
+	switch strings.ToLower(field) {
+	case "cn":
+		values = []string{cert.Subject.CommonName}
+	case "o":
+		values = cert.Subject.Organization
+	case "ou":
+		values = cert.Subject.OrganizationalUnit
+	case "l":
+		values = cert.Subject.Locality
+	case "st":
+		values = cert.Subject.Province
+	case "c":
+		values = cert.Subject.Country
+	case "dns":
+		values = cert.DNSNames
+	case "email":
+		values = cert.EmailAddresses
+	case "uri":
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+	default:
+		return "", fmt.Errorf("Unknown certificate field: %s", field)
+	}
+
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
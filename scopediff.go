@@ -0,0 +1,276 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/vars"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type ScopeDiffRequest struct {
+	A    map[string]string `json:"a"`
+	B    map[string]string `json:"b"`
+	Keys []string          `json:"keys"`
+}
+
+type ScopeDiffEntry struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	A     interface{} `json:"a"`
+	B     interface{} `json:"b"`
+	Error string      `json:"error,omitempty"`
+}
+
+type ScopeDiffResponse struct {
+	Type string            `json:"type"`
+	A    map[string]string `json:"a"`
+	B    map[string]string `json:"b"`
+	Data []ScopeDiffEntry  `json:"data"`
+}
+
+func (r ScopeDiffResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, entry := range r.Data {
+		if entry.Error != "" {
+			lines[idx] = fmt.Sprintf("%s: error: %s", entry.Key, entry.Error)
+			continue
+		}
+		lines[idx] = fmt.Sprintf("%s: %s | %s", entry.Key, diffValueString(entry.A), diffValueString(entry.B))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r ScopeDiffResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+func diffValueString(value interface{}) string {
+	switch v := value.(type) {
+	case *ValueSource:
+		return fmt.Sprintf("%s (%s)", v.Value, v.Source)
+	case []ValueSource:
+		entries := make([]string, len(v))
+		for idx, entry := range v {
+			entries[idx] = entry.Value
+		}
+		return fmt.Sprintf("[%s]", strings.Join(entries, ", "))
+	default:
+		return "<unset>"
+	}
+}
+
+/*
+ * Build a diff request from query parameters:
+ *   ?a.site=lon&b.site=nyc&key=db&key=web
+ */
+func ScopeDiffRequestFromQuery(query url.Values) ScopeDiffRequest {
+	request := ScopeDiffRequest{
+		A:    make(map[string]string),
+		B:    make(map[string]string),
+		Keys: make([]string, 0),
+	}
+	for param, values := range query {
+		switch {
+		case param == "key":
+			request.Keys = append(request.Keys, values...)
+		case strings.HasPrefix(param, "a."):
+			request.A[strings.TrimPrefix(param, "a.")] = values[0]
+		case strings.HasPrefix(param, "b."):
+			request.B[strings.TrimPrefix(param, "b.")] = values[0]
+		}
+	}
+	return request
+}
+
+/*
+ * Compare the resolved values of the requested keys (all keys if none
+ * were requested) between two scopes. Only differing values are returned.
+ */
+func (c *ConfMgr) DiffScopes(request ScopeDiffRequest, b backend.ConfigBackend) (ScopeDiffResponse, error) {
+	var resp ScopeDiffResponse
+	resp.Type = "list"
+	resp.Data = make([]ScopeDiffEntry, 0)
+
+	var err error
+	if request.A, err = c.ScopeValidator.Normalize(request.A); err != nil {
+		return resp, err
+	}
+	if request.B, err = c.ScopeValidator.Normalize(request.B); err != nil {
+		return resp, err
+	}
+	if request.A, err = c.ExpandScope(request.A, b); err != nil {
+		return resp, err
+	}
+	if request.B, err = c.ExpandScope(request.B, b); err != nil {
+		return resp, err
+	}
+	resp.A = request.A
+	resp.B = request.B
+
+	keyTypes, err := c.LogicalKeys(request.Keys, b)
+	if err != nil {
+		return resp, err
+	}
+
+	names := make([]string, 0, len(keyTypes))
+	for name := range keyTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, keyType := range keyTypes[name] {
+			respA, errA := c.LookupKey(name, keyType, request.A, b)
+			respB, errB := c.LookupKey(name, keyType, request.B, b)
+			if errA != nil || errB != nil {
+				entry := ScopeDiffEntry{Key: name, Type: keyType}
+				if errA != nil {
+					entry.Error = fmt.Sprintf("a: %s", errA)
+				} else {
+					entry.Error = fmt.Sprintf("b: %s", errB)
+				}
+				resp.Data = append(resp.Data, entry)
+				continue
+			}
+			resp.Data = append(resp.Data, diffLookups(name, keyType, respA, respB)...)
+		}
+	}
+
+	return resp, nil
+}
+
+func diffLookups(name string, keyType string, respA KeyResponse, respB KeyResponse) []ScopeDiffEntry {
+	entries := make([]ScopeDiffEntry, 0)
+
+	switch keyType {
+	case TypeToString(vars.TYPE_STRING):
+		a := respA.(LookupStringResponse).Data
+		b := respB.(LookupStringResponse).Data
+		if a.Value != b.Value || (a.Source == "") != (b.Source == "") {
+			entries = append(entries, ScopeDiffEntry{name, keyType, foundValue(a), foundValue(b), ""})
+		}
+	case TypeToString(vars.TYPE_HASH):
+		a := respA.(LookupHashResponse).Data
+		b := respB.(LookupHashResponse).Data
+		fields := make(map[string]bool)
+		for field := range a {
+			fields[field] = true
+		}
+		for field := range b {
+			fields[field] = true
+		}
+		sorted := make([]string, 0, len(fields))
+		for field := range fields {
+			sorted = append(sorted, field)
+		}
+		sort.Strings(sorted)
+		for _, field := range sorted {
+			fieldA, okA := a[field]
+			fieldB, okB := b[field]
+			if okA != okB || fieldA.Value != fieldB.Value {
+				entry := ScopeDiffEntry{Key: fmt.Sprintf("%s/%s", name, field), Type: TypeToString(vars.TYPE_STRING)}
+				if okA {
+					entry.A = &fieldA
+				}
+				if okB {
+					entry.B = &fieldB
+				}
+				entries = append(entries, entry)
+			}
+		}
+	case TypeToString(vars.TYPE_LIST):
+		if !reflect.DeepEqual(ResolvedValue(respA), ResolvedValue(respB)) {
+			entry := ScopeDiffEntry{Key: name, Type: keyType}
+			if a := respA.(LookupListResponse).Data; len(a) > 0 {
+				entry.A = a
+			}
+			if b := respB.(LookupListResponse).Data; len(b) > 0 {
+				entry.B = b
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func foundValue(value ValueSource) interface{} {
+	if value.Source == "" {
+		return nil
+	}
+	return &value
+}
+
+/*
+ * Map logical key names to the key types they are defined as on any
+ * hierarchy level. Returns all logical keys if names is empty. The types
+ * of all matching keys are fetched in one batch.
+ */
+func (c *ConfMgr) LogicalKeys(names []string, b backend.ConfigBackend) (map[string][]string, error) {
+	filters := make([]string, 0)
+	if len(names) == 0 {
+		filters = append(filters, c.Config.Main.KeyPrefix+"*")
+	}
+	for _, name := range names {
+		filters = append(filters, fmt.Sprintf("%s*:%s", c.Config.Main.KeyPrefix, name))
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	candidates := make([]string, 0)
+	logical := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, filter := range filters {
+		keys, err := b.ListKeys(filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			location, ok := c.ParseKey(key)
+			if !ok || seen[key] || (len(wanted) > 0 && !wanted[location.Name]) {
+				continue
+			}
+			seen[key] = true
+			candidates = append(candidates, key)
+			logical = append(logical, location.Name)
+		}
+	}
+
+	types, err := b.GetTypes(candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]map[string]bool)
+	for idx, keytype := range types {
+		if keytype == vars.TYPE_NOT_FOUND {
+			continue
+		}
+		if _, ok := found[logical[idx]]; !ok {
+			found[logical[idx]] = make(map[string]bool)
+		}
+		found[logical[idx]][TypeToString(keytype)] = true
+	}
+
+	keyTypes := make(map[string][]string)
+	for name, types := range found {
+		for keyType := range types {
+			keyTypes[name] = append(keyTypes[name], keyType)
+		}
+		sort.Strings(keyTypes[name])
+	}
+
+	return keyTypes, nil
+}
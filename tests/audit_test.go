@@ -0,0 +1,142 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confmgr-audit")
+	if err != nil {
+		t.Fatalf("ERROR: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Audit.Sink = "file"
+	cfg.Audit.File = filepath.Join(dir, "audit.jsonl")
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(nil)
+	prefix := cfg.Main.KeyPrefix
+	r := httptest.NewRequest("PUT", "/admin/key", nil)
+	srv.RecordChange(r, b, confmgr.AuditStore, prefix+"app", "", nil, &confmgr.HashKeyResponse{Type: "hash", Data: map[string]string{"host": "db1", "db_password": "hunter2"}})
+	srv.RecordChange(r, b, confmgr.AuditSetHashField, prefix+"app", "db_password", "hunter2", "hunter3")
+	srv.RecordChange(r, b, confmgr.AuditDelete, prefix+"other", "", &confmgr.StringKeyResponse{Type: "string", Data: "x"}, nil)
+
+	type TestEntry struct {
+		Query  string
+		Expect int
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"", 3},
+		TestEntry{"?key=app", 2},
+		TestEntry{"?op=delete", 1},
+		TestEntry{"?user=anonymous", 3},
+		TestEntry{"?user=alice", 0},
+		TestEntry{"?limit=1", 1},
+		TestEntry{"?from=2000-01-01T00:00:00Z&to=2001-01-01T00:00:00Z", 0},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: GET /admin/audit%s", idx, e.Query)
+		req := httptest.NewRequest("GET", "/admin/audit"+e.Query, nil)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, req)
+
+		var resp confmgr.AuditResponse
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &resp) != nil {
+			t.Fatalf("ERROR: Unexpected response %d: %s", w.Code, w.Body.String())
+		}
+		t.Logf("  Expected: %d entries", e.Expect)
+		t.Logf("  Actual  : %d entries", len(resp.Data))
+		if len(resp.Data) != e.Expect {
+			t.Fail()
+		}
+	}
+
+	data, _ := ioutil.ReadFile(cfg.Audit.File)
+	t.Logf("Expected: no secret values in audit file")
+	t.Logf("Actual  : %s", data)
+	if len(data) == 0 || strings.Contains(string(data), "hunter") {
+		t.Fail()
+	}
+}
+
+func TestAuditQueryTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confmgr-audit")
+	if err != nil {
+		t.Fatalf("ERROR: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	type TestEntry struct {
+		Config config.AuditConfig
+		Filter confmgr.AuditFilter
+		Expect []string
+		Total  int
+	}
+
+	file := config.AuditConfig{Sink: "file", File: filepath.Join(dir, "audit.jsonl")}
+	backend := config.AuditConfig{Sink: "backend", MaxEntries: 2000}
+	testdata := []TestEntry{
+		TestEntry{file, confmgr.AuditFilter{Limit: 3}, []string{"k2497", "k2498", "k2499"}, 3},
+		TestEntry{file, confmgr.AuditFilter{Key: "k5??", Limit: 2}, []string{"k598", "k599"}, 2},
+		TestEntry{file, confmgr.AuditFilter{Key: "k5??"}, []string{"k500", "k501"}, 100},
+		TestEntry{file, confmgr.AuditFilter{}, []string{"k0", "k1"}, 2500},
+		TestEntry{backend, confmgr.AuditFilter{Limit: 3}, []string{"k2497", "k2498", "k2499"}, 3},
+		TestEntry{backend, confmgr.AuditFilter{Key: "k5??"}, []string{"k500", "k501"}, 100},
+		TestEntry{backend, confmgr.AuditFilter{Key: "k4??"}, []string{}, 0},
+		TestEntry{backend, confmgr.AuditFilter{}, []string{"k500", "k501"}, 2000},
+	}
+
+	logs := make(map[string]*confmgr.AuditLog)
+	b := overlay.New(nil)
+	for _, cfg := range []config.AuditConfig{file, backend} {
+		audit, err := confmgr.NewAuditLog(cfg, "confmgr:")
+		if err != nil {
+			t.Fatalf("ERROR: %s", err)
+		}
+		b.DeleteKey(audit.Key)
+		for idx := 0; idx < 2500; idx++ {
+			entry := confmgr.AuditEntry{Op: confmgr.AuditStore, Key: fmt.Sprintf("k%d", idx), New: strings.Repeat("x", 100)}
+			if err := audit.Write(entry, b); err != nil {
+				t.Fatalf("ERROR: %s", err)
+			}
+		}
+		logs[cfg.Sink] = audit
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s sink, key '%s', limit %d", idx, e.Config.Sink, e.Filter.Key, e.Filter.Limit)
+		entries, err := logs[e.Config.Sink].Query(e.Filter, b)
+		if err != nil {
+			t.Fatalf("ERROR: %s", err)
+		}
+		keys := make([]string, 0, len(e.Expect))
+		for _, entry := range entries {
+			if len(keys) < len(e.Expect) {
+				keys = append(keys, entry.Key)
+			}
+		}
+		t.Logf("  Expected: %d entries starting with %v", e.Total, e.Expect)
+		t.Logf("  Actual  : %d entries starting with %v", len(entries), keys)
+		if len(entries) != e.Total || strings.Join(keys, ",") != strings.Join(e.Expect, ",") {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Tokens:  map[string]string{"ci": "t0ken"},
+		Users:   map[string]string{"alice": string(hash)},
+		Rules: []config.AuthRuleConfig{
+			config.AuthRuleConfig{Routes: "HandleAdminListHierarchies", Require: true, Methods: []string{"basic"}},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	type TestEntry struct {
+		Path   string
+		Token  string
+		User   string
+		Expect int
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"/", "", "", http.StatusOK},
+		TestEntry{"/admin/hierarchy", "", "", http.StatusUnauthorized},
+		TestEntry{"/admin/hierarchy", "wrong", "", http.StatusUnauthorized},
+		TestEntry{"/admin/hierarchy", "t0ken", "", http.StatusOK},
+		TestEntry{"/admin/hierarchy", "", "alice", http.StatusOK},
+		TestEntry{"/admin/hierarchies", "t0ken", "", http.StatusUnauthorized},
+		TestEntry{"/admin/hierarchies", "", "alice", http.StatusOK},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: GET %s with token '%s', user '%s'", idx, e.Path, e.Token, e.User)
+		r := httptest.NewRequest("GET", e.Path, nil)
+		if e.Token != "" {
+			r.Header.Set("Authorization", "Bearer "+e.Token)
+		}
+		if e.User != "" {
+			r.SetBasicAuth(e.User, "secret")
+		}
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d", w.Code)
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+	}
+}
@@ -2,9 +2,11 @@ package confmgr
 
 import (
 	redigo "github.com/garyburd/redigo/redis"
+	"github.com/moensch/confmgr/backends"
 	"github.com/moensch/confmgr/backends/redis"
 	"github.com/moensch/confmgr/vars"
 	"testing"
+	"time"
 )
 
 var (
@@ -54,6 +56,24 @@ func TestType(t *testing.T) {
 	}
 }
 
+func TestTypes(t *testing.T) {
+	keys := []string{"cfg:test:string", "cfg:test:array", "cfg:test:hash", "notfound"}
+	expected := []int{vars.TYPE_STRING, vars.TYPE_LIST, vars.TYPE_HASH, vars.TYPE_NOT_FOUND}
+
+	actual, err := b.GetTypes(keys)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot check types: %s", err)
+	}
+
+	t.Logf("  Expected: %v", expected)
+	t.Logf("  Actual  : %v", actual)
+	for idx := range expected {
+		if actual[idx] != expected[idx] {
+			t.Fail()
+		}
+	}
+}
+
 func TestExists(t *testing.T) {
 	exists, err := b.Exists("thiswillneverexist")
 
@@ -254,3 +274,69 @@ func TestListKeysFilter(t *testing.T) {
 		t.Logf(" key %d: '%s'", pos, entry)
 	}
 }
+
+func TestAtomic(t *testing.T) {
+	other, err := redigo.Dial("tcp", ":6379")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot connect: %s", err)
+	}
+	defer other.Close()
+
+	apply := func(w backend.ConfigWriter) error {
+		w.SetString("cfg:test:txn:a", "new")
+		return w.SetList("cfg:test:txn:b", []string{"new"})
+	}
+	b.SetString("cfg:test:txn:a", "old")
+
+	// A watched key modified by another client aborts the transaction
+	err = b.Atomic([]string{"cfg:test:txn:a"}, func() error {
+		_, err := other.Do("SET", "cfg:test:txn:a", "other")
+		return err
+	}, apply)
+	value, _ := b.GetString("cfg:test:txn:a")
+	t.Logf("Expected: %s, value 'other'", backend.ErrConflict)
+	t.Logf("Actual  : %v, value '%s'", err, value)
+	if err != backend.ErrConflict || value != "other" {
+		t.Fail()
+	}
+
+	err = b.Atomic([]string{"cfg:test:txn:a"}, func() error { return nil }, apply)
+	value, _ = b.GetString("cfg:test:txn:a")
+	list, _ := b.GetList("cfg:test:txn:b")
+	t.Logf("Expected: <nil>, value 'new', list [new]")
+	t.Logf("Actual  : %v, value '%s', list %v", err, value, list)
+	if err != nil || value != "new" || len(list) != 1 {
+		t.Fail()
+	}
+
+	b.DeleteKey("cfg:test:txn:a")
+	b.DeleteKey("cfg:test:txn:b")
+}
+
+func TestExpiry(t *testing.T) {
+	b.SetString("cfg:test:expiry", "on")
+	b.SetExpiry("cfg:test:expiry", time.Now().Add(time.Hour))
+	at, err := b.GetExpiry("cfg:test:expiry")
+	t.Logf("Expected: expiry in about 1h")
+	t.Logf("Actual  : %v, expiry in %s", err, time.Until(at))
+	if err != nil || time.Until(at) < 59*time.Minute || time.Until(at) > time.Hour {
+		t.Fail()
+	}
+
+	// Replacing the value makes the key permanent again
+	b.SetString("cfg:test:expiry", "off")
+	at, err = b.GetExpiry("cfg:test:expiry")
+	t.Logf("Expected: no expiry")
+	t.Logf("Actual  : %v, expiry %v", err, at)
+	if err != nil || !at.IsZero() {
+		t.Fail()
+	}
+
+	b.SetExpiry("cfg:test:expiry", time.Now().Add(-time.Second))
+	exists, _ := b.Exists("cfg:test:expiry")
+	t.Logf("Expected: expired key removed")
+	t.Logf("Actual  : exists %t", exists)
+	if exists {
+		t.Fail()
+	}
+}
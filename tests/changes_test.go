@@ -0,0 +1,211 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChanges(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.RequireReview = true
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		Tokens:  map[string]string{"alice": "alice-token", "bob": "bob-token", "carol": "carol-token"},
+	}
+	cfg.RBAC = config.RBACConfig{
+		Enabled: true,
+		Rules: []config.RBACRuleConfig{
+			config.RBACRuleConfig{Name: "editors", Identities: []string{"alice", "bob"}, Verbs: []string{"*"}, Keys: []string{cfg.Main.KeyPrefix + "*"}},
+			config.RBACRuleConfig{Name: "readers", Identities: []string{"carol"}, Verbs: []string{"read"}, Keys: []string{cfg.Main.KeyPrefix + "*"}},
+			config.RBACRuleConfig{Name: "operators", Identities: []string{"alice"}, Verbs: []string{"*"}, Keys: []string{cfg.Main.MetaPrefix + "hierarchy:*", cfg.Main.MetaPrefix + "registry:*"}},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	b.DeleteKey(cfg.Main.KeyPrefix + "motd")
+	b.DeleteKey(cfg.Main.MetaPrefix + "history:" + cfg.Main.KeyPrefix + "motd")
+	b.DeleteKey(cfg.Main.MetaPrefix + "change:" + srv.Namespace + ":missing")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	request := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		return w
+	}
+	create := func(motd string) string {
+		w := request("POST", "/admin/changes", "alice-token",
+			`{"title": "motd", "ops": [{"op": "set", "key": "motd", "type": "string", "data": "`+motd+`"}]}`)
+		var resp confmgr.ChangeResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("ERROR: Cannot create change set: %d %s", w.Code, w.Body.String())
+		}
+		return resp.Data.ID
+	}
+
+	w := request("POST", "/admin/key/motd", "alice-token", `{"type": "string", "data": "direct"}`)
+	t.Logf("Direct write: Expected %d, Actual %d", http.StatusForbidden, w.Code)
+	if w.Code != http.StatusForbidden {
+		t.Fail()
+	}
+
+	// Writes that cannot go through change sets are blocked too
+	for _, route := range [][]string{
+		[]string{"PUT", "/admin/hierarchy/default", `["default"]`},
+		[]string{"POST", "/admin/hierarchy/default/revert/1", ""},
+		[]string{"POST", "/admin/registry/node1", `{"scope": {"env": "prod"}}`},
+		[]string{"DELETE", "/admin/registry/node1", ""},
+	} {
+		w = request(route[0], route[1], "alice-token", route[2])
+		t.Logf("%s %s: Expected %d for review, Actual %d %s", route[0], route[1], http.StatusForbidden, w.Code, w.Body.String())
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "review") {
+			t.Fail()
+		}
+	}
+
+	w = request("POST", "/admin/changes", "carol-token",
+		`{"title": "motd", "ops": [{"op": "set", "key": "motd", "type": "string", "data": "carol"}]}`)
+	t.Logf("Create without write access: Expected %d, Actual %d", http.StatusForbidden, w.Code)
+	if w.Code != http.StatusForbidden {
+		t.Fail()
+	}
+
+	first := create("hello")
+	second := create("stale")
+
+	// Listed by the keys of the change sets, not the keys they are stored in
+	w = request("GET", "/admin/changes", "carol-token", "")
+	var list confmgr.ChangeListResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	t.Logf("List: Expected %d, 2 change sets", http.StatusOK)
+	t.Logf("List: Actual   %d, %d change sets", w.Code, len(list.Data))
+	if w.Code != http.StatusOK || len(list.Data) != 2 {
+		t.Fail()
+	}
+
+	type TestEntry struct {
+		Method string
+		Path   string
+		Token  string
+		Expect int
+		Motd   string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"GET", "/admin/changes/" + first + "/diff", "bob-token", http.StatusOK, ""},
+		TestEntry{"POST", "/admin/changes/" + first + "/approve", "alice-token", http.StatusConflict, ""},
+		TestEntry{"POST", "/admin/changes/" + first + "/approve", "bob-token", http.StatusOK, "hello"},
+		TestEntry{"POST", "/admin/changes/" + first + "/approve", "bob-token", http.StatusConflict, "hello"},
+		TestEntry{"POST", "/admin/changes/" + second + "/approve", "bob-token", http.StatusConflict, "hello"},
+		TestEntry{"POST", "/admin/changes/" + second + "/reject", "bob-token", http.StatusOK, "hello"},
+		TestEntry{"GET", "/admin/changes/missing", "bob-token", http.StatusNotFound, "hello"},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s", idx, e.Method, e.Path)
+		w := request(e.Method, e.Path, e.Token, "")
+		motd, _ := b.GetString(cfg.Main.KeyPrefix + "motd")
+		t.Logf("  Expected: %d, motd '%s'", e.Expect, e.Motd)
+		t.Logf("  Actual  : %d, motd '%s'", w.Code, motd)
+		if w.Code != e.Expect || motd != e.Motd {
+			t.Fail()
+		}
+	}
+
+	change, _ := srv.GetChange(first, b)
+	t.Logf("Expected: applied by token:bob")
+	t.Logf("Actual  : %s by %s", change.Status, change.Reviewer)
+	if change.Status != confmgr.ChangeApplied || change.Reviewer != "token:bob" {
+		t.Fail()
+	}
+}
+
+func TestChangesReviewRace(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	prefix := srv.Config.Main.KeyPrefix
+	b := &watchBackend{overlay.New(emptyBackend{}), make(map[string]int), nil}
+	b.DeleteKey(prefix + "motd")
+	b.DeleteKey(srv.Config.Main.MetaPrefix + "history:" + prefix + "motd")
+	r := httptest.NewRequest("POST", "/admin/changes", nil)
+
+	create := func() confmgr.ChangeSet {
+		change, err := srv.CreateChange("token:alice", confmgr.ChangeRequest{
+			Title: "motd",
+			Ops:   []confmgr.TxnOp{confmgr.TxnOp{Op: "set", Key: prefix + "motd", Type: "string", Data: "hello"}},
+		}, b)
+		if err != nil {
+			t.Fatalf("ERROR: Cannot create change set: %s", err)
+		}
+		return change
+	}
+	reject := func(change confmgr.ChangeSet) {
+		if _, err := srv.RejectChange(change, "token:carol", "", b); err != nil {
+			t.Fatalf("ERROR: Cannot reject change set: %s", err)
+		}
+	}
+
+	// Approved from a copy read before it was rejected
+	stale := create()
+	reject(stale)
+	_, err := srv.ApproveChange(r, stale, "token:bob", "", b)
+	exists, _ := b.Exists(prefix + "motd")
+	t.Logf("Expected: conflict, motd not written")
+	t.Logf("Actual  : %v, motd written %t", err, exists)
+	if err != backend.ErrConflict || exists {
+		t.Fail()
+	}
+
+	// Rejected while the approval is checked
+	racing := create()
+	b.interleave = func() { reject(racing) }
+	b.writes = make(map[string]int)
+	_, err = srv.ApproveChange(r, racing, "token:bob", "", b)
+	exists, _ = b.Exists(prefix + "motd")
+	change, _ := srv.GetChange(racing.ID, b)
+	t.Logf("Expected: conflict, motd not written, rejected")
+	t.Logf("Actual  : %v, motd written %t, %s", err, exists, change.Status)
+	if err != backend.ErrConflict || exists || change.Status != confmgr.ChangeRejected {
+		t.Fail()
+	}
+
+	// Approved while it is rejected
+	racing = create()
+	b.interleave = func() {
+		if _, err := srv.ApproveChange(r, racing, "token:bob", "", b); err != nil {
+			t.Errorf("ERROR: Cannot approve change set: %s", err)
+		}
+	}
+	_, err = srv.RejectChange(racing, "token:carol", "", b)
+	change, _ = srv.GetChange(racing.ID, b)
+	t.Logf("Expected: conflict, applied")
+	t.Logf("Actual  : %v, %s", err, change.Status)
+	if err != backend.ErrConflict || change.Status != confmgr.ChangeApplied {
+		t.Fail()
+	}
+
+	// Closed change sets are kept for main.change_retention
+	for _, id := range []string{stale.ID, racing.ID} {
+		at, _ := b.GetExpiry(srv.Config.Main.MetaPrefix + "change:" + srv.Namespace + ":" + id)
+		left := time.Until(at)
+		t.Logf("Expected: %s expires in 720h", id)
+		t.Logf("Actual  : %s expires in %s", id, left)
+		if left > 720*time.Hour || left < 719*time.Hour {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package confmgr
+
+import (
+	"fmt"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigOptions(t *testing.T) {
+	cfg := confmgr.DefaultConfig()
+	cfg.Backends = map[string]config.BackendConfig{
+		"redis": config.BackendConfig{Port: 6379, Address: "127.0.0.1"},
+	}
+
+	environ := []string{
+		"PATH=/bin",
+		"CONFMGR_BACKENDS_REDIS_ADDRESS=redis.local",
+		"CONFMGR_MAIN_KEY_PATHS=nodes:%{fqdn}, default",
+		"CONFMGR_MAIN_HIERARCHIES_DB_CREDS=[\"envs:%{env}\"]",
+		"CONFMGR_NAMESPACES_DBTEAM_READ_ONLY=true",
+		"CONFMGR_SCOPE_RULES_SITE_ALLOWED=lon,nyc",
+	}
+	if err := config.ApplyEnv(&cfg, environ); err != nil {
+		t.Fatalf("ERROR: Cannot apply environment: %s", err)
+	}
+
+	type TestEntry struct {
+		Setting string
+		Expect  string
+		Actual  interface{}
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"backends.redis.address", "redis.local", cfg.Backends["redis"].Address},
+		TestEntry{"backends.redis.port", "6379", cfg.Backends["redis"].Port},
+		TestEntry{"main.key_paths", "[nodes:%{fqdn} default]", cfg.Main.KeyPaths},
+		TestEntry{"main.hierarchies", "map[db_creds:[envs:%{env}]]", cfg.Main.Hierarchies},
+		TestEntry{"namespaces.dbteam.read_only", "true", cfg.Namespaces["dbteam"].ReadOnly},
+		TestEntry{"scope.rules.site.allowed", "[lon nyc]", cfg.Scope.Rules["site"].Allowed},
+		TestEntry{"main.hdr_prefix", "x-cfg-", cfg.Main.HdrPrefix},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Setting %s", idx, e.Setting)
+		actual := fmt.Sprintf("%v", e.Actual)
+		t.Logf("  Expected: %s", e.Expect)
+		t.Logf("  Actual  : %s", actual)
+		if actual != e.Expect {
+			t.Fail()
+		}
+	}
+
+	for _, name := range []string{"MAIN_NO_SUCH_SETTING", "LISTEN", "LISTEN_PORT"} {
+		if err := config.SetOption(&cfg, name, "abc"); err == nil {
+			t.Fatalf("Expected error for %s=abc but none occurred", name)
+		}
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	type TestEntry struct {
+		Config string
+		Errors []string
+	}
+
+	backend := "[backends.redis]\nport = 6379\naddress = \"127.0.0.1\"\n"
+	testdata := []TestEntry{
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nkey_paths = [\"sites:%{site}\", \"default\"]\n", []string{}},
+		TestEntry{"[main]\nkey_prefix = \"cfg:\"\n", []string{"backends.redis: section is required"}},
+		TestEntry{backend + "[main]\nkey_prefix = \"\"\n", []string{"main.key_prefix: must not be empty"}},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nkey_path = [\"default\"]\n", []string{"main.key_path: unknown setting"}},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nkey_paths = [\"sites:%{Site}\", \"x:%{y\"]\n", []string{
+			"main.key_paths[0]: invalid token name 'Site' in 'sites:%{Site}'",
+			"main.key_paths[1]: unterminated token in 'x:%{y'",
+		}},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\n[namespaces.meta]\nkey_prefix = \"confmgr:\"\n", []string{"namespaces.meta.key_prefix: 'confmgr:' overlaps with meta_prefix 'confmgr:'"}},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\n[namespaces.meta]\nkey_prefix = \"conf\"\n", []string{"namespaces.meta.key_prefix: 'conf' overlaps with meta_prefix 'confmgr:'"}},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nchange_retention = \"-1h\"\n", []string{"main.change_retention: must not be negative"}},
+	}
+
+	f, err := ioutil.TempFile("", "confmgr-check")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create config file: %s", err)
+	}
+	defer os.Remove(f.Name())
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Checking %q", idx, e.Config)
+		if err := ioutil.WriteFile(f.Name(), []byte(e.Config), 0644); err != nil {
+			t.Fatalf("ERROR: Cannot write config file: %s", err)
+		}
+		err := confmgr.CheckConfig(f.Name(), nil)
+		actual := ""
+		if err != nil {
+			actual = err.Error()
+		}
+		expect := strings.Join(e.Errors, "\n")
+		t.Logf("  Expected: %s", expect)
+		t.Logf("  Actual  : %s", actual)
+		if actual != expect {
+			t.Fail()
+		}
+	}
+}
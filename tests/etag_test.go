@@ -0,0 +1,180 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Fails transactions whose watched keys are written while they are
+// checked, like Redis WATCH. interleave runs once, between check and commit.
+type watchBackend struct {
+	*overlay.ConfigBackendOverlay
+	writes     map[string]int
+	interleave func()
+}
+
+func (b *watchBackend) SetString(key string, value string) error {
+	b.writes[key]++
+	return b.ConfigBackendOverlay.SetString(key, value)
+}
+
+func (b *watchBackend) SetList(key string, value []string) error {
+	b.writes[key]++
+	return b.ConfigBackendOverlay.SetList(key, value)
+}
+
+func (b *watchBackend) Atomic(watch []string, check func() error, apply func(backend.ConfigWriter) error) error {
+	before := make(map[string]int)
+	for _, key := range watch {
+		before[key] = b.writes[key]
+	}
+	if err := check(); err != nil {
+		return err
+	}
+	if b.interleave != nil {
+		interleave := b.interleave
+		b.interleave = nil
+		interleave()
+	}
+	for _, key := range watch {
+		if b.writes[key] != before[key] {
+			return backend.ErrConflict
+		}
+	}
+	return b.ConfigBackendOverlay.Atomic(nil, func() error { return nil }, func(w backend.ConfigWriter) error {
+		return apply(watchWriter{w, b.writes})
+	})
+}
+
+// Counts the writes of a transaction for the transactions watching them
+type watchWriter struct {
+	backend.ConfigWriter
+	writes map[string]int
+}
+
+func (w watchWriter) SetString(key string, value string) error {
+	w.writes[key]++
+	return w.ConfigWriter.SetString(key, value)
+}
+
+func (w watchWriter) SetList(key string, value []string) error {
+	w.writes[key]++
+	return w.ConfigWriter.SetList(key, value)
+}
+
+func TestETags(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyHistory = 0
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(nil)
+	b.DeleteKey(cfg.Main.KeyPrefix + "app")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Method string
+		Path   string
+		Body   string
+		Header string
+		// Name of a tag saved from an earlier response, or a literal value
+		Tag    string
+		Expect int
+		// Save the response's ETag under this name
+		Save string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"POST", "/admin/key/app", `{"type":"hash","data":{"a":"1"}}`, "If-Match", "*", http.StatusPreconditionFailed, ""},
+		TestEntry{"POST", "/admin/key/app", `{"type":"hash","data":{"a":"1"}}`, "", "", http.StatusOK, "v1"},
+		TestEntry{"GET", "/admin/key/app", "", "If-None-Match", "v1", http.StatusNotModified, ""},
+		TestEntry{"GET", "/admin/key/app/a", "", "If-None-Match", "v1", http.StatusNotModified, ""},
+		TestEntry{"POST", "/admin/key/app/b", `{"data":"2"}`, "If-Match", "v1", http.StatusOK, "v2"},
+		TestEntry{"POST", "/admin/key/app", `{"type":"hash","data":{}}`, "If-Match", "v1", http.StatusPreconditionFailed, ""},
+		TestEntry{"GET", "/admin/key/app", "", "If-None-Match", "v1", http.StatusOK, ""},
+		TestEntry{"DELETE", "/admin/key/app", "", "If-Match", "W/v2", http.StatusPreconditionFailed, ""},
+		TestEntry{"DELETE", "/admin/key/app", "", "If-Match", "v2", http.StatusOK, ""},
+	}
+
+	etags := make(map[string]string)
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s %s: %s", idx, e.Method, e.Path, e.Header, e.Tag)
+		r := httptest.NewRequest(e.Method, e.Path, strings.NewReader(e.Body))
+		if e.Header != "" {
+			tag := e.Tag
+			if saved, ok := etags[strings.TrimPrefix(tag, "W/")]; ok {
+				tag = strings.Replace(tag, strings.TrimPrefix(tag, "W/"), saved, 1)
+			}
+			r.Header.Set(e.Header, tag)
+		}
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d", w.Code)
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+		if e.Save != "" {
+			etags[e.Save] = w.Header().Get("ETag")
+		}
+	}
+}
+
+func TestETagRace(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyHistory = 0
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	key := cfg.Main.KeyPrefix + "motd"
+	b := &watchBackend{overlay.New(nil), make(map[string]int), nil}
+	b.SetString(key, "v1")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/key/motd", nil))
+	etag := w.Header().Get("ETag")
+
+	type TestEntry struct {
+		IfMatch string
+		Expect  int
+		Value   string
+	}
+
+	// Another client stores "other" after the ETag was compared
+	testdata := []TestEntry{
+		TestEntry{etag, http.StatusPreconditionFailed, "other"},
+		TestEntry{"", http.StatusOK, "mine"},
+	}
+
+	for idx, e := range testdata {
+		b.SetString(key, "v1")
+		b.interleave = func() { b.SetString(key, "other") }
+		r := httptest.NewRequest("POST", "/admin/key/motd", strings.NewReader(`{"type":"string","data":"mine"}`))
+		if e.IfMatch != "" {
+			r.Header.Set("If-Match", e.IfMatch)
+		}
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		value, _ := b.GetString(key)
+		t.Logf("Test %d: If-Match '%s'", idx, e.IfMatch)
+		t.Logf("  Expected: %d, value '%s'", e.Expect, e.Value)
+		t.Logf("  Actual  : %d, value '%s'", w.Code, value)
+		if w.Code != e.Expect || value != e.Value {
+			t.Fail()
+		}
+	}
+}
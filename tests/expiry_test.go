@@ -0,0 +1,169 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyExpiry(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyHistory = 0
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	b.DeleteKey(cfg.Main.KeyPrefix + "debug")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Method string
+		Path   string
+		Body   string
+		Expect int
+		TTL    int
+	}
+
+	// TTLs are checked within a few seconds, the clock runs between requests
+	value := `{"type": "string", "data": "on"}`
+	txn := `{"ops": [{"op": "set", "key": "debug", "type": "string", "data": "on", "ttl": "1h"}]}`
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	testdata := []TestEntry{
+		TestEntry{"POST", "/admin/key/debug?ttl=1h", value, http.StatusOK, 0},
+		TestEntry{"GET", "/admin/key/debug", "", http.StatusOK, 3600},
+		TestEntry{"POST", "/admin/key/debug?ttl=90", value, http.StatusOK, 0},
+		TestEntry{"GET", "/admin/key/debug", "", http.StatusOK, 90},
+		TestEntry{"POST", "/admin/key/debug?ttl=forever", value, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/key/debug?expires_at=" + past, value, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/key/debug?ttl=1h&expires_at=" + past, value, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/key/debug", value, http.StatusOK, 0},
+		TestEntry{"GET", "/admin/key/debug", "", http.StatusOK, 0},
+		TestEntry{"POST", "/admin/txn", txn, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/txn?ttl=1h", `{"ops": [{"op": "delete", "key": "debug"}]}`, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/changes", txn, http.StatusBadRequest, 0},
+		TestEntry{"POST", "/admin/schedule?ttl=1h", `{"ops": [{"op": "delete", "key": "debug"}]}`, http.StatusBadRequest, 0},
+		TestEntry{"GET", "/admin/key/debug", "", http.StatusOK, 0},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s", idx, e.Method, e.Path)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest(e.Method, e.Path, strings.NewReader(e.Body)))
+		header := w.Header().Get("X-Confmgr-TTL")
+		ttl, _ := strconv.Atoi(header)
+		t.Logf("  Expected: %d, ttl %d", e.Expect, e.TTL)
+		t.Logf("  Actual  : %d, ttl '%s'", w.Code, header)
+		if w.Code != e.Expect || (e.TTL == 0 && header != "") || (e.TTL > 0 && (ttl > e.TTL || ttl < e.TTL-5)) {
+			t.Fail()
+		}
+	}
+
+	// Expired keys are gone for lookups and admin reads alike
+	b.SetExpiry(cfg.Main.KeyPrefix+"debug", time.Now().Add(-time.Second))
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/key/debug", nil))
+	t.Logf("Expired: Expected %d, Actual %d", http.StatusNotFound, w.Code)
+	if w.Code != http.StatusNotFound {
+		t.Fail()
+	}
+}
+
+func TestKeyExpiryRecorded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confmgr-expiry")
+	if err != nil {
+		t.Fatalf("ERROR: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Audit.Sink = "file"
+	cfg.Audit.File = filepath.Join(dir, "audit.jsonl")
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	keyName := cfg.Main.KeyPrefix + "servers"
+	b := overlay.New(emptyBackend{})
+	b.DeleteKey(keyName)
+	b.DeleteKey(cfg.Main.MetaPrefix + "history:" + keyName)
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	request := func(method string, path string, body string, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("ERROR: %s %s: %d %s", method, path, w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	// Appends keep the expiry of the list, storing it again removes it
+	request("POST", "/admin/key/servers?ttl=1h", `{"type": "list", "data": ["web1"]}`, "")
+	request("PATCH", "/admin/key/append/servers", `{"data": "web2"}`, "")
+
+	w := request("GET", "/admin/key/servers", "", "")
+	var resp struct {
+		Data      []string  `json:"data"`
+		ExpiresAt time.Time `json:"expires_at"`
+		TTL       int       `json:"ttl"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	t.Logf("JSON: Expected 2 entries, expires_at set, ttl 3600")
+	t.Logf("JSON: Actual   %s", w.Body.String())
+	if len(resp.Data) != 2 || resp.ExpiresAt.IsZero() || resp.TTL > 3600 || resp.TTL < 3595 {
+		t.Fail()
+	}
+	etag := w.Header().Get("ETag")
+
+	w = request("GET", "/admin/key/servers", "", "text/plain")
+	t.Logf("Text: Expected the list and the expiry")
+	t.Logf("Text: Actual   %s", w.Body.String())
+	if !strings.HasPrefix(w.Body.String(), "web1\nweb2\n# expires_at: "+resp.ExpiresAt.UTC().Format(time.RFC3339)) {
+		t.Fail()
+	}
+
+	// The tag only covers the key, so it stays usable for If-Match
+	r := httptest.NewRequest("POST", "/admin/key/servers", strings.NewReader(`{"type": "list", "data": ["web3"]}`))
+	r.Header.Set("If-Match", etag)
+	w = httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, r)
+	t.Logf("If-Match: Expected %d, Actual %d", http.StatusOK, w.Code)
+	if w.Code != http.StatusOK {
+		t.Fail()
+	}
+
+	history, _ := srv.KeyHistory(keyName, b)
+	entries, _ := srv.Audit.Query(confmgr.AuditFilter{Key: keyName}, b)
+	expect := []bool{true, true, false}
+	t.Logf("Expected: expires_at on %v", expect)
+	if len(history) != len(expect) || len(entries) != len(expect) {
+		t.Fatalf("ERROR: %d versions, %d audit entries", len(history), len(entries))
+	}
+	for idx, expires := range expect {
+		t.Logf("  Actual  : version %d %v, audit %v", history[idx].Version, history[idx].ExpiresAt, entries[idx].ExpiresAt)
+		if (history[idx].ExpiresAt != nil) != expires || (entries[idx].ExpiresAt != nil) != expires {
+			t.Fail()
+		}
+	}
+	if history[0].ExpiresAt != nil && !history[0].ExpiresAt.Truncate(time.Second).Equal(resp.ExpiresAt) {
+		t.Fail()
+	}
+}
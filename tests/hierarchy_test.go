@@ -0,0 +1,237 @@
+package confmgr
+
+import (
+	"fmt"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"strings"
+	"testing"
+)
+
+func TestSearchPaths(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{
+		"nodes:%{fqdn}",
+		"apps:%{app}:%{env?}",
+		"regions:%{region} when site =~ ^us-",
+		"legacy when site != lon and pod == a",
+		"sites:%{site}",
+		"default",
+	}
+	cfg.Main.Derived = map[string]config.DerivedTokenConfig{
+		"region": config.DerivedTokenConfig{
+			From: "site",
+			Map:  map[string]string{"us-east": "useast"},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	type TestEntry struct {
+		Scope  map[string]string
+		Expect string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{
+			map[string]string{},
+			"default",
+		},
+		TestEntry{
+			map[string]string{"site": "lon", "fqdn": "web01"},
+			"default sites:lon nodes:web01",
+		},
+		TestEntry{
+			map[string]string{"site": "us-east"},
+			"default sites:us-east regions:useast",
+		},
+		TestEntry{
+			map[string]string{"site": "us-west", "region": "west"},
+			"default sites:us-west regions:west",
+		},
+		TestEntry{
+			map[string]string{"site": "nyc", "pod": "a", "app": "shop"},
+			"default sites:nyc legacy apps:shop",
+		},
+		TestEntry{
+			map[string]string{"app": "shop", "env": "prod"},
+			"default apps:shop:prod",
+		},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Search paths for %q", idx, e.Scope)
+		actual := strings.Join(srv.SearchPaths(e.Scope), " ")
+		t.Logf("  Expected: %s", e.Expect)
+		t.Logf("  Actual  : %s", actual)
+		if actual != e.Expect {
+			t.Fail()
+		}
+	}
+}
+
+func TestInvalidHierarchy(t *testing.T) {
+	invalid := []string{
+		"sites:%{site",
+		"sites:%{Site}",
+		"sites:%{site} when site ~ lon",
+		"sites:%{site} when site =~ ^(lon",
+	}
+
+	for _, path := range invalid {
+		t.Logf("Testing invalid key path '%s'", path)
+		if _, err := confmgr.NewHierarchy([]string{path}, nil); err == nil {
+			t.Fatalf("Expected error for key path '%s' but none occurred", path)
+		}
+	}
+}
+
+func TestNamedHierarchies(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{
+		"nodes:%{fqdn}",
+		"default",
+	}
+	cfg.Main.Hierarchies = map[string][]string{
+		"dbcreds": []string{"env:%{env}"},
+	}
+	cfg.Main.HierarchyRules = []config.HierarchyRuleConfig{
+		config.HierarchyRuleConfig{Keys: "db_*", Hierarchy: "dbcreds"},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	scope := map[string]string{"fqdn": "web01", "env": "prod"}
+
+	type TestEntry struct {
+		Key    string
+		Scope  map[string]string
+		Expect string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"app", scope, "default nodes:web01"},
+		TestEntry{"db_main", scope, "env:prod"},
+		TestEntry{"app", map[string]string{"env": "prod", confmgr.HierarchyScopeKey: "dbcreds"}, "env:prod"},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Search paths for key %s with %q", idx, e.Key, e.Scope)
+		actual := strings.Join(srv.SearchPathsFor(e.Key, e.Scope), " ")
+		t.Logf("  Expected: %s", e.Expect)
+		t.Logf("  Actual  : %s", actual)
+		if actual != e.Expect {
+			t.Fail()
+		}
+	}
+
+	cfg.Main.HierarchyRules[0].Hierarchy = "missing"
+	if err := srv.ApplyConfig(cfg); err == nil {
+		t.Fatal("Expected error for rule with unknown hierarchy but none occurred")
+	}
+}
+
+func TestStoreHierarchy(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"default"}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	// Nothing stored yet, reads must not reach the missing backend
+	b := overlay.New(nil)
+	b.DeleteKey(cfg.Main.MetaPrefix + "hierarchy:default:default")
+
+	if _, err := srv.StoreHierarchy("default", []string{"sites:%{site"}, b); err == nil {
+		t.Fatal("Expected error for invalid key path but none occurred")
+	}
+
+	scope := map[string]string{"site": "lon"}
+
+	type TestEntry struct {
+		Version int
+		Expect  string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{2, "default sites:lon"},
+		TestEntry{3, "default"},
+	}
+
+	for idx, e := range testdata {
+		var version confmgr.HierarchyVersion
+		var err error
+		if idx == 0 {
+			version, err = srv.StoreHierarchy("default", []string{"sites:%{site}", "default"}, b)
+		} else {
+			version, err = srv.RevertHierarchy("default", 1, b)
+		}
+		if err != nil {
+			t.Fatalf("ERROR: Cannot store hierarchy: %s", err)
+		}
+		actual := strings.Join(srv.SearchPaths(scope), " ")
+		t.Logf("Test %d: Activated version %d", idx, version.Version)
+		t.Logf("  Expected: %d / %s", e.Version, e.Expect)
+		t.Logf("  Actual  : %d / %s", version.Version, actual)
+		if version.Version != e.Version || actual != e.Expect {
+			t.Fail()
+		}
+	}
+
+	history, err := srv.HierarchyHistory("default", b)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot read hierarchy history: %s", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 versions in history, got %d", len(history))
+	}
+}
+
+func TestStoreHierarchyRace(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"default"}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	key := cfg.Main.MetaPrefix + "hierarchy:default:default"
+	b := &watchBackend{overlay.New(nil), make(map[string]int), nil}
+	b.DeleteKey(key)
+
+	// Another instance stores version 2 while this one is checking
+	b.interleave = func() {
+		b.SetList(key, []string{`{"version": 1, "paths": ["default"]}`, `{"version": 2, "paths": ["pods:%{pod}", "default"]}`})
+	}
+	if _, err := srv.StoreHierarchy("default", []string{"sites:%{site}", "default"}, b); err != backend.ErrConflict {
+		t.Fatalf("Expected a conflict storing a hierarchy concurrently, got %v", err)
+	}
+
+	version, err := srv.StoreHierarchy("default", []string{"sites:%{site}", "default"}, b)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot store hierarchy: %s", err)
+	}
+	history, err := srv.HierarchyHistory("default", b)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot read hierarchy history: %s", err)
+	}
+
+	versions := make([]string, len(history))
+	for idx, entry := range history {
+		versions[idx] = fmt.Sprintf("%d:%s", entry.Version, strings.Join(entry.Paths, ","))
+	}
+	expect := "1:default 2:pods:%{pod},default 3:sites:%{site},default"
+	t.Logf("Stored version %d", version.Version)
+	t.Logf("  Expected: %s", expect)
+	t.Logf("  Actual  : %s", strings.Join(versions, " "))
+	if version.Version != 3 || strings.Join(versions, " ") != expect {
+		t.Fail()
+	}
+}
@@ -0,0 +1,96 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/vars"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Has a string at every key, none of which can be read
+type brokenBackend struct {
+	emptyBackend
+}
+
+func (e brokenBackend) Exists(key string) (bool, error) {
+	return true, nil
+}
+
+func (e brokenBackend) GetType(key string) (int, error) {
+	return vars.TYPE_STRING, nil
+}
+
+func (e brokenBackend) GetString(key string) (string, error) {
+	return "", fmt.Errorf("%s is unreadable", key)
+}
+
+func (e brokenBackend) GetHash(key string) (map[string]string, error) {
+	return nil, fmt.Errorf("%s is unreadable", key)
+}
+
+func TestImpact(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"sites:%{site}", "default"}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	// Only keys of the broken site reach the backend
+	b := overlay.New(brokenBackend{})
+	for _, site := range []string{"lon", "ams"} {
+		b.DeleteKey(cfg.Main.KeyPrefix + "sites:" + site + ":motd")
+	}
+	b.DeleteKey(cfg.Main.MetaPrefix + "registry:host1")
+	b.SetString(cfg.Main.KeyPrefix+"default:motd", "old")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Key     string
+		Body    string
+		Expect  int
+		Changed []bool
+		Errors  []int
+	}
+
+	write := `{"type": "string", "data": "new", "scopes": %s}`
+	testdata := []TestEntry{
+		TestEntry{"sites:lon:motd", fmt.Sprintf(write, `[{"site": "lon"}, {"site": "ams"}]`), http.StatusOK, []bool{true, false}, []int{0, 0}},
+		TestEntry{"default:motd", fmt.Sprintf(write, `[{"site": "lon"}, {"fqdn": "host1", "site": "ams"}]`), http.StatusOK, []bool{true, true}, []int{0, 0}},
+		TestEntry{"sites:lon:motd", fmt.Sprintf(write, `[{"site": "broken"}]`), http.StatusOK, []bool{false}, []int{2}},
+		TestEntry{"sites:lon:motd", `{"type": "string"`, http.StatusBadRequest, nil, nil},
+		TestEntry{"elsewhere:motd", fmt.Sprintf(write, `[{"site": "lon"}]`), http.StatusBadRequest, nil, nil},
+		TestEntry{"sites:lon:motd", `{"type": "set", "data": "new", "scopes": [{"site": "lon"}]}`, http.StatusBadRequest, nil, nil},
+		TestEntry{"sites:lon:motd", fmt.Sprintf(write, `[{"site": "lon:1"}]`), http.StatusBadRequest, nil, nil},
+		TestEntry{"sites:lon:motd", fmt.Sprintf(write, `[]`), http.StatusBadRequest, nil, nil},
+		TestEntry{"sites:lon:motd", fmt.Sprintf(write, `[{"fqdn": "broken"}]`), http.StatusInternalServerError, nil, nil},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: impact of %s %s", idx, e.Key, e.Body)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/impact/"+e.Key, strings.NewReader(e.Body)))
+		var resp confmgr.ImpactResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		changed := make([]bool, len(resp.Data))
+		errors := make([]int, len(resp.Data))
+		for i, impact := range resp.Data {
+			changed[i] = impact.Changed
+			if impact.Error != "" {
+				errors[i] = len(strings.Split(impact.Error, "; "))
+			}
+		}
+		t.Logf("  Expected: %d, changed %v, errors %v", e.Expect, e.Changed, e.Errors)
+		t.Logf("  Actual  : %d, changed %v, errors %v %s", w.Code, changed, errors, w.Body.String())
+		if w.Code != e.Expect || fmt.Sprint(changed) != fmt.Sprint(e.Changed) || fmt.Sprint(errors) != fmt.Sprint(e.Errors) {
+			t.Fail()
+		}
+	}
+}
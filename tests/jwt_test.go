@@ -0,0 +1,102 @@
+package confmgr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signJWT(secret string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuth(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		JWT: config.JWTConfig{
+			Algorithm: "HS256",
+			Secret:    "s3cret",
+			Issuer:    "sso",
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	type TestEntry struct {
+		Token  string
+		Expect int
+	}
+
+	testdata := []TestEntry{
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": exp}), http.StatusOK},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": exp,
+			"permissions": []string{"read:confmgr:hierarchy:*"}}), http.StatusOK},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": exp,
+			"permissions": []string{"read:cfg:*"}}), http.StatusForbidden},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": time.Now().Add(-time.Hour).Unix()}), http.StatusUnauthorized},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "other", "exp": exp}), http.StatusUnauthorized},
+		TestEntry{signJWT("wrong", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": exp}), http.StatusUnauthorized},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"iss": "sso", "exp": exp}), http.StatusUnauthorized},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso"}), http.StatusUnauthorized},
+		TestEntry{signJWT("s3cret", map[string]interface{}{"sub": "deploy", "iss": "sso", "exp": "never"}), http.StatusUnauthorized},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: GET /admin/hierarchy with token %s", idx, e.Token)
+		r := httptest.NewRequest("GET", "/admin/hierarchy", nil)
+		r.Header.Set("Authorization", "Bearer "+e.Token)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d", w.Code)
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+	}
+}
+
+func TestJWTScope(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		JWT:     config.JWTConfig{Algorithm: "HS256", Secret: "s3cret"},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	client := map[string]string{"env": "dev", "fqdn": "host1"}
+	token := map[string]string{"env": "prod"}
+
+	scope, err := srv.TrustedScope(client, token)
+	t.Logf("Expected: env=prod fqdn=host1")
+	t.Logf("Actual  : env=%s fqdn=%s", scope["env"], scope["fqdn"])
+	if err != nil || scope["env"] != "prod" || scope["fqdn"] != "host1" {
+		t.Fail()
+	}
+
+	srv.Auth.JWT.StrictScope = true
+	scope, err = srv.TrustedScope(client, token)
+	t.Logf("Expected: env=prod fqdn=")
+	t.Logf("Actual  : env=%s fqdn=%s", scope["env"], scope["fqdn"])
+	if err != nil || scope["env"] != "prod" || scope["fqdn"] != "" {
+		t.Fail()
+	}
+}
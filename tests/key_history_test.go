@@ -0,0 +1,108 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Hands out the same in-memory backend for every request
+type overlayFactory struct {
+	b backend.ConfigBackend
+}
+
+func (f overlayFactory) NewBackend() backend.ConfigBackend {
+	return f.b
+}
+
+func (f overlayFactory) Close() {
+}
+
+func TestKeyHistory(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyHistory = 3
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(nil)
+	b.DeleteKey(cfg.Main.KeyPrefix + "app")
+	b.DeleteKey(cfg.Main.MetaPrefix + "history:" + cfg.Main.KeyPrefix + "app")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Method   string
+		Path     string
+		Body     string
+		Expect   int
+		Versions []int
+		Value    string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"POST", "/admin/key/app", `{"type":"string","data":"v1"}`, http.StatusOK, []int{1}, "v1"},
+		TestEntry{"POST", "/admin/key/app", `{"type":"string","data":"v2"}`, http.StatusOK, []int{1, 2}, "v2"},
+		TestEntry{"DELETE", "/admin/key/app", "", http.StatusOK, []int{1, 2, 3}, ""},
+		TestEntry{"POST", "/admin/key/app/rollback/2", "", http.StatusOK, []int{2, 3, 4}, "v2"},
+		TestEntry{"POST", "/admin/key/app/rollback/1", "", http.StatusNotFound, []int{2, 3, 4}, "v2"},
+		TestEntry{"POST", "/admin/key/app/rollback/3", "", http.StatusOK, []int{3, 4, 5}, ""},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s %s", idx, e.Method, e.Path, e.Body)
+		r := httptest.NewRequest(e.Method, e.Path, strings.NewReader(e.Body))
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d", w.Code)
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+
+		w = httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/history/key/app", nil))
+		var resp confmgr.KeyHistoryResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("ERROR: Invalid history response %d: %s", w.Code, w.Body.String())
+		}
+		versions := make([]int, len(resp.Data))
+		for i, version := range resp.Data {
+			versions[i] = version.Version
+		}
+		value, _ := b.GetString(cfg.Main.KeyPrefix + "app")
+		t.Logf("  Expected: versions %v, value '%s'", e.Versions, e.Value)
+		t.Logf("  Actual  : versions %v, value '%s'", versions, value)
+		if !compareIntSlices(versions, e.Versions) || value != e.Value {
+			t.Fail()
+		}
+	}
+
+	// History lives outside /admin/key, so no hash field name is shadowed
+	b.SetHash(cfg.Main.KeyPrefix+"app", map[string]string{"history": "kept"})
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/key/app/history", nil))
+	t.Logf("Field 'history': Expected %d 'kept', Actual %d '%s'", http.StatusOK, w.Code, strings.TrimSpace(w.Body.String()))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "kept") {
+		t.Fail()
+	}
+}
+
+func compareIntSlices(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return false
+		}
+	}
+	return true
+}
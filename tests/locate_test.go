@@ -0,0 +1,141 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseKey(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{
+		"nodes:%{fqdn}",
+		"sites:%{site}:groups:%{group}",
+		"sites:%{site}",
+		"default",
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	type TestEntry struct {
+		Key    string
+		Level  string
+		Name   string
+		Tokens map[string]string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{
+			"cfg:sites:lon:db",
+			"sites:%{site}",
+			"db",
+			map[string]string{"site": "lon"},
+		},
+		TestEntry{
+			"cfg:sites:lon:groups:web:db",
+			"sites:%{site}:groups:%{group}",
+			"db",
+			map[string]string{"site": "lon", "group": "web"},
+		},
+		TestEntry{
+			"cfg:default:db",
+			"default",
+			"db",
+			map[string]string{},
+		},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Parsing key '%s'", idx, e.Key)
+		location, ok := srv.ParseKey(e.Key)
+		if !ok {
+			t.Fatalf("Key %s did not match any level", e.Key)
+		}
+		t.Logf("  Expected: %s / %s / %q", e.Level, e.Name, e.Tokens)
+		t.Logf("  Actual  : %s / %s / %q", location.Level, location.Name, location.Tokens)
+		if location.Level != e.Level || location.Name != e.Name || len(location.Tokens) != len(e.Tokens) {
+			t.Fail()
+			continue
+		}
+		for token, value := range e.Tokens {
+			if location.Tokens[token] != value {
+				t.Fail()
+			}
+		}
+	}
+
+	if _, ok := srv.ParseKey("cfg:unknown:db"); ok {
+		t.Fatal("Expected no match for key outside of hierarchy")
+	}
+}
+
+func TestLocateKey(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{
+		"nodes:%{fqdn}",
+		"sites:%{site}",
+		"default",
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	for _, key := range []string{"nodes:web1:db", "sites:lon:db", "default:db", "unknown:db", "default:dbx", "sites:lon:other"} {
+		b.SetString(cfg.Main.KeyPrefix+key, key)
+	}
+
+	type TestEntry struct {
+		Name   string
+		Levels []string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"db", []string{"default", "nodes:%{fqdn}", "sites:%{site}", ""}},
+		TestEntry{"other", []string{"sites:%{site}"}},
+		TestEntry{"missing", []string{}},
+	}
+
+	for idx, e := range testdata {
+		resp, err := srv.LocateKey(e.Name, b)
+		if err != nil {
+			t.Fatalf("ERROR: Cannot locate %s: %s", e.Name, err)
+		}
+		levels := make([]string, len(resp.Data))
+		for i, entry := range resp.Data {
+			levels[i] = entry.Level
+		}
+		t.Logf("Test %d: locating '%s'", idx, e.Name)
+		t.Logf("  Expected: %q", e.Levels)
+		t.Logf("  Actual  : %q", levels)
+		if strings.Join(levels, ",") != strings.Join(e.Levels, ",") {
+			t.Fail()
+		}
+	}
+
+	// Key names are not globs
+	for _, name := range []string{"d*", "d?", "[d]b", "d\\b"} {
+		_, err := srv.LocateKey(name, b)
+		_, ok := err.(confmgr.LocateError)
+		t.Logf("Locating '%s': Expected LocateError, Actual %v", name, err)
+		if !ok {
+			t.Fail()
+		}
+	}
+
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/locate/d*", nil))
+	t.Logf("GET /admin/locate/d*: Expected %d, Actual %d", http.StatusBadRequest, w.Code)
+	if w.Code != http.StatusBadRequest {
+		t.Fail()
+	}
+}
@@ -0,0 +1,123 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Namespaces = map[string]config.NamespaceConfig{
+		"dbteam": config.NamespaceConfig{
+			KeyPrefix: "db:",
+			KeyPaths:  []string{"envs:%{env}"},
+			ReadOnly:  true,
+		},
+		"internal": config.NamespaceConfig{
+			KeyPrefix: "internal:",
+			KeyPaths:  []string{"default"},
+			Allow:     []string{"10.0.0.0/8"},
+		},
+		"web": config.NamespaceConfig{
+			KeyPrefix: "web:",
+			KeyPaths:  []string{"default"},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	ns := srv.Namespaces["dbteam"]
+	if ns == nil || ns.Config.Main.KeyPrefix != "db:" {
+		t.Fatal("Namespace dbteam was not set up with its own key prefix")
+	}
+
+	type TestEntry struct {
+		Method string
+		Path   string
+		Client string
+		Expect int
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"GET", "/ns/unknown/hash/db", "192.0.2.1:1234", http.StatusNotFound},
+		TestEntry{"DELETE", "/ns/dbteam/admin/key/db", "192.0.2.1:1234", http.StatusForbidden},
+		TestEntry{"GET", "/ns/internal/hash/db", "192.0.2.1:1234", http.StatusForbidden},
+		TestEntry{"POST", "/ns/web/admin/registry/host1", "192.0.2.1:1234", http.StatusForbidden},
+		TestEntry{"DELETE", "/ns/web/admin/registry/host1", "192.0.2.1:1234", http.StatusForbidden},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s from %s", idx, e.Method, e.Path, e.Client)
+		r := httptest.NewRequest(e.Method, e.Path, nil)
+		r.RemoteAddr = e.Client
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d", w.Code)
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+	}
+
+	cfg.Namespaces["overlap"] = config.NamespaceConfig{KeyPrefix: "cfg:x:"}
+	if err := srv.ApplyConfig(cfg); err == nil {
+		t.Fatal("Expected error for overlapping key prefixes but none occurred")
+	}
+
+	delete(cfg.Namespaces, "overlap")
+	cfg.Namespaces["meta"] = config.NamespaceConfig{KeyPrefix: cfg.Main.MetaPrefix + "registry:"}
+	if err := srv.ApplyConfig(cfg); err == nil {
+		t.Fatal("Expected error for a key prefix overlapping meta_prefix but none occurred")
+	}
+}
+
+func TestNamespaceListKeys(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Namespaces = map[string]config.NamespaceConfig{
+		"dbteam": config.NamespaceConfig{KeyPrefix: "db:", KeyPaths: []string{"default"}},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	for _, key := range []string{"cfg:motd", "cfg:default:motd", "db:default:host", cfg.Main.MetaPrefix + "history:db:default:host", cfg.Main.MetaPrefix + "registry:host1"} {
+		b.SetString(key, "value")
+	}
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Path   string
+		Expect []string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"/admin/keys", []string{"default:motd", "motd"}},
+		TestEntry{"/ns/dbteam/admin/keys", []string{"default:host"}},
+		TestEntry{"/ns/dbteam/admin/keys/*", []string{"default:host"}},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s", idx, e.Path)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("GET", e.Path, nil))
+		var resp confmgr.ListKeyResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		t.Logf("  Expected: %d %s", http.StatusOK, strings.Join(e.Expect, " "))
+		t.Logf("  Actual  : %d %s", w.Code, strings.Join(resp.Data, " "))
+		if w.Code != http.StatusOK || strings.Join(resp.Data, " ") != strings.Join(e.Expect, " ") {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr/backends/overlay"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOverlayListKeys(t *testing.T) {
+	b := overlay.New(emptyBackend{})
+	for _, key := range []string{"cfg:a/b", "cfg:ab", "cfg:ac", "cfg:ad", "cfg:[x]", "cfg:gone"} {
+		b.SetString(key, "value")
+	}
+	b.DeleteKey("cfg:gone")
+
+	type TestEntry struct {
+		Filter string
+		Expect []string
+	}
+
+	// Redis KEYS semantics, '/' is not special
+	testdata := []TestEntry{
+		TestEntry{"", []string{"cfg:[x]", "cfg:a/b", "cfg:ab", "cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:a*", []string{"cfg:a/b", "cfg:ab", "cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:a?b", []string{"cfg:a/b"}},
+		TestEntry{"cfg:a?", []string{"cfg:ab", "cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:a[bc]", []string{"cfg:ab", "cfg:ac"}},
+		TestEntry{"cfg:a[^b]", []string{"cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:a[c-d]", []string{"cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:a[d-c]", []string{"cfg:ac", "cfg:ad"}},
+		TestEntry{"cfg:\\[x\\]", []string{"cfg:[x]"}},
+		TestEntry{"cfg:[[]x*", []string{"cfg:[x]"}},
+		TestEntry{"cfg:a[b", []string{"cfg:ab"}},
+		TestEntry{"cfg:**b", []string{"cfg:a/b", "cfg:ab"}},
+		TestEntry{"cfg:gone", []string{}},
+	}
+
+	for idx, e := range testdata {
+		keys, err := b.ListKeys(e.Filter)
+		if err != nil {
+			t.Fatalf("ERROR: Cannot list keys: %s", err)
+		}
+		sort.Strings(keys)
+		t.Logf("Test %d: filter '%s'", idx, e.Filter)
+		t.Logf("  Expected: %s", strings.Join(e.Expect, " "))
+		t.Logf("  Actual  : %s", strings.Join(keys, " "))
+		if strings.Join(keys, " ") != strings.Join(e.Expect, " ") {
+			t.Fail()
+		}
+	}
+}
+
+func TestOverlayIsolation(t *testing.T) {
+	base := overlay.New(emptyBackend{})
+	base.SetString("cfg:motd", "live")
+	base.SetHash("cfg:db", map[string]string{"host": "db1"})
+
+	staged := overlay.New(base)
+	staged.SetString("cfg:motd", "staged")
+	staged.SetHashField("cfg:db", "port", "5432")
+	staged.DeleteKey("cfg:db")
+	staged.SetList("cfg:groups", []string{"web"})
+
+	type TestEntry struct {
+		Key    string
+		Staged string
+		Live   string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"cfg:motd", "staged", "live"},
+		TestEntry{"cfg:db", "", "db1"},
+		TestEntry{"cfg:groups", "web", ""},
+	}
+
+	read := func(b *overlay.ConfigBackendOverlay, key string) string {
+		if exists, _ := b.Exists(key); !exists {
+			return ""
+		}
+		switch key {
+		case "cfg:db":
+			value, _ := b.GetHashField(key, "host")
+			return value
+		case "cfg:groups":
+			value, _ := b.GetListIndex(key, 0)
+			return value
+		}
+		value, _ := b.GetString(key)
+		return value
+	}
+
+	// Keys never written to the base fall through to emptyBackend
+	base.DeleteKey("cfg:groups")
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s", idx, e.Key)
+		t.Logf("  Expected: staged '%s', live '%s'", e.Staged, e.Live)
+		t.Logf("  Actual  : staged '%s', live '%s'", read(staged, e.Key), read(base, e.Key))
+		if read(staged, e.Key) != e.Staged || read(base, e.Key) != e.Live {
+			t.Fail()
+		}
+	}
+}
+
+func TestOverlayListRange(t *testing.T) {
+	b := overlay.New(emptyBackend{})
+	b.SetList("cfg:list", []string{"a", "b", "c", "d", "e"})
+
+	type TestEntry struct {
+		Start  int64
+		Stop   int64
+		Expect []string
+	}
+
+	// Redis LRANGE semantics
+	testdata := []TestEntry{
+		TestEntry{0, -1, []string{"a", "b", "c", "d", "e"}},
+		TestEntry{1, 2, []string{"b", "c"}},
+		TestEntry{-2, -1, []string{"d", "e"}},
+		TestEntry{-10, 1, []string{"a", "b"}},
+		TestEntry{3, 10, []string{"d", "e"}},
+		TestEntry{-20, -10, []string{}},
+		TestEntry{3, 1, []string{}},
+	}
+
+	for idx, e := range testdata {
+		list, err := b.GetListRange("cfg:list", e.Start, e.Stop)
+		if err != nil {
+			t.Fatalf("ERROR: Cannot get list range: %s", err)
+		}
+		t.Logf("Test %d: range %d %d", idx, e.Start, e.Stop)
+		t.Logf("  Expected: %s", strings.Join(e.Expect, " "))
+		t.Logf("  Actual  : %s", strings.Join(list, " "))
+		if strings.Join(list, " ") != strings.Join(e.Expect, " ") {
+			t.Fail()
+		}
+	}
+
+	b.ListTrim("cfg:list", -2, -1)
+	list, _ := b.GetList("cfg:list")
+	t.Logf("Expected: d e after trim")
+	t.Logf("Actual  : %s", strings.Join(list, " "))
+	if strings.Join(list, " ") != "d e" {
+		t.Fail()
+	}
+
+	b.ListTrim("cfg:list", 5, 10)
+	exists, _ := b.Exists("cfg:list")
+	t.Logf("Expected: empty list removed")
+	t.Logf("Actual  : exists %t", exists)
+	if exists {
+		t.Fail()
+	}
+}
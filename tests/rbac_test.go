@@ -0,0 +1,122 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRBAC(t *testing.T) {
+	policy, err := confmgr.NewRBACPolicy(config.RBACConfig{
+		Enabled: true,
+		Rules: []config.RBACRuleConfig{
+			config.RBACRuleConfig{Name: "no-global", Identities: []string{"dbteam"}, Verbs: []string{"write", "delete"}, Keys: []string{"cfg:global*"}, Effect: "deny"},
+			config.RBACRuleConfig{Name: "dbteam", Identities: []string{"dbteam"}, Verbs: []string{"*"}, Keys: []string{"cfg:databases*"}},
+			config.RBACRuleConfig{Name: "readers", Identities: []string{"*"}, Verbs: []string{"read", "list", "lookup"}, Keys: []string{"*"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ERROR: Cannot compile policy: %s", err)
+	}
+
+	dbteam := &confmgr.Principal{Name: "dbteam", Method: "token"}
+
+	type TestEntry struct {
+		Principal *confmgr.Principal
+		Verb      string
+		Key       string
+		Allowed   bool
+	}
+
+	testdata := []TestEntry{
+		TestEntry{dbteam, "write", "cfg:databases:main", true},
+		TestEntry{dbteam, "delete", "cfg:databases", true},
+		TestEntry{dbteam, "write", "cfg:global", false},
+		TestEntry{dbteam, "read", "cfg:global", true},
+		TestEntry{nil, "lookup", "db", true},
+		TestEntry{nil, "write", "cfg:databases:main", false},
+	}
+
+	for idx, e := range testdata {
+		err := policy.Check(e.Principal, e.Verb, e.Key)
+		t.Logf("Test %d: %v %s %s", idx, e.Principal, e.Verb, e.Key)
+		t.Logf("  Expected: allowed=%t", e.Allowed)
+		t.Logf("  Actual  : %v", err)
+		if (err == nil) != e.Allowed {
+			t.Fail()
+		}
+	}
+
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Auth = config.AuthConfig{Enabled: true, Tokens: map[string]string{"dbteam": "t0ken"}}
+	cfg.RBAC = config.RBACConfig{
+		Enabled: true,
+		Rules: []config.RBACRuleConfig{
+			config.RBACRuleConfig{Name: "no-global", Identities: []string{"dbteam"}, Verbs: []string{"delete"}, Keys: []string{"cfg:global*"}, Effect: "deny"},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	r := httptest.NewRequest("DELETE", "/admin/key/global", nil)
+	r.Header.Set("Authorization", "Bearer t0ken")
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "no-global") {
+		t.Fatalf("Expected 403 naming rule no-global, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRBACLookup(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"default"}
+	cfg.RBAC = config.RBACConfig{
+		Enabled: true,
+		Rules: []config.RBACRuleConfig{
+			config.RBACRuleConfig{Name: "db", Identities: []string{"*"}, Verbs: []string{"lookup", "read"}, Keys: []string{cfg.Main.KeyPrefix + "db*"}},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	for _, key := range []string{"db", "dbcreds", "default:db", "default:dbcreds", "default:motd"} {
+		b.DeleteKey(cfg.Main.KeyPrefix + key)
+	}
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Path   string
+		Expect int
+	}
+
+	// The same glob covers lookups and reads
+	testdata := []TestEntry{
+		TestEntry{"/string/db", http.StatusNotFound},
+		TestEntry{"/hash/dbcreds/user", http.StatusNotFound},
+		TestEntry{"/string/motd", http.StatusForbidden},
+		TestEntry{"/admin/key/db", http.StatusNotFound},
+		TestEntry{"/admin/key/motd", http.StatusForbidden},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: GET %s", idx, e.Path)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("GET", e.Path, nil))
+		t.Logf("  Expected: %d", e.Expect)
+		t.Logf("  Actual  : %d %s", w.Code, strings.TrimSpace(w.Body.String()))
+		if w.Code != e.Expect {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFacts(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	b := overlay.New(emptyBackend{})
+	b.DeleteKey(srv.Config.Main.MetaPrefix + "registry:unknown")
+
+	if err := srv.SetFacts("Host1", map[string]string{"site": "lon", "group": "web"}, b); err != nil {
+		t.Fatalf("ERROR: Cannot set facts: %s", err)
+	}
+
+	type TestEntry struct {
+		Identity string
+		Expect   map[string]string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"host1", map[string]string{"site": "lon", "group": "web"}},
+		TestEntry{"HOST1", map[string]string{"site": "lon", "group": "web"}},
+		TestEntry{"unknown", map[string]string{}},
+	}
+
+	for idx, e := range testdata {
+		facts, err := srv.GetFacts(e.Identity, b)
+		t.Logf("Test %d: facts of %s", idx, e.Identity)
+		t.Logf("  Expected: %q", e.Expect)
+		t.Logf("  Actual  : %q", facts)
+		if err != nil || !compareScopes(facts, e.Expect) {
+			t.Fail()
+		}
+	}
+}
+
+func TestExpandScope(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	b := overlay.New(emptyBackend{})
+	b.DeleteKey(srv.Config.Main.MetaPrefix + "registry:unknown")
+	srv.SetFacts("host1", map[string]string{"site": "lon", "group": "web"}, b)
+
+	type TestEntry struct {
+		Scope  map[string]string
+		Expect map[string]string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{
+			map[string]string{"site": "ams"},
+			map[string]string{"site": "ams"},
+		},
+		TestEntry{
+			map[string]string{"fqdn": "unknown", "site": "ams"},
+			map[string]string{"fqdn": "unknown", "site": "ams"},
+		},
+		TestEntry{
+			map[string]string{"fqdn": "host1", "site": "ams", "env": "dev"},
+			map[string]string{"fqdn": "host1", "site": "lon", "group": "web", "env": "dev"},
+		},
+	}
+
+	for idx, e := range testdata {
+		scope, err := srv.ExpandScope(e.Scope, b)
+		t.Logf("Test %d: expanding %q", idx, e.Scope)
+		t.Logf("  Expected: %q", e.Expect)
+		t.Logf("  Actual  : %q", scope)
+		if err != nil || !compareScopes(scope, e.Expect) {
+			t.Fail()
+		}
+	}
+}
+
+func TestScopePrecedence(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"sites:%{site}"}
+	cfg.Auth = config.AuthConfig{
+		Enabled: true,
+		JWT:     config.JWTConfig{Algorithm: "HS256", Secret: "s3cret"},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	srv.SetFacts("host1", map[string]string{"site": "lon"}, b)
+	srv.SetFacts("host2", map[string]string{"site": "ber"}, b)
+	for _, site := range []string{"lon", "ber", "ams", "par"} {
+		b.SetString(cfg.Main.KeyPrefix+"sites:"+site+":motd", site)
+	}
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		TokenScope map[string]string
+		Expect     string
+	}
+
+	// The client claims host1 in site par
+	testdata := []TestEntry{
+		TestEntry{nil, "lon"},
+		TestEntry{map[string]string{"site": "ams"}, "ams"},
+		TestEntry{map[string]string{"fqdn": "host2"}, "ber"},
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	for idx, e := range testdata {
+		claims := map[string]interface{}{"sub": "deploy", "exp": exp}
+		if e.TokenScope != nil {
+			claims["scope"] = e.TokenScope
+		}
+		r := httptest.NewRequest("GET", "/string/motd", nil)
+		r.Header.Set("Authorization", "Bearer "+signJWT("s3cret", claims))
+		r.Header.Set("X-Cfg-Fqdn", "host1")
+		r.Header.Set("X-Cfg-Site", "par")
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, r)
+		t.Logf("Test %d: token scope %q", idx, e.TokenScope)
+		t.Logf("  Expected: %d motd of %s", http.StatusOK, e.Expect)
+		t.Logf("  Actual  : %d %s", w.Code, w.Body.String())
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"value":"`+e.Expect+`"`) {
+			t.Fail()
+		}
+	}
+}
+
+func compareScopes(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for token, value := range a {
+		if b[token] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,165 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Holds the first key type lookup until released, like a slow backend
+type slowBackend struct {
+	*overlay.ConfigBackendOverlay
+	once    *sync.Once
+	started chan bool
+	release chan bool
+}
+
+func (b slowBackend) GetType(key string) (int, error) {
+	b.once.Do(func() {
+		b.started <- true
+		<-b.release
+	})
+	return b.ConfigBackendOverlay.GetType(key)
+}
+
+func TestReload(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+
+	f, err := ioutil.TempFile("", "confmgr-reload")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create config file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	srv.ConfigPath = f.Name()
+
+	type TestEntry struct {
+		Config    string
+		Valid     bool
+		KeyPrefix string
+	}
+
+	backend := "[backends.redis]\nport = 6379\naddress = \"127.0.0.1\"\n"
+	testdata := []TestEntry{
+		TestEntry{backend + "[main]\nkey_prefix = \"new:\"\nkey_paths = [\"default\"]\n", true, "new:"},
+		TestEntry{backend + "[main]\nkey_prefix = \"broken:\"\nkey_paths = [\"sites:%{site\"]\n", false, "new:"},
+		TestEntry{backend + "[main]\nkey_prefix = \"other:\"\nlog_level = \"loud\"\n", false, "new:"},
+		TestEntry{"[main]\nkey_prefix = \"other:\"\n", false, "new:"},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Reloading %q", idx, e.Config)
+		if err := ioutil.WriteFile(f.Name(), []byte(e.Config), 0644); err != nil {
+			t.Fatalf("ERROR: Cannot write config file: %s", err)
+		}
+		err := srv.Reload()
+		t.Logf("  Expected: valid=%t / %s", e.Valid, e.KeyPrefix)
+		t.Logf("  Actual  : error=%v / %s", err, srv.Config.Main.KeyPrefix)
+		if (err == nil) != e.Valid || srv.Config.Main.KeyPrefix != e.KeyPrefix {
+			t.Fail()
+		}
+	}
+}
+
+func TestReloadStartsTasks(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+
+	f, err := ioutil.TempFile("", "confmgr-reload")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create config file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	srv.ConfigPath = f.Name()
+
+	type TestEntry struct {
+		Config     string
+		Start      bool
+		Watching   bool
+		Scheduling bool
+	}
+
+	backend := "[backends.redis]\nport = 6379\naddress = \"127.0.0.1\"\n"
+	testdata := []TestEntry{
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nwatch_interval = 0\nschedule_interval = 0\n", false, false, false},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nwatch_interval = 3600\nschedule_interval = 3600\n", false, false, false},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nwatch_interval = 0\nschedule_interval = 0\n", true, false, false},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nwatch_interval = 3600\nschedule_interval = 0\n", false, true, false},
+		TestEntry{backend + "[main]\nkey_prefix = \"cfg:\"\nwatch_interval = 3600\nschedule_interval = 3600\n", false, true, true},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Reloading %q", idx, e.Config)
+		if err := ioutil.WriteFile(f.Name(), []byte(e.Config), 0644); err != nil {
+			t.Fatalf("ERROR: Cannot write config file: %s", err)
+		}
+		if err := srv.Reload(); err != nil {
+			t.Fatalf("ERROR: Cannot reload: %s", err)
+		}
+		// Only a started server runs the loops
+		if e.Start {
+			srv.StartBackgroundTasks()
+		}
+		watching, scheduling := srv.BackgroundTasks()
+		t.Logf("  Expected: watching=%t scheduling=%t", e.Watching, e.Scheduling)
+		t.Logf("  Actual  : watching=%t scheduling=%t", watching, scheduling)
+		if watching != e.Watching || scheduling != e.Scheduling {
+			t.Fail()
+		}
+	}
+}
+
+func TestReloadDuringRequest(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+
+	f, err := ioutil.TempFile("", "confmgr-reload")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create config file: %s", err)
+	}
+	defer os.Remove(f.Name())
+	srv.ConfigPath = f.Name()
+
+	b := slowBackend{overlay.New(emptyBackend{}), &sync.Once{}, make(chan bool), make(chan bool)}
+	b.SetString(srv.Config.Main.KeyPrefix+"motd", "hello")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	w := httptest.NewRecorder()
+	served := make(chan bool)
+	go func() {
+		srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/key/motd", nil))
+		close(served)
+	}()
+	<-b.started
+
+	backend := "[backends.redis]\nport = 6379\naddress = \"127.0.0.1\"\n"
+	if err := ioutil.WriteFile(f.Name(), []byte(backend+"[main]\nkey_prefix = \"new:\"\n"), 0644); err != nil {
+		t.Fatalf("ERROR: Cannot write config file: %s", err)
+	}
+	reloaded := make(chan error)
+	go func() { reloaded <- srv.Reload() }()
+	select {
+	case err := <-reloaded:
+		if err != nil {
+			t.Fatalf("ERROR: Cannot reload: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		close(b.release)
+		t.Fatal("Reload waited for a request in flight")
+	}
+	close(b.release)
+	<-served
+
+	// The request keeps the key prefix it started with
+	t.Logf("  Expected: %d hello / new:", http.StatusOK)
+	t.Logf("  Actual  : %d %s / %s", w.Code, strings.TrimSpace(w.Body.String()), srv.Config.Main.KeyPrefix)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hello") || srv.Config.Main.KeyPrefix != "new:" {
+		t.Fail()
+	}
+}
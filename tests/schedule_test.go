@@ -0,0 +1,150 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/backends/overlay"
+	"github.com/moensch/confmgr/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A backend without keys, so overlays can list theirs
+type emptyBackend struct {
+	backend.ConfigBackend
+}
+
+func (e emptyBackend) ListKeys(filter string) ([]string, error) {
+	return []string{}, nil
+}
+
+func TestSchedule(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.RBAC = config.RBACConfig{
+		Enabled: true,
+		Rules: []config.RBACRuleConfig{
+			config.RBACRuleConfig{Name: "keys", Identities: []string{"*"}, Verbs: []string{"*"}, Keys: []string{cfg.Main.KeyPrefix + "*"}},
+		},
+	}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(emptyBackend{})
+	for _, key := range []string{"motd", "groups"} {
+		b.DeleteKey(cfg.Main.KeyPrefix + key)
+		b.DeleteKey(cfg.Main.MetaPrefix + "history:" + cfg.Main.KeyPrefix + key)
+	}
+	index := cfg.Main.MetaPrefix + "pending_schedules:" + srv.Namespace
+	b.DeleteKey(index)
+	b.SetString(cfg.Main.KeyPrefix+"motd", "before")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	schedule := func(applyAt time.Time, op string) (int, string) {
+		body := `{"apply_at": "` + applyAt.Format(time.RFC3339) + `", "ops": [` + op + `]}`
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/schedule", strings.NewReader(body)))
+		var resp confmgr.ScheduleResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Data.ID
+	}
+
+	now := time.Now()
+	_, due := schedule(now.Add(-time.Minute), `{"op": "set", "key": "motd", "type": "string", "data": "maintenance"}`)
+	_, later := schedule(now.Add(time.Hour), `{"op": "delete", "key": "motd"}`)
+	_, failing := schedule(now.Add(-time.Minute), `{"op": "append", "key": "groups", "data": "web"}`)
+	code, _ := schedule(now, `{"op": "rename", "key": "motd"}`)
+	t.Logf("Invalid op: Expected %d, Actual %d", http.StatusBadRequest, code)
+	if code != http.StatusBadRequest {
+		t.Fail()
+	}
+
+	// The key becomes a string before the append is due
+	b.SetString(cfg.Main.KeyPrefix+"groups", "web")
+	// Left in the index by a change set that is gone
+	b.DeleteKey(cfg.Main.MetaPrefix + "schedule:" + srv.Namespace + ":gone")
+	b.SetHashField(index, "gone", now.Add(-time.Hour).Format(time.RFC3339Nano))
+	if err := srv.ApplyDueSchedules(now, b); err != nil {
+		t.Fatalf("ERROR: Cannot apply scheduled changes: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/schedule/"+later, nil))
+	t.Logf("Cancel: Expected %d, Actual %d", http.StatusOK, w.Code)
+	if w.Code != http.StatusOK {
+		t.Fail()
+	}
+	w = httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("DELETE", "/admin/schedule/"+due, nil))
+	t.Logf("Cancel applied: Expected %d, Actual %d", http.StatusConflict, w.Code)
+	if w.Code != http.StatusConflict {
+		t.Fail()
+	}
+	srv.ApplyDueSchedules(now.Add(2*time.Hour), b)
+
+	// Listed by the keys the changes write, not the keys they are stored in
+	w = httptest.NewRecorder()
+	srv.Router.ServeHTTP(w, httptest.NewRequest("GET", "/admin/schedule", nil))
+	var list confmgr.ScheduleListResponse
+	json.Unmarshal(w.Body.Bytes(), &list)
+	t.Logf("List: Expected %d, 3 changes", http.StatusOK)
+	t.Logf("List: Actual   %d, %d changes", w.Code, len(list.Data))
+	if w.Code != http.StatusOK || len(list.Data) != 3 {
+		t.Fail()
+	}
+
+	type TestEntry struct {
+		ID     string
+		Expect string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{due, confmgr.ScheduleApplied},
+		TestEntry{later, confmgr.ScheduleCancelled},
+		TestEntry{failing, confmgr.ScheduleFailed},
+	}
+
+	for idx, e := range testdata {
+		change, err := srv.GetSchedule(e.ID, b)
+		if err != nil || change == nil {
+			t.Fatalf("ERROR: Cannot read scheduled change %s: %v", e.ID, err)
+		}
+		t.Logf("Test %d: scheduled change %s", idx, e.ID)
+		t.Logf("  Expected: %s", e.Expect)
+		t.Logf("  Actual  : %s %s", change.Status, change.Error)
+		if change.Status != e.Expect {
+			t.Fail()
+		}
+	}
+
+	motd, _ := b.GetString(cfg.Main.KeyPrefix + "motd")
+	t.Logf("Expected: motd 'maintenance'")
+	t.Logf("Actual  : motd '%s'", motd)
+	if motd != "maintenance" {
+		t.Fail()
+	}
+
+	// Closed changes leave the index and are kept for main.change_retention
+	pending, _ := b.GetHash(index)
+	t.Logf("Expected: no pending changes")
+	t.Logf("Actual  : %v", pending)
+	if len(pending) != 0 {
+		t.Fail()
+	}
+	for _, e := range testdata {
+		at, _ := b.GetExpiry(cfg.Main.MetaPrefix + "schedule:" + srv.Namespace + ":" + e.ID)
+		left := time.Until(at)
+		t.Logf("Expected: %s expires in 720h", e.ID)
+		t.Logf("Actual  : %s expires in %s", e.ID, left)
+		if left > 720*time.Hour || left < 719*time.Hour {
+			t.Fail()
+		}
+	}
+}
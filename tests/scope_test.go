@@ -0,0 +1,101 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/config"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScopeChain(t *testing.T) {
+	cfg := config.ScopeConfig{
+		Sources:     []string{"query", "body", "header"},
+		QueryPrefix: "scope.",
+	}
+	chain, err := confmgr.NewScopeChain(cfg, "x-cfg-")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot build scope chain: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "/hash/db?scope.site=LON", strings.NewReader(`{"scope": {"site": "nyc", "pod": "b"}}`))
+	r.Header.Set("X-Cfg-Site", "sfo")
+	r.Header.Set("X-Cfg-Pod", "a")
+	r.Header.Set("X-Cfg-Group", "web")
+
+	scope, err := chain.Scope(r)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot extract scope: %s", err)
+	}
+
+	expected := map[string]string{
+		"site":  "LON",
+		"pod":   "b",
+		"group": "web",
+	}
+	t.Logf("  Expected: %q", expected)
+	t.Logf("  Actual  : %q", scope)
+	if len(scope) != len(expected) {
+		t.Fail()
+	}
+	for token, value := range expected {
+		if scope[token] != value {
+			t.Fail()
+		}
+	}
+
+	if _, err := confmgr.NewScopeChain(config.ScopeConfig{Sources: []string{"invalid"}}, "x-cfg-"); err == nil {
+		t.Fatal("Expected error for unknown scope source but none occurred")
+	}
+}
+
+func TestScopeValidator(t *testing.T) {
+	cfg := config.ScopeConfig{
+		Rules: map[string]config.ScopeRuleConfig{
+			"site": config.ScopeRuleConfig{Pattern: "^[a-z]{3}$"},
+			"pod":  config.ScopeRuleConfig{Allowed: []string{"a", "b"}},
+		},
+	}
+	validator, err := confmgr.NewScopeValidator(cfg)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot build scope validator: %s", err)
+	}
+
+	type TestEntry struct {
+		Scope map[string]string
+		Valid bool
+	}
+
+	testdata := []TestEntry{
+		TestEntry{map[string]string{"site": "LON", "pod": "a"}, true},
+		TestEntry{map[string]string{"site": "london"}, false},
+		TestEntry{map[string]string{"pod": "c"}, false},
+		TestEntry{map[string]string{"fqdn": "web01:db"}, false},
+		TestEntry{map[string]string{"fqdn": "web*"}, false},
+		TestEntry{map[string]string{"fqdn": "web 01"}, false},
+		TestEntry{map[string]string{"fq:dn": "web01"}, false},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: Validating %q", idx, e.Scope)
+		scope, err := validator.Normalize(e.Scope)
+		t.Logf("  Expected valid: %t", e.Valid)
+		t.Logf("  Actual        : %q %v", scope, err)
+		if (err == nil) != e.Valid {
+			t.Fail()
+		}
+	}
+
+	scope, _ := validator.Normalize(map[string]string{"site": "LON"})
+	if scope["site"] != "lon" {
+		t.Fatalf("Expected lowercased value but got %s", scope["site"])
+	}
+
+	cfg.PreserveCase = true
+	cfg.Rules = nil
+	validator, _ = confmgr.NewScopeValidator(cfg)
+	scope, _ = validator.Normalize(map[string]string{"fqdn": "Web01"})
+	if scope["fqdn"] != "Web01" {
+		t.Fatalf("Expected preserved case but got %s", scope["fqdn"])
+	}
+}
@@ -0,0 +1,73 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScopeDiff(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Main.KeyPaths = []string{"sites:%{site}", "default"}
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	prefix := cfg.Main.KeyPrefix
+	b := overlay.New(emptyBackend{})
+	b.SetString(prefix+"default:motd", "hello")
+	b.SetString(prefix+"default:db", "db-default")
+	b.SetString(prefix+"sites:lon:db", "db-lon")
+	b.SetString(prefix+"sites:lon:extra", "lon only")
+	b.SetHash(prefix+"default:app", map[string]string{"a": "1", "c": "3"})
+	b.SetHash(prefix+"sites:lon:app", map[string]string{"a": "2", "b": "2"})
+	for _, name := range []string{"motd", "db", "extra", "app"} {
+		b.DeleteKey(prefix + "sites:ams:" + name)
+	}
+	b.DeleteKey(prefix + "default:extra")
+	b.DeleteKey(prefix + "sites:lon:motd")
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Method string
+		Path   string
+		Body   string
+		Expect int
+		Keys   []string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{"GET", "/admin/diff?a.site=lon&b.site=ams", "", http.StatusOK, []string{"app/a", "app/b", "db", "extra"}},
+		TestEntry{"GET", "/admin/diff?a.site=lon&b.site=LON", "", http.StatusOK, []string{}},
+		TestEntry{"GET", "/admin/diff?a.site=lon&b.site=ams&key=motd", "", http.StatusOK, []string{}},
+		TestEntry{"GET", "/admin/diff?a.site=lon&b.site=ams&key=db&key=missing", "", http.StatusOK, []string{"db"}},
+		TestEntry{"POST", "/admin/diff", `{"a": {"site": "ams"}, "b": {"site": "lon"}, "keys": ["extra"]}`, http.StatusOK, []string{"extra"}},
+		TestEntry{"GET", "/admin/diff?a.site=lon:1&b.site=ams", "", http.StatusBadRequest, []string{}},
+		TestEntry{"POST", "/admin/diff", `{"a": {"site": "lon"}, "b": {"site*": "ams"}}`, http.StatusBadRequest, []string{}},
+		TestEntry{"POST", "/admin/diff", `{"a": `, http.StatusBadRequest, []string{}},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: %s %s %s", idx, e.Method, e.Path, e.Body)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest(e.Method, e.Path, strings.NewReader(e.Body)))
+		var resp confmgr.ScopeDiffResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		keys := make([]string, len(resp.Data))
+		for i, entry := range resp.Data {
+			keys[i] = entry.Key
+		}
+		t.Logf("  Expected: %d %s", e.Expect, strings.Join(e.Keys, " "))
+		t.Logf("  Actual  : %d %s", w.Code, strings.Join(keys, " "))
+		if w.Code != e.Expect || strings.Join(keys, " ") != strings.Join(e.Keys, " ") {
+			t.Fail()
+		}
+	}
+}
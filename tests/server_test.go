@@ -0,0 +1,49 @@
+package confmgr
+
+import (
+	"context"
+	"github.com/moensch/confmgr"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot listen: %s", err)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	resp, err := http.Get("http://" + listener.Addr().String() + "/")
+	if err != nil {
+		t.Fatalf("ERROR: Request failed: %s", err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatalf("ERROR: Shutdown failed: %s", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Expected Serve to return nil after shutdown, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after shutdown")
+	}
+
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Fatal("Expected request after shutdown to fail but it succeeded")
+	}
+}
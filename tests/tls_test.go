@@ -0,0 +1,141 @@
+package confmgr
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/moensch/confmgr"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	Cert     *x509.Certificate
+	Key      *ecdsa.PrivateKey
+	CertFile string
+	KeyFile  string
+}
+
+func newTestCert(t *testing.T, dir string, name string, template *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot generate key: %s", err)
+	}
+
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create certificate: %s", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	c := &testCert{
+		Cert:     cert,
+		Key:      key,
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	ioutil.WriteFile(c.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(c.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "confmgr-tls")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot create directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca", &x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, dir, "server", &x509.Certificate{
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client := newTestCert(t, dir, "web01", &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	cfg.Listen.TLS.CertFile = server.CertFile
+	cfg.Listen.TLS.KeyFile = server.KeyFile
+	cfg.Listen.TLS.ClientCA = ca.CertFile
+	cfg.Listen.TLS.ClientAuth = "require"
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ERROR: Cannot listen: %s", err)
+	}
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	clientPair, err := tls.LoadX509KeyPair(client.CertFile, client.KeyFile)
+	if err != nil {
+		t.Fatalf("ERROR: Cannot load client certificate: %s", err)
+	}
+
+	type TestEntry struct {
+		Certificates []tls.Certificate
+		Success      bool
+	}
+
+	testdata := []TestEntry{
+		TestEntry{[]tls.Certificate{clientPair}, true},
+		TestEntry{nil, false},
+	}
+
+	for idx, e := range testdata {
+		httpClient := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: e.Certificates},
+		}}
+		resp, err := httpClient.Get("https://" + listener.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		t.Logf("Test %d: Request with %d client certificates", idx, len(e.Certificates))
+		t.Logf("  Expected: success=%t", e.Success)
+		t.Logf("  Actual  : error=%v", err)
+		if (err == nil) != e.Success {
+			t.Fail()
+		}
+	}
+
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{client.Cert},
+		VerifiedChains:   [][]*x509.Certificate{[]*x509.Certificate{client.Cert, ca.Cert}},
+	}
+	if identity := srv.ClientIdentity(r); identity != "web01" {
+		t.Fatalf("Expected client identity web01, got '%s'", identity)
+	}
+}
@@ -0,0 +1,74 @@
+package confmgr
+
+import (
+	"github.com/moensch/confmgr"
+	"github.com/moensch/confmgr/backends/overlay"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	srv, _ := confmgr.NewConfMgr()
+	cfg := srv.Config
+	if err := srv.ApplyConfig(cfg); err != nil {
+		t.Fatalf("ERROR: Cannot apply config: %s", err)
+	}
+
+	b := overlay.New(nil)
+	for _, key := range []string{"databases", "groups", "motd"} {
+		b.DeleteKey(cfg.Main.KeyPrefix + key)
+		b.DeleteKey(cfg.Main.MetaPrefix + "history:" + cfg.Main.KeyPrefix + key)
+	}
+	oldFactory := confmgr.BackendFactory
+	confmgr.BackendFactory = overlayFactory{b}
+	defer func() { confmgr.BackendFactory = oldFactory }()
+
+	type TestEntry struct {
+		Body   string
+		Expect int
+		Motd   string
+	}
+
+	testdata := []TestEntry{
+		TestEntry{`{"ops": [
+			{"op": "set", "key": "databases", "type": "hash", "data": {"host": "db1"}},
+			{"op": "set", "key": "groups", "type": "list", "data": ["web"]},
+			{"op": "set", "key": "motd", "type": "string", "data": "hello"}]}`, http.StatusOK, "hello"},
+		TestEntry{`{"preconditions": [{"key": "databases", "exists": false}],
+			"ops": [{"op": "set", "key": "motd", "type": "string", "data": "x"}]}`, http.StatusPreconditionFailed, "hello"},
+		TestEntry{`{"ops": [
+			{"op": "set", "key": "motd", "type": "string", "data": "x"},
+			{"op": "append", "key": "databases", "data": "db2"}]}`, http.StatusBadRequest, "hello"},
+		TestEntry{`{"preconditions": [{"key": "databases", "version": 1}, {"key": "motd", "value": {"type": "string", "data": "hello"}}],
+			"ops": [
+			{"op": "set_field", "key": "databases", "field": "port", "data": "5432"},
+			{"op": "append", "key": "groups", "data": "db"},
+			{"op": "delete", "key": "motd"}]}`, http.StatusOK, ""},
+		TestEntry{`{"preconditions": [{"key": "databases", "version": 1}],
+			"ops": [{"op": "set", "key": "motd", "type": "string", "data": "x"}]}`, http.StatusPreconditionFailed, ""},
+		TestEntry{`{"ops": [{"op": "rename", "key": "motd"}]}`, http.StatusBadRequest, ""},
+		TestEntry{`{"ops": [{"op": "set", "key": "motd", "type": "hash", "data": "x"}]}`, http.StatusBadRequest, ""},
+	}
+
+	for idx, e := range testdata {
+		t.Logf("Test %d: POST /admin/txn %s", idx, e.Body)
+		w := httptest.NewRecorder()
+		srv.Router.ServeHTTP(w, httptest.NewRequest("POST", "/admin/txn", strings.NewReader(e.Body)))
+		motd, _ := b.GetString(cfg.Main.KeyPrefix + "motd")
+		t.Logf("  Expected: %d, motd '%s'", e.Expect, e.Motd)
+		t.Logf("  Actual  : %d, motd '%s'", w.Code, motd)
+		if w.Code != e.Expect || motd != e.Motd {
+			t.Fail()
+		}
+	}
+
+	groups, _ := b.GetList(cfg.Main.KeyPrefix + "groups")
+	port, _ := b.GetHashField(cfg.Main.KeyPrefix+"databases", "port")
+	t.Logf("Expected: groups [web db], port 5432")
+	t.Logf("Actual  : groups %v, port %s", groups, port)
+	if len(groups) != 2 || groups[1] != "db" || port != "5432" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,189 @@
+package confmgr
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/config"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often certificate files are checked for changes
+const certCheckInterval = 10 * time.Second
+
+var clientAuthModes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+/*
+ * Holds the server certificate and client CA pool, re-reading the files
+ * when they change so rotated certificates are used without a restart
+ */
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	caPool    *x509.CertPool
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string, caFile string) (*CertReloader, error) {
+	r := &CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		CAFile:   caFile,
+		modTimes: make(map[string]time.Time),
+	}
+	if err := r.load(); err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) files() []string {
+	files := []string{r.CertFile, r.KeyFile}
+	if r.CAFile != "" {
+		files = append(files, r.CAFile)
+	}
+	return files
+}
+
+func (r *CertReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var caPool *x509.CertPool
+	if r.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.CAFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in %s", r.CAFile)
+		}
+	}
+
+	r.cert = &cert
+	r.caPool = caPool
+	r.modTimes = modTimes
+	return nil
+}
+
+/*
+ * Reload the files if any of them changed since the last check. A failed
+ * reload keeps the current certificates, a half-written file is picked up
+ * on a later check.
+ */
+func (r *CertReloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.lastCheck) < certCheckInterval {
+		return
+	}
+	r.lastCheck = time.Now()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[file]) {
+			if err := r.load(); err != nil {
+				log.Errorf("Cannot reload TLS certificates, keeping current ones: %s", err)
+				return
+			}
+			log.Infof("Reloaded TLS certificate from %s", r.CertFile)
+			return
+		}
+	}
+}
+
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) ClientCAs() *x509.CertPool {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.caPool
+}
+
+/*
+ * Build the listener's TLS config, nil if TLS is not enabled
+ */
+func NewTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	clientAuth, ok := clientAuthModes[cfg.ClientAuth]
+	if !ok {
+		return nil, fmt.Errorf("Invalid client_auth '%s'", cfg.ClientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.ClientCA == "" {
+		return nil, fmt.Errorf("client_auth '%s' needs client_ca", cfg.ClientAuth)
+	}
+
+	reloader, err := NewCertReloader(cfg.CertFile, cfg.KeyFile, cfg.ClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		ClientAuth:     clientAuth,
+		GetCertificate: reloader.GetCertificate,
+	}
+	// Hand out the current CA pool on every handshake
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			ClientAuth:     clientAuth,
+			ClientCAs:      reloader.ClientCAs(),
+			GetCertificate: reloader.GetCertificate,
+		}, nil
+	}
+
+	return tlsConfig, nil
+}
+
+/*
+ * Return the identity of a client that presented a verified certificate,
+ * taken from the configured certificate field. Empty for anonymous clients.
+ */
+func (c *ConfMgr) ClientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	identity, err := CertField(r.TLS.PeerCertificates[0], c.Config.Listen.TLS.IdentityField)
+	if err != nil {
+		return ""
+	}
+	return identity
+}
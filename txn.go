@@ -0,0 +1,522 @@
+package confmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/moensch/confmgr/backends"
+	"github.com/moensch/confmgr/vars"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	TxnSet      = "set"
+	TxnSetField = "set_field"
+	TxnAppend   = "append"
+	TxnDelete   = "delete"
+)
+
+/*
+ * A single write in a transaction. Data is a string, hash or list for
+ * set, and a string for set_field and append. TTL and ExpiresAt are only
+ * parsed to reject them, expiry is set by single key writes.
+ */
+type TxnOp struct {
+	Op        string      `json:"op"`
+	Key       string      `json:"key"`
+	Field     string      `json:"field,omitempty"`
+	Type      string      `json:"type,omitempty"`
+	Data      interface{} `json:"data,omitempty"`
+	TTL       interface{} `json:"ttl,omitempty"`
+	ExpiresAt string      `json:"expires_at,omitempty"`
+}
+
+/*
+ * A condition on the current state of a key. Only the given fields are
+ * checked; version is the last version in the key's history.
+ */
+type TxnPrecondition struct {
+	Key     string          `json:"key"`
+	Exists  *bool           `json:"exists,omitempty"`
+	ETag    string          `json:"etag,omitempty"`
+	Version *int            `json:"version,omitempty"`
+	Value   *GenericRequest `json:"value,omitempty"`
+}
+
+type TxnRequest struct {
+	Preconditions []TxnPrecondition `json:"preconditions"`
+	Ops           []TxnOp           `json:"ops"`
+}
+
+type TxnResult struct {
+	Key     string `json:"key"`
+	ETag    string `json:"etag,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+type TxnResponse struct {
+	Type string      `json:"type"`
+	Data []TxnResult `json:"data"`
+}
+
+func (r TxnResponse) ToString() string {
+	lines := make([]string, len(r.Data))
+	for idx, result := range r.Data {
+		if result.Deleted {
+			lines[idx] = result.Key + " deleted"
+		} else {
+			lines[idx] = result.Key + " " + result.ETag
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r TxnResponse) ToJsonString() (string, error) {
+	var retval string
+	jsonblob, err := json.Marshal(r)
+	if err != nil {
+		return retval, err
+	}
+	return string(jsonblob), err
+}
+
+/*
+ * An invalid transaction, nothing was written
+ */
+type TxnError struct {
+	Message string
+}
+
+func (e TxnError) Error() string {
+	return e.Message
+}
+
+/*
+ * A precondition that does not hold, nothing was written
+ */
+type PreconditionError struct {
+	Message string
+}
+
+func (e PreconditionError) Error() string {
+	return e.Message
+}
+
+var txnKeyTypes = map[string]int{
+	"string": vars.TYPE_STRING,
+	"hash":   vars.TYPE_HASH,
+	"list":   vars.TYPE_LIST,
+}
+
+/*
+ * Convert the data of a set operation to the value it stores
+ */
+func txnValue(keyType string, data interface{}) (KeyResponse, error) {
+	switch keyType {
+	case "string":
+		if value, ok := data.(string); ok {
+			return &StringKeyResponse{keyType, value}, nil
+		}
+	case "hash":
+		if fields, ok := data.(map[string]interface{}); ok {
+			value := make(map[string]string)
+			for field, v := range fields {
+				str, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("hash field %s must be a string", field)
+				}
+				value[field] = str
+			}
+			return &HashKeyResponse{keyType, value}, nil
+		}
+	case "list":
+		if entries, ok := data.([]interface{}); ok {
+			value := make([]string, len(entries))
+			for idx, v := range entries {
+				str, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("list entry %d must be a string", idx)
+				}
+				value[idx] = str
+			}
+			return &ListKeyResponse{keyType, value}, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported key type: %s", keyType)
+	}
+	return nil, fmt.Errorf("data does not match type %s", keyType)
+}
+
+/*
+ * Prefix key names and check the operations, before anything is read
+ */
+func (c *ConfMgr) prepareTxn(txn *TxnRequest) error {
+	if len(txn.Ops) == 0 {
+		return TxnError{"Transaction has no operations"}
+	}
+
+	prefix := func(key string) string {
+		if !strings.HasPrefix(key, c.Config.Main.KeyPrefix) {
+			return c.Config.Main.KeyPrefix + key
+		}
+		return key
+	}
+
+	for idx := range txn.Preconditions {
+		p := &txn.Preconditions[idx]
+		if p.Key == "" {
+			return TxnError{fmt.Sprintf("preconditions[%d]: key must be set", idx)}
+		}
+		p.Key = prefix(p.Key)
+	}
+
+	for idx := range txn.Ops {
+		op := &txn.Ops[idx]
+		if op.Key == "" {
+			return TxnError{fmt.Sprintf("ops[%d]: key must be set", idx)}
+		}
+		op.Key = prefix(op.Key)
+		if op.TTL != nil || op.ExpiresAt != "" {
+			return TxnError{fmt.Sprintf("ops[%d]: %s", idx, errExpiryUnsupported)}
+		}
+
+		switch op.Op {
+		case TxnSet:
+			if _, err := txnValue(op.Type, op.Data); err != nil {
+				return TxnError{fmt.Sprintf("ops[%d]: %s", idx, err)}
+			}
+		case TxnSetField, TxnAppend:
+			if _, ok := op.Data.(string); !ok {
+				return TxnError{fmt.Sprintf("ops[%d]: data must be a string", idx)}
+			}
+			if op.Op == TxnSetField && op.Field == "" {
+				return TxnError{fmt.Sprintf("ops[%d]: field must be set", idx)}
+			}
+		case TxnDelete:
+		default:
+			return TxnError{fmt.Sprintf("ops[%d]: unknown op '%s'", idx, op.Op)}
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Check the preconditions and that field sets and appends target keys
+ * of the right type. Runs while the keys are watched.
+ */
+func (c *ConfMgr) checkTxn(txn TxnRequest, b backend.ConfigBackend) error {
+	for _, p := range txn.Preconditions {
+		current, err := c.ReadKey(p.Key, b)
+		if err != nil {
+			return err
+		}
+
+		if p.Exists != nil && *p.Exists != (current != nil) {
+			return PreconditionError{fmt.Sprintf("%s: exists is %t", p.Key, current != nil)}
+		}
+		if p.ETag != "" {
+			etag := ""
+			if current != nil {
+				if etag, err = KeyETag(current); err != nil {
+					return err
+				}
+			}
+			if !etagMatches(p.ETag, etag, false) {
+				return PreconditionError{fmt.Sprintf("%s: etag does not match", p.Key)}
+			}
+		}
+		if p.Version != nil {
+			history, err := c.KeyHistory(p.Key, b)
+			if err != nil {
+				return err
+			}
+			version := 0
+			if len(history) > 0 {
+				version = history[len(history)-1].Version
+			}
+			if version != *p.Version {
+				return PreconditionError{fmt.Sprintf("%s: current version is %d", p.Key, version)}
+			}
+		}
+		if p.Value != nil {
+			expected, err := txnValue(p.Value.Type, p.Value.Data)
+			if err != nil {
+				return TxnError{fmt.Sprintf("%s: precondition value: %s", p.Key, err)}
+			}
+			expectedTag, _ := KeyETag(expected)
+			currentTag := ""
+			if current != nil {
+				currentTag, _ = KeyETag(current)
+			}
+			if expectedTag != currentTag {
+				return PreconditionError{fmt.Sprintf("%s: value does not match", p.Key)}
+			}
+		}
+	}
+
+	// Redis does not roll back commands failing inside EXEC
+	wanted := map[string]int{TxnSetField: vars.TYPE_HASH, TxnAppend: vars.TYPE_LIST}
+	types := make(map[string]int)
+	for _, op := range txn.Ops {
+		keytype, ok := types[op.Key]
+		if !ok {
+			var err error
+			if keytype, err = b.GetType(op.Key); err != nil {
+				return err
+			}
+		}
+		if want, ok := wanted[op.Op]; ok && keytype != want && keytype != vars.TYPE_NOT_FOUND {
+			return TxnError{fmt.Sprintf("%s: %s needs a %s, key is a %s", op.Key, op.Op, TypeToString(want), TypeToString(keytype))}
+		}
+
+		switch op.Op {
+		case TxnSet:
+			types[op.Key] = txnKeyTypes[op.Type]
+		case TxnDelete:
+			types[op.Key] = vars.TYPE_NOT_FOUND
+		default:
+			types[op.Key] = wanted[op.Op]
+		}
+	}
+
+	return nil
+}
+
+func applyTxn(txn TxnRequest, w backend.ConfigWriter) error {
+	for _, op := range txn.Ops {
+		var err error
+		switch op.Op {
+		case TxnSet:
+			value, _ := txnValue(op.Type, op.Data)
+			switch v := value.(type) {
+			case *StringKeyResponse:
+				err = w.SetString(op.Key, v.Data)
+			case *HashKeyResponse:
+				err = w.SetHash(op.Key, v.Data)
+			case *ListKeyResponse:
+				err = w.SetList(op.Key, v.Data)
+			}
+		case TxnSetField:
+			err = w.SetHashField(op.Key, op.Field, op.Data.(string))
+		case TxnAppend:
+			err = w.ListAppend(op.Key, op.Data.(string))
+		case TxnDelete:
+			err = w.DeleteKey(op.Key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ * Apply a set of writes atomically, if all preconditions hold. Returns
+ * the keys written, in order.
+ */
+func (c *ConfMgr) ApplyTxn(r *http.Request, txn TxnRequest, b backend.ConfigBackend) ([]string, error) {
+	return c.commitTxn(r, AuditTxn, txn, nil, b)
+}
+
+/*
+ * A string key committed together with a transaction, only if it still
+ * has the expected value. Used to claim a stored record exactly once.
+ */
+type txnGuard struct {
+	Key      string
+	Expected string
+	Value    string
+	// Remove the key at this time, zero keeps it
+	Expires time.Time
+	// Further writes committed with the guard
+	Apply func(backend.ConfigWriter) error
+}
+
+func (g *txnGuard) check(b backend.ConfigBackend) error {
+	current, err := b.GetString(g.Key)
+	if err != nil {
+		return err
+	}
+	if current != g.Expected {
+		return backend.ErrConflict
+	}
+	return nil
+}
+
+func (g *txnGuard) write(w backend.ConfigWriter) error {
+	if err := w.SetString(g.Key, g.Value); err != nil {
+		return err
+	}
+	if err := setExpiry(w, g.Key, g.Expires); err != nil {
+		return err
+	}
+	if g.Apply != nil {
+		return g.Apply(w)
+	}
+	return nil
+}
+
+/*
+ * Update the guarded key on its own, ErrConflict if it changed
+ */
+func (g *txnGuard) commit(b backend.ConfigBackend) error {
+	return b.Atomic([]string{g.Key}, func() error {
+		return g.check(b)
+	}, g.write)
+}
+
+func (c *ConfMgr) commitTxn(r *http.Request, op string, txn TxnRequest, guard *txnGuard, b backend.ConfigBackend) ([]string, error) {
+	keys := make([]string, 0, len(txn.Ops))
+	seen := make(map[string]bool)
+	for _, op := range txn.Ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+
+	watch := make([]string, 0)
+	for _, key := range keys {
+		watch = append(watch, key, c.keyHistoryKey(key))
+	}
+	for _, p := range txn.Preconditions {
+		watch = append(watch, p.Key, c.keyHistoryKey(p.Key))
+	}
+	if guard != nil {
+		watch = append(watch, guard.Key)
+	}
+
+	old := make(map[string]KeyResponse)
+	var values map[string]KeyResponse
+	var expiries map[string]time.Time
+	histories := make(map[string][]string)
+	check := func() error {
+		if guard != nil {
+			if err := guard.check(b); err != nil {
+				return err
+			}
+		}
+		if err := c.checkTxn(txn, b); err != nil {
+			return err
+		}
+
+		var err error
+		if values, expiries, err = c.stagedKeys(keys, func(w backend.ConfigWriter) error {
+			return applyTxn(txn, w)
+		}, b); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if values == nil {
+				// Neither audited nor versioned
+				break
+			}
+			if old[key], err = c.ReadKey(key, b); err != nil {
+				return err
+			}
+			entry := KeyVersion{Op: op, ExpiresAt: expiryField(expiries[key])}
+			if histories[key], err = c.nextKeyHistory(r, key, old[key], values[key], entry, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	apply := func(w backend.ConfigWriter) error {
+		if err := applyTxn(txn, w); err != nil {
+			return err
+		}
+		if err := c.storeKeyHistory(histories, w); err != nil {
+			return err
+		}
+		if guard != nil {
+			return guard.write(w)
+		}
+		return nil
+	}
+
+	if err := b.Atomic(watch, check, apply); err != nil {
+		return keys, err
+	}
+
+	for _, key := range keys {
+		c.RecordExpiringChange(r, b, op, key, "", old[key], values[key], expiries[key])
+	}
+	return keys, nil
+}
+
+func (c *ConfMgr) HandleAdminTxn(w http.ResponseWriter, r *http.Request, b backend.ConfigBackend) {
+	if !checkNoExpiry(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+	if err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	if err := r.Body.Close(); err != nil {
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+
+	var txn TxnRequest
+	if err := json.Unmarshal(body, &txn); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid request: %s", err))
+		return
+	}
+	if err := c.prepareTxn(&txn); err != nil {
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid transaction: %s", err))
+		return
+	}
+
+	for _, p := range txn.Preconditions {
+		if !c.checkAccess(w, r, VerbRead, p.Key) {
+			return
+		}
+	}
+	for _, op := range txn.Ops {
+		verb := VerbWrite
+		if op.Op == TxnDelete {
+			verb = VerbDelete
+		}
+		if !c.checkAccess(w, r, verb, op.Key) {
+			return
+		}
+	}
+
+	keys, err := c.ApplyTxn(r, txn, b)
+	switch err.(type) {
+	case nil:
+	case TxnError:
+		SendErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Invalid transaction: %s", err))
+		return
+	case PreconditionError:
+		SendErrorResponse(w, http.StatusPreconditionFailed, fmt.Sprintf("Precondition failed: %s", err))
+		return
+	default:
+		if err == backend.ErrConflict {
+			SendErrorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+		return
+	}
+	log.Infof("Applied transaction with %d operations on %s", len(txn.Ops), strings.Join(keys, ", "))
+
+	resp := TxnResponse{"txn", make([]TxnResult, len(keys))}
+	for idx, key := range keys {
+		etag, err := c.currentETag(key, b)
+		if err != nil {
+			SendErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Backend error: %s", err))
+			return
+		}
+		resp.Data[idx] = TxnResult{key, etag, etag == ""}
+	}
+
+	SendResponse(w, r, resp)
+}